@@ -0,0 +1,167 @@
+package access
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/logging"
+
+	"go.uber.org/zap"
+)
+
+type (
+	// Extractor extracts an identifier, such as an API key, from a request.
+	Extractor func(r *http.Request) string
+
+	// List represents a list of user IDs, API keys and IP ranges, which can be modified at runtime.
+	// Requests match the list if their user ID, API key or remote IP address match any of its entries.
+	List struct {
+		users    *concurrent.Set[string]
+		keys     *concurrent.Set[string]
+		networks *concurrent.Map[string, *net.IPNet]
+	}
+
+	// Lists combines an allowlist, whose matching requests are exempt from rate limits, and a denylist, whose matching
+	// requests are always rejected. The denylist takes precedence over the allowlist.
+	// Users are identified by the rate limiter checking the lists, while API keys are extracted by the configured
+	// Extractor.
+	Lists struct {
+		Allow *List
+		Deny  *List
+		key   Extractor
+	}
+)
+
+// NewList returns a new, empty, list.
+func NewList() *List {
+	return &List{
+		users:    concurrent.NewSet[string](),
+		keys:     concurrent.NewSet[string](),
+		networks: concurrent.NewMap[string, *net.IPNet](),
+	}
+}
+
+// AddUser adds a user ID to the list.
+func (l *List) AddUser(ID string) *List {
+	l.users.Put(ID)
+	return l
+}
+
+// RemoveUser removes a user ID from the list.
+func (l *List) RemoveUser(ID string) {
+	l.users.Remove(ID)
+}
+
+// AddKey adds an API key to the list.
+func (l *List) AddKey(key string) *List {
+	l.keys.Put(key)
+	return l
+}
+
+// RemoveKey removes an API key from the list.
+func (l *List) RemoveKey(key string) {
+	l.keys.Remove(key)
+}
+
+// AddCIDR adds an IP range, in CIDR notation (e.g. 10.0.0.0/8), to the list.
+// It returns an error if the range is invalid.
+func (l *List) AddCIDR(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	l.networks.Put(network.String(), network)
+	return nil
+}
+
+// RemoveCIDR removes an IP range, in CIDR notation, from the list.
+// It returns an error if the range is invalid.
+func (l *List) RemoveCIDR(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	l.networks.Delete(network.String())
+	return nil
+}
+
+// FromHeader returns an Extractor that reads the identifier from the provided request header.
+func FromHeader(name string) Extractor {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Matches returns true if the user ID, the API key or the remote IP address of the request match any entry of the
+// list.
+func (l *List) Matches(r *http.Request, userID, key string) bool {
+	if userID != "" && l.users.Contains(userID) {
+		return true
+	}
+
+	if key != "" && l.keys.Contains(key) {
+		return true
+	}
+
+	ip := RemoteIP(r)
+	if ip == nil {
+		return false
+	}
+
+	for t := range l.networks.Iterate() {
+		if t.Value.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewLists returns new, empty, allow and deny lists. By default, API keys are read from the `X-API-Key` header.
+func NewLists() *Lists {
+	return &Lists{
+		Allow: NewList(),
+		Deny:  NewList(),
+		key:   FromHeader("X-API-Key"),
+	}
+}
+
+// SetKeyExtractor sets the function used to extract the API key of a request. It must be invoked before the lists are
+// used.
+func (l *Lists) SetKeyExtractor(key Extractor) *Lists {
+	l.key = key
+	return l
+}
+
+// Check returns common.Denylisted if the request, issued by the provided user, matches the denylist, or
+// common.Allowlisted if it matches the allowlist. The returned boolean is false if the request matches neither.
+func (l *Lists) Check(r *http.Request, userID string) (common.Outcome, bool) {
+	log := logging.Logger()
+	key := l.key(r)
+
+	if l.Deny.Matches(r, userID, key) {
+		log.Debug("request denylisted", zap.String("path", r.URL.Path), zap.String("remote_addr", r.RemoteAddr))
+		return common.Denylisted, true
+	}
+
+	if l.Allow.Matches(r, userID, key) {
+		log.Debug("request allowlisted", zap.String("path", r.URL.Path), zap.String("remote_addr", r.RemoteAddr))
+		return common.Allowlisted, true
+	}
+
+	return 0, false
+}
+
+// RemoteIP returns the IP address of the client that sent the request, or nil if it cannot be parsed.
+func RemoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
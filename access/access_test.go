@@ -0,0 +1,89 @@
+package access
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRequest(remoteAddr string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest("GET", "/bar", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return req
+}
+
+func TestList_Matches_User(t *testing.T) {
+	l := NewList().AddUser("alice")
+	req := newRequest("10.0.0.1:1234", nil)
+
+	assert.True(t, l.Matches(req, "alice", ""))
+	assert.False(t, l.Matches(req, "bob", ""))
+
+	l.RemoveUser("alice")
+	assert.False(t, l.Matches(req, "alice", ""))
+}
+
+func TestList_Matches_Key(t *testing.T) {
+	l := NewList().AddKey("k1")
+	req := newRequest("10.0.0.1:1234", nil)
+
+	assert.True(t, l.Matches(req, "", "k1"))
+	assert.False(t, l.Matches(req, "", "k2"))
+
+	l.RemoveKey("k1")
+	assert.False(t, l.Matches(req, "", "k1"))
+}
+
+func TestList_Matches_CIDR(t *testing.T) {
+	l := NewList()
+	assert.NoError(t, l.AddCIDR("10.0.0.0/8"))
+	assert.NoError(t, l.AddCIDR("2001:db8::/32"))
+
+	assert.True(t, l.Matches(newRequest("10.1.2.3:1234", nil), "", ""))
+	assert.True(t, l.Matches(newRequest("[2001:db8::1]:1234", nil), "", ""))
+	assert.False(t, l.Matches(newRequest("192.168.0.1:1234", nil), "", ""))
+
+	assert.NoError(t, l.RemoveCIDR("10.0.0.0/8"))
+	assert.False(t, l.Matches(newRequest("10.1.2.3:1234", nil), "", ""))
+}
+
+func TestList_AddCIDR_FailsIfRangeIsInvalid(t *testing.T) {
+	assert.Error(t, NewList().AddCIDR("10.0.0.0"))
+}
+
+func TestLists_Check(t *testing.T) {
+	l := NewLists()
+	l.Allow.AddUser("alice").AddUser("bob")
+	l.Deny.AddUser("bob")
+	req := newRequest("10.0.0.1:1234", nil)
+
+	outcome, ok := l.Check(req, "alice")
+	assert.True(t, ok)
+	assert.Equal(t, common.Allowlisted, outcome)
+
+	outcome, ok = l.Check(req, "bob")
+	assert.True(t, ok)
+	assert.Equal(t, common.Denylisted, outcome)
+
+	_, ok = l.Check(req, "carol")
+	assert.False(t, ok)
+}
+
+func TestLists_CheckKey(t *testing.T) {
+	l := NewLists().SetKeyExtractor(FromHeader("Authorization"))
+	l.Deny.AddKey("k1")
+
+	outcome, ok := l.Check(newRequest("10.0.0.1:1234", map[string]string{"Authorization": "k1"}), "")
+	assert.True(t, ok)
+	assert.Equal(t, common.Denylisted, outcome)
+
+	_, ok = l.Check(newRequest("10.0.0.1:1234", map[string]string{"X-API-Key": "k1"}), "")
+	assert.False(t, ok)
+}
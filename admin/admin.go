@@ -0,0 +1,383 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/penalty"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+type (
+	// Limiter is implemented by rate limiters whose quotas can be inspected and manipulated, such as
+	// token_bucket.RateLimiter.
+	Limiter interface {
+		// Paths returns all configured paths, along with their limits.
+		Paths() map[token_bucket.Path]token_bucket.Config
+		// Users returns all registered users.
+		Users() []token_bucket.UserID
+		// Quota returns the current state of the bucket of a user on a path, along with its configuration.
+		Quota(ctx context.Context, userID token_bucket.UserID, path token_bucket.Path) (token_bucket.Bucket, token_bucket.Config, error)
+		// ResetQuota fills up the bucket of a user on a path.
+		ResetQuota(ctx context.Context, userID token_bucket.UserID, path token_bucket.Path) error
+		// TopUpQuota adds n tokens to the bucket of a user on a path.
+		TopUpQuota(ctx context.Context, userID token_bucket.UserID, path token_bucket.Path, n int) (token_bucket.Bucket, error)
+		// SetQuota sets the number of tokens in the bucket of a user on a path.
+		SetQuota(ctx context.Context, userID token_bucket.UserID, path token_bucket.Path, n int) (token_bucket.Bucket, error)
+	}
+
+	// Authorizer returns true if the request is allowed to access the admin API.
+	Authorizer func(r *http.Request) bool
+
+	// HandlerBuilder builds an admin handler.
+	HandlerBuilder struct {
+		limiters   []Limiter
+		boxes      []*penalty.Box
+		authorizer Authorizer
+	}
+
+	// Handler serves an HTTP/JSON API to inspect and manipulate the quotas of rate limiters:
+	//   - GET /paths: lists all configured paths, along with their limits and users;
+	//   - GET /users: lists all registered users;
+	//   - GET /quota?path=...&user=...: returns the remaining tokens and the time of the next refill;
+	//   - PUT /quota?path=...&user=...: sets the number of remaining tokens, as {"tokens": n};
+	//   - POST /quota/top-up?path=...&user=...: adds tokens, as {"tokens": n}, without exceeding the limit;
+	//   - POST /quota/reset?path=...&user=...: fills up the bucket;
+	//   - GET /bans: lists the keys currently banned by penalty boxes, along with the end of their ban;
+	//   - DELETE /bans?key=...: lifts the ban of a key and forgets its past violations.
+	//
+	// An empty user identifies the global bucket of the path, if any. All requests must be allowed by the authorizer,
+	// otherwise they are rejected with status 401. It is meant to be served on a separate, internal, address, or
+	// under a prefix using http.StripPrefix.
+	Handler struct {
+		limiters   []Limiter
+		boxes      []*penalty.Box
+		authorizer Authorizer
+		mux        *http.ServeMux
+	}
+
+	rate struct {
+		Value    int    `json:"value"`
+		Interval string `json:"interval"`
+	}
+
+	limit struct {
+		Limit  rate `json:"limit"`
+		Refill rate `json:"refill"`
+	}
+
+	pathResponse struct {
+		Path   string   `json:"path"`
+		Limit  rate     `json:"limit"`
+		Refill rate     `json:"refill"`
+		Global *limit   `json:"global,omitempty"`
+		Users  []string `json:"users"`
+	}
+
+	quotaResponse struct {
+		Path       string    `json:"path"`
+		User       string    `json:"user"`
+		Limit      int       `json:"limit"`
+		Remaining  int       `json:"remaining"`
+		NextRefill time.Time `json:"next_refill"`
+	}
+
+	tokensRequest struct {
+		Tokens *int `json:"tokens"`
+	}
+
+	errorResponse struct {
+		Error string `json:"error"`
+	}
+)
+
+// NewHandlerBuilder instantiates an admin handler builder.
+func NewHandlerBuilder() *HandlerBuilder {
+	return &HandlerBuilder{}
+}
+
+// AddLimiter adds a rate limiter whose quotas are exposed. If several limiters configure the same user and path, the
+// first one added takes precedence.
+func (b *HandlerBuilder) AddLimiter(l Limiter) *HandlerBuilder {
+	b.limiters = append(b.limiters, l)
+	return b
+}
+
+// AddPenaltyBox adds a penalty box whose bans are exposed.
+func (b *HandlerBuilder) AddPenaltyBox(box *penalty.Box) *HandlerBuilder {
+	b.boxes = append(b.boxes, box)
+	return b
+}
+
+// SetAuthorizer sets the function deciding which requests can access the admin API, e.g. BearerToken.
+func (b *HandlerBuilder) SetAuthorizer(a Authorizer) *HandlerBuilder {
+	b.authorizer = a
+	return b
+}
+
+// Build builds an admin handler.
+// It returns an error if no limiter or no authorizer has been configured.
+func (b *HandlerBuilder) Build() (*Handler, error) {
+	if len(b.limiters) == 0 {
+		return nil, errors.New("no limiter configured")
+	}
+
+	if b.authorizer == nil {
+		return nil, errors.New("no authorizer configured")
+	}
+
+	h := &Handler{
+		limiters:   b.limiters,
+		boxes:      b.boxes,
+		authorizer: b.authorizer,
+		mux:        http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("GET /paths", h.paths)
+	h.mux.HandleFunc("GET /users", h.users)
+	h.mux.HandleFunc("GET /quota", h.quota)
+	h.mux.HandleFunc("PUT /quota", h.tokens(Limiter.SetQuota))
+	h.mux.HandleFunc("POST /quota/top-up", h.tokens(Limiter.TopUpQuota))
+	h.mux.HandleFunc("POST /quota/reset", h.reset)
+	h.mux.HandleFunc("GET /bans", h.bans)
+	h.mux.HandleFunc("DELETE /bans", h.lift)
+
+	return h, nil
+}
+
+// BearerToken returns an Authorizer that only allows requests whose `Authorization` header contains the provided
+// bearer token.
+func BearerToken(token string) Authorizer {
+	return func(r *http.Request) bool {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	}
+}
+
+// ServeHTTP serves the admin API.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizer(r) {
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func toRate(r common.Rate) rate {
+	return rate{Value: r.Value, Interval: r.Interval.String()}
+}
+
+func (h *Handler) paths(w http.ResponseWriter, _ *http.Request) {
+	paths := make([]pathResponse, 0)
+	for _, l := range h.limiters {
+		users := make([]string, 0)
+		for _, u := range l.Users() {
+			users = append(users, string(u))
+		}
+
+		for path, cfg := range l.Paths() {
+			p := pathResponse{
+				Path:   string(path),
+				Limit:  toRate(cfg.Limit),
+				Refill: toRate(cfg.Refill),
+				Users:  users,
+			}
+
+			if g := cfg.Global; g != nil {
+				p.Global = &limit{
+					Limit:  toRate(g.Limit),
+					Refill: toRate(g.Refill),
+				}
+			}
+
+			paths = append(paths, p)
+		}
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool { return paths[i].Path < paths[j].Path })
+	writeJSON(w, http.StatusOK, paths)
+}
+
+func (h *Handler) users(w http.ResponseWriter, _ *http.Request) {
+	seen := make(map[token_bucket.UserID]bool)
+	users := make([]string, 0)
+	for _, l := range h.limiters {
+		for _, u := range l.Users() {
+			if !seen[u] {
+				seen[u] = true
+				users = append(users, string(u))
+			}
+		}
+	}
+
+	sort.Strings(users)
+	writeJSON(w, http.StatusOK, users)
+}
+
+// target returns the user and path of the request, along with the limiter configuring them.
+func (h *Handler) target(r *http.Request) (Limiter, token_bucket.UserID, token_bucket.Path, error) {
+	userID := token_bucket.UserID(r.URL.Query().Get("user"))
+	path := token_bucket.Path(r.URL.Query().Get("path"))
+
+	for _, l := range h.limiters {
+		if _, _, err := l.Quota(r.Context(), userID, path); !errors.Is(err, token_bucket.ErrUnknownQuota) {
+			return l, userID, path, nil
+		}
+	}
+
+	return nil, userID, path, token_bucket.ErrUnknownQuota
+}
+
+func (h *Handler) quota(w http.ResponseWriter, r *http.Request) {
+	l, userID, path, err := h.target(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.writeQuota(w, r, l, userID, path)
+}
+
+func (h *Handler) writeQuota(w http.ResponseWriter, r *http.Request, l Limiter, userID token_bucket.UserID, path token_bucket.Path) {
+	b, cfg, err := l.Quota(r.Context(), userID, path)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quotaResponse{
+		Path:       string(path),
+		User:       string(userID),
+		Limit:      cfg.Limit.Value,
+		Remaining:  b.Tokens,
+		NextRefill: b.NextRefill(cfg),
+	})
+}
+
+func (h *Handler) tokens(
+	f func(Limiter, context.Context, token_bucket.UserID, token_bucket.Path, int) (token_bucket.Bucket, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tokensRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		if req.Tokens == nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "tokens is required"})
+			return
+		}
+
+		l, userID, path, err := h.target(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if _, err := f(l, r.Context(), userID, path, *req.Tokens); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		audit(r, userID, path, zap.Int("tokens", *req.Tokens))
+		h.writeQuota(w, r, l, userID, path)
+	}
+}
+
+func (h *Handler) reset(w http.ResponseWriter, r *http.Request) {
+	l, userID, path, err := h.target(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := l.ResetQuota(r.Context(), userID, path); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	audit(r, userID, path)
+	h.writeQuota(w, r, l, userID, path)
+}
+
+func (h *Handler) bans(w http.ResponseWriter, _ *http.Request) {
+	bans := make([]penalty.Ban, 0)
+	for _, b := range h.boxes {
+		bans = append(bans, b.Bans()...)
+	}
+
+	sort.SliceStable(bans, func(i, j int) bool { return bans[i].Key < bans[j].Key })
+	writeJSON(w, http.StatusOK, bans)
+}
+
+func (h *Handler) lift(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "key is required"})
+		return
+	}
+
+	var banned bool
+	for _, b := range h.boxes {
+		if _, ok := b.Banned(key); ok {
+			banned = true
+		}
+
+		b.Lift(key)
+	}
+
+	if !banned {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "key is not banned"})
+		return
+	}
+
+	logging.Logger().Info(
+		"ban lifted",
+		zap.String("key", key),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// audit logs a change to a quota.
+func audit(r *http.Request, userID token_bucket.UserID, path token_bucket.Path, fields ...zap.Field) {
+	logging.Logger().Info(
+		"quota changed",
+		append([]zap.Field{
+			zap.String("operation", r.Method+" "+r.URL.Path),
+			zap.String("user", string(userID)),
+			zap.String("path", string(path)),
+			zap.String("remote_addr", r.RemoteAddr),
+		}, fields...)...,
+	)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, token_bucket.ErrUnknownQuota):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+	case errors.Is(err, token_bucket.ErrInvalidQuota):
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+	default:
+		logging.Logger().Error("cannot serve request", zap.String("path", r.URL.Path), zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
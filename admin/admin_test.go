@@ -0,0 +1,175 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/penalty"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+const token = "secret"
+
+func newHandler(t *testing.T) *Handler {
+	cfg := token_bucket.Config{
+		Limit:  common.Rate{Value: 5, Interval: time.Hour},
+		Refill: common.Rate{Value: 1, Interval: time.Minute},
+	}
+
+	free, err := token_bucket.NewRateLimiterBuilder().SetLimit("/api", cfg).RegisterUser("alice").Build()
+	assert.NoError(t, err)
+	t.Cleanup(free.Stop)
+
+	cfg.Limit.Value = 50
+	pro, err := token_bucket.NewRateLimiterBuilder().SetLimit("/api", cfg).RegisterUser("bob").Build()
+	assert.NoError(t, err)
+	t.Cleanup(pro.Stop)
+
+	h, err := NewHandlerBuilder().
+		AddLimiter(free).
+		AddLimiter(pro).
+		SetAuthorizer(BearerToken(token)).
+		Build()
+	assert.NoError(t, err)
+
+	return h
+}
+
+func call(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	var v T
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&v))
+
+	return v
+}
+
+func TestHandlerBuilder_Build_FailsWithoutAuthorizer(t *testing.T) {
+	_, err := NewHandlerBuilder().AddLimiter(&token_bucket.RateLimiter{}).Build()
+	assert.Error(t, err)
+}
+
+func TestHandler_RejectsUnauthorizedRequests(t *testing.T) {
+	h := newHandler(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestHandler_PathsAndUsers(t *testing.T) {
+	h := newHandler(t)
+
+	w := call(h, http.MethodGet, "/users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"alice", "bob"}, decode[[]string](t, w))
+
+	w = call(h, http.MethodGet, "/paths", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	paths := decode[[]pathResponse](t, w)
+	assert.Len(t, paths, 2)
+	assert.Equal(t, "/api", paths[0].Path)
+	assert.Equal(t, rate{Value: 5, Interval: "1h0m0s"}, paths[0].Limit)
+	assert.Equal(t, rate{Value: 1, Interval: "1m0s"}, paths[0].Refill)
+	assert.Equal(t, []string{"alice"}, paths[0].Users)
+	assert.Equal(t, 50, paths[1].Limit.Value)
+}
+
+func TestHandler_Quota(t *testing.T) {
+	h := newHandler(t)
+
+	w := call(h, http.MethodGet, "/quota?path=/api&user=bob", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	q := decode[quotaResponse](t, w)
+	assert.Equal(t, 50, q.Limit)
+	assert.Equal(t, 50, q.Remaining)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), q.NextRefill, 5*time.Second)
+
+	w = call(h, http.MethodGet, "/quota?path=/api&user=carol", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHandler_ManipulateQuota(t *testing.T) {
+	h := newHandler(t)
+
+	w := call(h, http.MethodPut, "/quota?path=/api&user=alice", `{"tokens": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, decode[quotaResponse](t, w).Remaining)
+
+	w = call(h, http.MethodPost, "/quota/top-up?path=/api&user=alice", `{"tokens": 2}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, decode[quotaResponse](t, w).Remaining)
+
+	w = call(h, http.MethodPost, "/quota/reset?path=/api&user=alice", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 5, decode[quotaResponse](t, w).Remaining)
+
+	w = call(h, http.MethodPut, "/quota?path=/api&user=alice", `{"tokens": 6}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(h, http.MethodPut, "/quota?path=/api&user=alice", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(h, http.MethodDelete, "/quota?path=/api&user=alice", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandler_Bans(t *testing.T) {
+	box, err := penalty.NewBox(penalty.Policy{Violations: 1, Window: time.Minute, BanDuration: time.Minute})
+	assert.NoError(t, err)
+	box.Violation("bob")
+	box.Violation("alice")
+
+	rl, err := token_bucket.NewRateLimiterBuilder().
+		SetLimit("/api", token_bucket.Config{
+			Limit:  common.Rate{Value: 1, Interval: time.Minute},
+			Refill: common.Rate{Value: 1, Interval: time.Minute},
+		}).
+		RegisterUser("alice").
+		SetPenaltyBox(box).
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	h, err := NewHandlerBuilder().AddLimiter(rl).AddPenaltyBox(box).SetAuthorizer(BearerToken(token)).Build()
+	assert.NoError(t, err)
+
+	w := call(h, http.MethodGet, "/bans", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	bans := decode[[]penalty.Ban](t, w)
+	assert.Len(t, bans, 2)
+	assert.Equal(t, "alice", bans[0].Key)
+	assert.Equal(t, "bob", bans[1].Key)
+
+	w = call(h, http.MethodDelete, "/bans?key=alice", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	_, banned := box.Banned("alice")
+	assert.False(t, banned)
+
+	w = call(h, http.MethodDelete, "/bans?key=alice", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = call(h, http.MethodDelete, "/bans", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,165 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+type (
+	// Budget is a number of bytes that can be transferred in a given interval, backed by a token bucket (where each
+	// token is a byte). Budgets can be shared by several readers and writers, which then split it among themselves.
+	// Since buckets are refilled once per interval, short intervals (e.g. 10KB every 10ms rather than 1MB every
+	// second) result in smoother transfers.
+	Budget struct {
+		store token_bucket.Store
+		key   token_bucket.Key
+		cfg   token_bucket.Config
+	}
+
+	reader struct {
+		ctx     context.Context
+		r       io.Reader
+		budgets []*Budget
+	}
+
+	writer struct {
+		ctx     context.Context
+		w       io.Writer
+		budgets []*Budget
+	}
+)
+
+// NewBudget returns a new budget allowing up to rate.Value bytes every rate.Interval. Both need to be positive,
+// otherwise it panics: the budget would never be refilled.
+func NewBudget(rate common.Rate) *Budget {
+	if rate.Value <= 0 || rate.Interval <= 0 {
+		panic(fmt.Sprintf("bandwidth: budget must be positive, got %v bytes every %v", rate.Value, rate.Interval))
+	}
+
+	return &Budget{
+		store: token_bucket.NewMemoryStore(),
+		cfg:   token_bucket.Config{Limit: rate, Refill: rate},
+	}
+}
+
+// acquire consumes up to n bytes from the budget, waiting until at least one is available or ctx is done. It returns
+// the number of bytes consumed.
+func (b *Budget) acquire(ctx context.Context, n int) (int, error) {
+	for {
+		bucket, err := b.store.Get(ctx, b.key, b.cfg)
+		if err != nil {
+			return 0, err
+		}
+
+		if bucket.Tokens > 0 {
+			if bucket.Tokens < n {
+				n = bucket.Tokens
+			}
+
+			_, taken, err := b.store.Take(ctx, b.key, b.cfg, n)
+			if err != nil {
+				return 0, err
+			}
+
+			if taken {
+				return n, nil
+			}
+
+			// consumed concurrently in the meantime: try again
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(bucket.NextRefill(b.cfg)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// refund gives back n bytes that have been consumed but not transferred.
+func (b *Budget) refund(ctx context.Context, n int) {
+	if n > 0 {
+		b.store.Refill(ctx, b.key, b.cfg, n)
+	}
+}
+
+// acquire consumes up to n bytes from all budgets, waiting until at least one is available in each of them or ctx is
+// done. It returns the number of bytes consumed from each budget.
+func acquire(ctx context.Context, budgets []*Budget, n int) (int, error) {
+	for i, b := range budgets {
+		granted, err := b.acquire(ctx, n)
+		if err != nil {
+			refund(ctx, budgets[:i], n)
+			return 0, err
+		}
+
+		// the previous budgets granted more than this one
+		refund(ctx, budgets[:i], n-granted)
+		n = granted
+	}
+
+	return n, nil
+}
+
+func refund(ctx context.Context, budgets []*Budget, n int) {
+	for _, b := range budgets {
+		b.refund(ctx, n)
+	}
+}
+
+// NewReader returns a reader that reads from r without exceeding any of the budgets, until ctx is done.
+func NewReader(ctx context.Context, r io.Reader, budgets ...*Budget) io.Reader {
+	return &reader{ctx: ctx, r: r, budgets: budgets}
+}
+
+// Read reads at most as many bytes as currently allowed by the budgets, waiting for at least one to be available.
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+
+	n, err := acquire(r.ctx, r.budgets, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	read, err := r.r.Read(p[:n])
+	refund(r.ctx, r.budgets, n-read)
+
+	return read, err
+}
+
+// NewWriter returns a writer that writes to w without exceeding any of the budgets, until ctx is done.
+func NewWriter(ctx context.Context, w io.Writer, budgets ...*Budget) io.Writer {
+	return &writer{ctx: ctx, w: w, budgets: budgets}
+}
+
+// Write writes p in chunks, as large as currently allowed by the budgets.
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := acquire(w.ctx, w.budgets, len(p))
+		if err != nil {
+			return written, err
+		}
+
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			refund(w.ctx, w.budgets, n-m)
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,103 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var rate = common.Rate{Value: 100, Interval: 20 * time.Millisecond}
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 500)
+	r := NewReader(context.Background(), bytes.NewReader(data), NewBudget(rate))
+
+	start := time.Now()
+	read, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	// the first 100 bytes are read at once, the others at each of the following 4 refills
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+}
+
+func TestReader_ChunksAreBoundedByBudget(t *testing.T) {
+	r := NewReader(context.Background(), bytes.NewReader(bytes.Repeat([]byte("a"), 500)), NewBudget(rate))
+
+	p := make([]byte, 300)
+	n, err := r.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+}
+
+func TestNewBudget_PanicsIfRateIsNotPositive(t *testing.T) {
+	for _, rate := range []common.Rate{{Value: 100}, {Interval: time.Second}} {
+		assert.Panics(t, func() { NewBudget(rate) })
+	}
+}
+
+func TestReader_RefundsUnreadBytes(t *testing.T) {
+	budget := NewBudget(common.Rate{Value: 100, Interval: time.Hour})
+	r := NewReader(context.Background(), bytes.NewReader(bytes.Repeat([]byte("a"), 10)), budget)
+
+	read, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, read, 10)
+
+	b, err := budget.store.Get(context.Background(), budget.key, budget.cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 90, b.Tokens)
+}
+
+func TestReader_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	budget := NewBudget(common.Rate{Value: 10, Interval: time.Hour})
+	r := NewReader(ctx, bytes.NewReader(bytes.Repeat([]byte("a"), 100)), budget)
+
+	read, err := io.ReadAll(r)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Len(t, read, 10)
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(context.Background(), &buf, NewBudget(rate))
+
+	start := time.Now()
+	n, err := w.Write(bytes.Repeat([]byte("a"), 300))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, n)
+	assert.Equal(t, 300, buf.Len())
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestWriter_SharedBudget(t *testing.T) {
+	shared := NewBudget(rate)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var own bytes.Buffer
+			w := NewWriter(context.Background(), &own, NewBudget(common.Rate{Value: 1000, Interval: time.Millisecond}), shared)
+			_, err := w.Write(bytes.Repeat([]byte("a"), 200))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// 400 bytes within a budget of 100 bytes every 20ms
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
@@ -0,0 +1,164 @@
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+type connKey struct{}
+
+type (
+	// ThrottleBuilder builds a response throttle.
+	ThrottleBuilder struct {
+		shared    *common.Rate
+		user      *common.Rate
+		conn      *common.Rate
+		extractor token_bucket.UserExtractor
+	}
+
+	// Throttle acts as an HTTP middleware that limits the throughput of response bodies, in bytes, rather than the
+	// number of requests. Responses are limited by any combination of:
+	//   - a shared budget, split among all responses;
+	//   - a budget for each user, split among all the responses sent to the user;
+	//   - a budget for each connection, split among all the responses sent on the connection: the server needs to use
+	//     ConnContext as its http.Server.ConnContext, otherwise each response gets its own budget.
+	Throttle struct {
+		shared    *Budget
+		user      *common.Rate
+		users     token_bucket.Store
+		conn      *common.Rate
+		extractor token_bucket.UserExtractor
+	}
+
+	throttledWriter struct {
+		http.ResponseWriter
+		w io.Writer
+	}
+)
+
+// NewThrottleBuilder instantiates a response throttle builder.
+func NewThrottleBuilder() *ThrottleBuilder {
+	return &ThrottleBuilder{
+		extractor: token_bucket.FromHeader("X-User-ID"),
+	}
+}
+
+// SetSharedRate sets the budget shared by all responses.
+func (b *ThrottleBuilder) SetSharedRate(rate common.Rate) *ThrottleBuilder {
+	b.shared = &rate
+	return b
+}
+
+// SetUserRate sets the budget of each user. Responses to requests without a user are not limited by it.
+func (b *ThrottleBuilder) SetUserRate(rate common.Rate) *ThrottleBuilder {
+	b.user = &rate
+	return b
+}
+
+// SetConnectionRate sets the budget of each connection.
+func (b *ThrottleBuilder) SetConnectionRate(rate common.Rate) *ThrottleBuilder {
+	b.conn = &rate
+	return b
+}
+
+// SetUserExtractor sets the function used to identify the user issuing a request. By default, users are identified by
+// the value of the `X-User-ID` header.
+func (b *ThrottleBuilder) SetUserExtractor(extractor token_bucket.UserExtractor) *ThrottleBuilder {
+	b.extractor = extractor
+	return b
+}
+
+// Build builds a response throttle.
+// It returns an error if no budget has been configured, or if any of them is not positive.
+func (b *ThrottleBuilder) Build() (*Throttle, error) {
+	if b.shared == nil && b.user == nil && b.conn == nil {
+		return nil, errors.New("no budget configured")
+	}
+
+	for _, rate := range []*common.Rate{b.shared, b.user, b.conn} {
+		if rate != nil && (rate.Value <= 0 || rate.Interval <= 0) {
+			return nil, errors.New("budgets must be positive")
+		}
+	}
+
+	t := &Throttle{
+		user:      b.user,
+		users:     token_bucket.NewMemoryStore(),
+		conn:      b.conn,
+		extractor: b.extractor,
+	}
+
+	if b.shared != nil {
+		t.shared = NewBudget(*b.shared)
+	}
+
+	return t, nil
+}
+
+// ConnContext attaches a budget to each new connection. It is meant to be used as http.Server.ConnContext.
+func (t *Throttle) ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	if t.conn == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, connKey{}, NewBudget(*t.conn))
+}
+
+// budgets returns the budgets limiting the response to the request.
+func (t *Throttle) budgets(r *http.Request) []*Budget {
+	var budgets []*Budget
+	if t.conn != nil {
+		b, ok := r.Context().Value(connKey{}).(*Budget)
+		if !ok {
+			b = NewBudget(*t.conn)
+		}
+
+		budgets = append(budgets, b)
+	}
+
+	if t.user != nil {
+		if userID := t.extractor(r); userID != "" {
+			budgets = append(budgets, &Budget{
+				store: t.users,
+				key:   token_bucket.Key{UserID: userID},
+				cfg:   token_bucket.Config{Limit: *t.user, Refill: *t.user},
+			})
+		}
+	}
+
+	if t.shared != nil {
+		budgets = append(budgets, t.shared)
+	}
+
+	return budgets
+}
+
+// Handle returns an HTTP middleware that throttles the body of all responses.
+func (t *Throttle) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, w: NewWriter(r.Context(), w, t.budgets(r)...)}, r)
+	})
+}
+
+// Write writes the response body, without exceeding the budgets.
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Flush sends any buffered data to the client, if supported by the underlying writer.
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
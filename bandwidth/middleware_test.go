@@ -0,0 +1,86 @@
+package bandwidth
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var body = bytes.Repeat([]byte("a"), 300)
+
+func newServer(t *testing.T, throttle *Throttle) *httptest.Server {
+	server := httptest.NewUnstartedServer(throttle.Handle(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(body)
+	})))
+	server.Config.ConnContext = throttle.ConnContext
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func download(t *testing.T, client *http.Client, url, userID string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-User-ID", userID)
+
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	read, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, read)
+}
+
+func TestThrottleBuilder_Build(t *testing.T) {
+	_, err := NewThrottleBuilder().Build()
+	assert.Error(t, err)
+
+	_, err = NewThrottleBuilder().SetUserRate(common.Rate{Value: 0, Interval: time.Second}).Build()
+	assert.Error(t, err)
+}
+
+func TestThrottle_ConnectionBudget(t *testing.T) {
+	throttle, err := NewThrottleBuilder().SetConnectionRate(rate).Build()
+	assert.NoError(t, err)
+	server := newServer(t, throttle)
+	client := server.Client()
+
+	start := time.Now()
+	download(t, client, server.URL, "abc")
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// the second response on the same connection starts where the first one left off
+	start = time.Now()
+	download(t, client, server.URL, "abc")
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestThrottle_UserBudget(t *testing.T) {
+	throttle, err := NewThrottleBuilder().SetUserRate(rate).Build()
+	assert.NoError(t, err)
+	server := newServer(t, throttle)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// separate clients use separate connections
+			download(t, &http.Client{Transport: &http.Transport{}}, server.URL, "abc")
+		}()
+	}
+	wg.Wait()
+
+	// 600 bytes within a budget of 100 bytes every 20ms
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
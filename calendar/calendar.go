@@ -0,0 +1,271 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/fedragon/rate-limiter/tracing"
+)
+
+type (
+	// Quota represents a number of requests allowed in a calendar period.
+	Quota struct {
+		Limit  int
+		Period Period
+		Anchor Anchor
+		// Location is the timezone used to align periods, unless overridden for a user. Defaults to UTC.
+		Location *time.Location
+	}
+
+	// Usage represents the current usage of a quota by a user on a path.
+	Usage struct {
+		Remaining int
+		NextReset time.Time
+	}
+
+	key struct {
+		userID token_bucket.UserID
+		path   token_bucket.Path
+	}
+
+	usage struct {
+		used      int
+		nextReset time.Time
+	}
+
+	// RateLimiterBuilder builds a calendar rate limiter.
+	RateLimiterBuilder struct {
+		paths     *concurrent.Map[token_bucket.Path, Quota]
+		users     *concurrent.Map[token_bucket.UserID, *time.Location]
+		extractor token_bucket.UserExtractor
+		observer  common.Observer
+	}
+
+	// RateLimiter acts as an HTTP middleware that rate-limits traffic according to quotas aligned to calendar periods
+	// (e.g. 50,000 requests per month, resetting on the 1st at midnight UTC), which are reset all at once at the
+	// beginning of each period rather than being refilled gradually.
+	// Quotas are reset lazily, upon the first request following the end of a period, so it does not need to be
+	// stopped.
+	RateLimiter struct {
+		paths     *concurrent.Map[token_bucket.Path, Quota]
+		users     *concurrent.Map[token_bucket.UserID, *time.Location]
+		usages    *concurrent.Map[key, usage]
+		extractor token_bucket.UserExtractor
+		observer  common.Observer
+		now       func() time.Time
+	}
+)
+
+// NewRateLimiterBuilder instantiates a calendar rate limiter builder.
+func NewRateLimiterBuilder() *RateLimiterBuilder {
+	return &RateLimiterBuilder{
+		paths:     concurrent.NewMap[token_bucket.Path, Quota](),
+		users:     concurrent.NewMap[token_bucket.UserID, *time.Location](),
+		extractor: token_bucket.FromHeader("X-User-ID"),
+	}
+}
+
+// SetQuota sets a quota on a path. The path needs to be absolute and start with a leading '/'.
+func (b *RateLimiterBuilder) SetQuota(path string, quota Quota) *RateLimiterBuilder {
+	b.paths.Put(token_bucket.Path(path), quota)
+	return b
+}
+
+// RegisterUser registers a user, whose quotas are aligned to the timezone configured on each path.
+func (b *RateLimiterBuilder) RegisterUser(ID string) *RateLimiterBuilder {
+	b.users.Put(token_bucket.UserID(ID), nil)
+	return b
+}
+
+// RegisterUserIn registers a user, whose quotas are aligned to the provided timezone (e.g. the customer's one).
+func (b *RateLimiterBuilder) RegisterUserIn(ID string, loc *time.Location) *RateLimiterBuilder {
+	b.users.Put(token_bucket.UserID(ID), loc)
+	return b
+}
+
+// SetUserExtractor sets the function used to identify the user issuing a request. By default, users are identified by
+// the value of the `X-User-ID` header.
+func (b *RateLimiterBuilder) SetUserExtractor(extractor token_bucket.UserExtractor) *RateLimiterBuilder {
+	b.extractor = extractor
+	return b
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken by the HTTP middleware.
+func (b *RateLimiterBuilder) SetObserver(observer common.Observer) *RateLimiterBuilder {
+	b.observer = observer
+	return b
+}
+
+// Build builds a rate limiter.
+// It returns an error if no quotas have been configured, or if any of them is invalid.
+func (b *RateLimiterBuilder) Build() (*RateLimiter, error) {
+	if b.paths.Size() == 0 {
+		return nil, errors.New("no quota configured")
+	}
+
+	for t := range b.paths.Iterate() {
+		if t.Value.Limit <= 0 {
+			return nil, fmt.Errorf("invalid limit on path %v: %v", t.Key, t.Value.Limit)
+		}
+
+		if t.Value.Period < Day || t.Value.Period > Month {
+			return nil, fmt.Errorf("invalid period on path %v: %v", t.Key, t.Value.Period)
+		}
+
+		if err := t.Value.Anchor.validate(); err != nil {
+			return nil, fmt.Errorf("invalid anchor on path %v: %w", t.Key, err)
+		}
+	}
+
+	return &RateLimiter{
+		paths:     b.paths,
+		users:     b.users,
+		usages:    concurrent.NewMap[key, usage](),
+		extractor: b.extractor,
+		observer:  b.observer,
+		now:       time.Now,
+	}, nil
+}
+
+// Stop does nothing, since quotas are reset lazily. It only exists to satisfy the composite.Limiter interface.
+func (rl *RateLimiter) Stop() {
+}
+
+func (rl *RateLimiter) quota(userID token_bucket.UserID, path token_bucket.Path) (Quota, *time.Location, bool) {
+	quota, ok := rl.paths.Get(path)
+	if !ok {
+		return Quota{}, nil, false
+	}
+
+	loc, ok := rl.users.Get(userID)
+	if !ok {
+		return Quota{}, nil, false
+	}
+
+	if loc == nil {
+		loc = quota.Location
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return quota, loc, true
+}
+
+// Remaining returns the remaining quota of a user on a path, along with the time when it will next be reset.
+// The returned boolean is false if either the user or the path is unknown.
+func (rl *RateLimiter) Remaining(userID, path string) (Usage, bool) {
+	quota, loc, ok := rl.quota(token_bucket.UserID(userID), token_bucket.Path(path))
+	if !ok {
+		return Usage{}, false
+	}
+
+	now := rl.now()
+	u, exists := rl.usages.Get(key{token_bucket.UserID(userID), token_bucket.Path(path)})
+	if !exists || !now.Before(u.nextReset) {
+		return Usage{Remaining: quota.Limit, NextReset: quota.Period.next(quota.Anchor, now, loc)}, true
+	}
+
+	return Usage{Remaining: quota.Limit - u.used, NextReset: u.nextReset}, true
+}
+
+// Take consumes a unit of quota for the user and path of the provided request, if available.
+func (rl *RateLimiter) Take(r *http.Request) common.Decision {
+	userID, path := rl.extractor(r), token_bucket.Path(r.URL.Path)
+	return rl.take(userID, path)
+}
+
+// take consumes a unit of quota of a user on a path, if available.
+func (rl *RateLimiter) take(userID token_bucket.UserID, path token_bucket.Path) common.Decision {
+	quota, loc, ok := rl.quota(userID, path)
+	if !ok {
+		return common.Decision{Outcome: common.Unknown}
+	}
+
+	now := rl.now()
+	var taken bool
+	u := rl.usages.Update(key{userID, path}, func(u usage, _ bool) usage {
+		if !now.Before(u.nextReset) {
+			u = usage{nextReset: quota.Period.next(quota.Anchor, now, loc)}
+		}
+
+		if u.used < quota.Limit {
+			u.used++
+			taken = true
+		}
+
+		return u
+	})
+
+	if !taken {
+		return common.Decision{
+			Outcome:    common.Denied,
+			Limit:      quota.Limit,
+			RetryAfter: u.nextReset.Sub(now),
+		}
+	}
+
+	return common.Decision{
+		Outcome:   common.Allowed,
+		Limit:     quota.Limit,
+		Remaining: quota.Limit - u.used,
+	}
+}
+
+// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d, if the request was
+// allowed.
+func (rl *RateLimiter) Refund(r *http.Request, d common.Decision) {
+	if d.Outcome != common.Allowed {
+		return
+	}
+
+	rl.usages.Update(key{rl.extractor(r), token_bucket.Path(r.URL.Path)}, func(u usage, _ bool) usage {
+		if u.used > 0 {
+			u.used--
+		}
+
+		return u
+	})
+}
+
+// Handle returns an HTTP middleware that applies preconfigured quotas to all received requests.
+// Responses to known users include their remaining quota and the time of its next reset, as a Unix timestamp.
+func (rl *RateLimiter) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, path := rl.extractor(r), token_bucket.Path(r.URL.Path)
+		d := rl.take(userID, path)
+		r = tracing.Record(r, "calendar", string(userID), string(path), d)
+		if rl.observer != nil {
+			var route string
+			if _, ok := rl.paths.Get(path); ok {
+				route = string(path)
+			}
+			rl.observer.Observe(r, "calendar", route, d)
+		}
+		if d.Outcome == common.Unknown {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if u, ok := rl.Remaining(string(userID), string(path)); ok {
+			w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(d.Limit))
+			w.Header().Add("X-Ratelimit-Remaining", strconv.Itoa(u.Remaining))
+			w.Header().Add("X-Ratelimit-Reset", strconv.FormatInt(u.NextReset.Unix(), 10))
+		}
+
+		if !d.Allowed() {
+			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(d.RetryAfter.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
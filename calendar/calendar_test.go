@@ -0,0 +1,152 @@
+package calendar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	route  = "/bar"
+	userID = "0-0-0-0-0"
+)
+
+var (
+	quota = Quota{
+		Limit:  2,
+		Period: Month,
+	}
+)
+
+func newRequest(userID string) *http.Request {
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	return req
+}
+
+func TestRateLimiterBuilder_Build_FailsIfQuotasAreNotConfigured(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiterBuilder_Build_FailsIfQuotaIsInvalid(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().SetQuota(route, Quota{Limit: 0, Period: Day}).Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiterBuilder_Build_FailsIfAnchorIsInvalid(t *testing.T) {
+	for _, anchor := range []Anchor{
+		{TimeOfDay: -time.Hour},
+		{TimeOfDay: 24 * time.Hour},
+		{MonthDay: 32},
+		{MonthDay: -1},
+		{Weekday: 7},
+	} {
+		rl, err := NewRateLimiterBuilder().SetQuota(route, Quota{Limit: 1, Period: Month, Anchor: anchor}).Build()
+
+		assert.Nil(t, rl)
+		assert.Error(t, err)
+	}
+}
+
+func TestRateLimiter_Take_ResetsQuotaAtTheBeginningOfThePeriod(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().SetQuota(route, quota).RegisterUser(userID).Build()
+	assert.NoError(t, err)
+	now := time.Date(2022, 10, 31, 23, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+
+	assert.True(t, rl.Take(newRequest(userID)).Allowed())
+	assert.True(t, rl.Take(newRequest(userID)).Allowed())
+
+	d := rl.Take(newRequest(userID))
+	assert.Equal(t, common.Denied, d.Outcome)
+	assert.Equal(t, time.Hour, d.RetryAfter)
+
+	now = now.Add(time.Hour)
+	assert.True(t, rl.Take(newRequest(userID)).Allowed())
+}
+
+func TestRateLimiter_Take_AlignsPeriodsToUserTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	assert.NoError(t, err)
+	rl, err := NewRateLimiterBuilder().
+		SetQuota(route, Quota{Limit: 1, Period: Day}).
+		RegisterUser(userID).
+		RegisterUserIn("tokyo", loc).
+		Build()
+	assert.NoError(t, err)
+	now := time.Date(2022, 10, 5, 14, 30, 0, 0, time.UTC) // 23:30 in Tokyo
+	rl.now = func() time.Time { return now }
+
+	assert.True(t, rl.Take(newRequest(userID)).Allowed())
+	assert.True(t, rl.Take(newRequest("tokyo")).Allowed())
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, common.Denied, rl.Take(newRequest(userID)).Outcome)
+	assert.True(t, rl.Take(newRequest("tokyo")).Allowed())
+}
+
+func TestRateLimiter_Remaining(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().SetQuota(route, quota).RegisterUser(userID).Build()
+	assert.NoError(t, err)
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+	nextReset := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	u, ok := rl.Remaining(userID, route)
+	assert.True(t, ok)
+	assert.Equal(t, Usage{Remaining: 2, NextReset: nextReset}, u)
+
+	rl.Take(newRequest(userID))
+
+	u, ok = rl.Remaining(userID, route)
+	assert.True(t, ok)
+	assert.Equal(t, Usage{Remaining: 1, NextReset: nextReset}, u)
+
+	_, ok = rl.Remaining("unknown", route)
+	assert.False(t, ok)
+}
+
+func Test_ServerReturns429_OnQuotaExhausted(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().SetQuota(route, Quota{Limit: 1, Period: Day}).RegisterUser(userID).Build()
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	res, err := sendRequest(server.URL+route, userID, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "0", res.Header.Get("X-Ratelimit-Remaining"))
+
+	res, err = sendRequest(server.URL+route, userID, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	res, err = sendRequest(server.URL+route, "unknown", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func sendRequest(route string, userID string, client *http.Client) (*http.Response, error) {
+	req, _ := http.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package calendar
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period represents a calendar period, at the end of which quotas are reset.
+type Period int
+
+const (
+	Day Period = iota
+	Week
+	Month
+)
+
+// String returns the period name.
+func (p Period) String() string {
+	switch p {
+	case Day:
+		return "day"
+	case Week:
+		return "week"
+	case Month:
+		return "month"
+	default:
+		return fmt.Sprintf("Period(%d)", int(p))
+	}
+}
+
+// Anchor defines the moment, within a period, when quotas are reset.
+type Anchor struct {
+	// Weekday is the day of the week when weekly quotas are reset.
+	Weekday time.Weekday
+	// MonthDay is the day of the month when monthly quotas are reset: 0 is the same as 1, and days that do not exist in
+	// a given month (e.g. 31) are replaced by the last day of that month.
+	MonthDay int
+	// TimeOfDay is the time elapsed since midnight when quotas are reset.
+	TimeOfDay time.Duration
+}
+
+// validate returns an error if any field of the anchor is out of range.
+func (a Anchor) validate() error {
+	if a.Weekday < time.Sunday || a.Weekday > time.Saturday {
+		return fmt.Errorf("invalid weekday: %d", int(a.Weekday))
+	}
+
+	if a.MonthDay < 0 || a.MonthDay > 31 {
+		return fmt.Errorf("invalid day of the month: %d", a.MonthDay)
+	}
+
+	if a.TimeOfDay < 0 || a.TimeOfDay >= 24*time.Hour {
+		return fmt.Errorf("invalid time of day: %v", a.TimeOfDay)
+	}
+
+	return nil
+}
+
+// next returns the first reset time strictly after now, in the provided location.
+func (p Period) next(anchor Anchor, now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	year, month, day := now.Date()
+
+	switch p {
+	case Day:
+		reset := midnight(year, month, day, loc).Add(anchor.TimeOfDay)
+		if !reset.After(now) {
+			reset = midnight(year, month, day+1, loc).Add(anchor.TimeOfDay)
+		}
+
+		return reset
+	case Week:
+		days := (int(anchor.Weekday) - int(now.Weekday()) + 7) % 7
+		reset := midnight(year, month, day+days, loc).Add(anchor.TimeOfDay)
+		if !reset.After(now) {
+			reset = midnight(year, month, day+days+7, loc).Add(anchor.TimeOfDay)
+		}
+
+		return reset
+	default:
+		reset := midnight(year, month, monthDay(year, month, anchor.MonthDay), loc).Add(anchor.TimeOfDay)
+		if !reset.After(now) {
+			reset = midnight(year, month+1, monthDay(year, month+1, anchor.MonthDay), loc).Add(anchor.TimeOfDay)
+		}
+
+		return reset
+	}
+}
+
+func midnight(year int, month time.Month, day int, loc *time.Location) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// monthDay returns the provided day, capped to the number of days in the given month.
+func monthDay(year int, month time.Month, day int) int {
+	if day < 1 {
+		return 1
+	}
+
+	// day 0 of the following month is the last day of this one
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day(); day > last {
+		return last
+	}
+
+	return day
+}
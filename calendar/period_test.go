@@ -0,0 +1,47 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeriod_Next_Day(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2022, 10, 6, 0, 0, 0, 0, time.UTC), Day.next(Anchor{}, now, time.UTC))
+	assert.Equal(
+		t,
+		time.Date(2022, 10, 5, 14, 0, 0, 0, time.UTC),
+		Day.next(Anchor{TimeOfDay: 14 * time.Hour}, now, time.UTC),
+	)
+}
+
+func TestPeriod_Next_DayInTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	now := time.Date(2022, 10, 5, 2, 0, 0, 0, time.UTC) // still Oct 4th in New York
+
+	assert.Equal(t, time.Date(2022, 10, 5, 0, 0, 0, 0, loc), Day.next(Anchor{}, now, loc))
+}
+
+func TestPeriod_Next_Week(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC) // Wednesday
+
+	assert.Equal(t, time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC), Week.next(Anchor{Weekday: time.Monday}, now, time.UTC))
+	assert.Equal(t, time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC), Week.next(Anchor{Weekday: time.Wednesday}, now, time.UTC))
+}
+
+func TestPeriod_Next_Month(t *testing.T) {
+	now := time.Date(2022, 12, 5, 13, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Month.next(Anchor{}, now, time.UTC))
+	assert.Equal(t, time.Date(2022, 12, 15, 0, 0, 0, 0, time.UTC), Month.next(Anchor{MonthDay: 15}, now, time.UTC))
+}
+
+func TestPeriod_Next_MonthCapsDayToLastOfMonth(t *testing.T) {
+	now := time.Date(2023, 1, 31, 13, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2023, 2, 28, 0, 0, 0, 0, time.UTC), Month.next(Anchor{MonthDay: 31}, now, time.UTC))
+}
@@ -0,0 +1,292 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fedragon/rate-limiter/admin"
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+// Fallback defines how a node decides when the owner of a bucket is unreachable.
+type Fallback int
+
+const (
+	// FallbackLocal applies the operation to the local store, so that each node enforces limits on its own until the
+	// owner is reachable again.
+	FallbackLocal Fallback = iota
+	// FallbackAllow allows all requests (i.e. fails open).
+	FallbackAllow
+	// FallbackDeny denies all requests (i.e. fails closed).
+	FallbackDeny
+)
+
+const (
+	// BucketsPath is the path where nodes serve requests forwarded by their peers.
+	BucketsPath = "/cluster/v1/buckets"
+
+	// maxRequestSize is the maximum size, in bytes, of the body of requests forwarded by peers.
+	maxRequestSize = 64 << 10
+)
+
+var errUnknownOperation = errors.New("unknown operation")
+
+type (
+	// Config configures a cluster node.
+	Config struct {
+		// Self is the base URL of this node (e.g. http://10.0.0.1:8080), as listed in Peers.
+		Self string
+		// Peers are the base URLs of all the nodes in the cluster, including this one.
+		Peers []string
+		// Replicas is the number of times each peer is placed on the hash ring. Defaults to 100.
+		Replicas int
+		// Timeout is the maximum time to wait for a peer to respond. Defaults to 1 second.
+		Timeout  time.Duration
+		Fallback Fallback
+		// Token is a secret shared by all peers, which nodes send as a bearer token when forwarding requests.
+		Token string
+		// Authorizer decides which forwarded requests are served by the handler of the node. Defaults to
+		// admin.BearerToken(Token).
+		Authorizer admin.Authorizer
+	}
+
+	// Node is a token_bucket.Store that spreads buckets across a static set of peers, without any external store: each
+	// bucket is owned by a single peer, chosen by consistent hashing, and every operation on it is forwarded to its
+	// owner over HTTP. Owners keep their buckets in a local store.
+	// Each node must serve the handler returned by its Handler() method at BucketsPath, so that peers can reach it:
+	// since it gives access to all buckets, it only serves requests allowed by the configured authorizer.
+	Node struct {
+		self       string
+		ring       *Ring
+		local      token_bucket.Store
+		client     *http.Client
+		fallback   Fallback
+		token      string
+		authorizer admin.Authorizer
+	}
+
+	request struct {
+		Op     string              `json:"op"`
+		UserID token_bucket.UserID `json:"user_id,omitempty"`
+		Path   token_bucket.Path   `json:"path"`
+		Limit  common.Rate         `json:"limit"`
+		Refill common.Rate         `json:"refill"`
+		N      int                 `json:"n,omitempty"`
+	}
+
+	response struct {
+		Tokens     int       `json:"tokens"`
+		LastRefill time.Time `json:"last_refill"`
+		Taken      bool      `json:"taken"`
+	}
+)
+
+// NewNode returns a new cluster node, which keeps the buckets it owns in the local store.
+// It returns an error if the node itself is not listed among the peers, or if neither a token nor an authorizer has
+// been configured.
+func NewNode(cfg Config, local token_bucket.Store) (*Node, error) {
+	found := false
+	for _, p := range cfg.Peers {
+		if p == cfg.Self {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("node %v is not listed among the peers", cfg.Self)
+	}
+
+	if cfg.Authorizer == nil {
+		if cfg.Token == "" {
+			return nil, errors.New("no token or authorizer configured")
+		}
+
+		cfg.Authorizer = admin.BearerToken(cfg.Token)
+	}
+
+	if cfg.Replicas <= 0 {
+		cfg.Replicas = 100
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+
+	return &Node{
+		self:       cfg.Self,
+		ring:       NewRing(cfg.Peers, cfg.Replicas),
+		local:      local,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		fallback:   cfg.Fallback,
+		token:      cfg.Token,
+		authorizer: cfg.Authorizer,
+	}, nil
+}
+
+// Owner returns the base URL of the peer that owns the bucket identified by key.
+func (n *Node) Owner(key token_bucket.Key) string {
+	return n.ring.Owner(fmt.Sprintf("%d:%s:%s", len(key.Path), key.Path, key.UserID))
+}
+
+// Take refills the bucket identified by key according to cfg, then consumes n tokens from it if available.
+func (n *Node) Take(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, tokens int) (token_bucket.Bucket, bool, error) {
+	return n.do(ctx, request{Op: "take", UserID: key.UserID, Path: key.Path, Limit: cfg.Limit, Refill: cfg.Refill, N: tokens})
+}
+
+// Refill adds n tokens to the bucket identified by key, without exceeding its limit.
+func (n *Node) Refill(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, tokens int) (token_bucket.Bucket, error) {
+	b, _, err := n.do(ctx, request{Op: "refill", UserID: key.UserID, Path: key.Path, Limit: cfg.Limit, Refill: cfg.Refill, N: tokens})
+	return b, err
+}
+
+// Set refills the bucket identified by key according to cfg, then sets its number of tokens to n.
+func (n *Node) Set(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, tokens int) (token_bucket.Bucket, error) {
+	b, _, err := n.do(ctx, request{Op: "set", UserID: key.UserID, Path: key.Path, Limit: cfg.Limit, Refill: cfg.Refill, N: tokens})
+	return b, err
+}
+
+// Get returns the current state of the bucket identified by key, refilled according to cfg.
+func (n *Node) Get(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) (token_bucket.Bucket, error) {
+	b, _, err := n.do(ctx, request{Op: "get", UserID: key.UserID, Path: key.Path, Limit: cfg.Limit, Refill: cfg.Refill})
+	return b, err
+}
+
+// Reset fills up the bucket identified by key.
+func (n *Node) Reset(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) error {
+	_, _, err := n.do(ctx, request{Op: "reset", UserID: key.UserID, Path: key.Path, Limit: cfg.Limit, Refill: cfg.Refill})
+	return err
+}
+
+func (n *Node) do(ctx context.Context, req request) (token_bucket.Bucket, bool, error) {
+	key := token_bucket.Key{UserID: req.UserID, Path: req.Path}
+	owner := n.Owner(key)
+	if owner == n.self {
+		return n.apply(ctx, req)
+	}
+
+	b, taken, err := n.forward(ctx, owner, req)
+	if err == nil {
+		return b, taken, nil
+	}
+
+	logging.Logger().Warn("cannot reach bucket owner", zap.String("owner", owner), zap.Error(err))
+
+	switch n.fallback {
+	case FallbackAllow:
+		return token_bucket.Bucket{LastRefill: time.Now()}, true, nil
+	case FallbackDeny:
+		return token_bucket.Bucket{LastRefill: time.Now()}, false, nil
+	default:
+		return n.apply(ctx, req)
+	}
+}
+
+// apply applies the request to the local store.
+func (n *Node) apply(ctx context.Context, req request) (token_bucket.Bucket, bool, error) {
+	key := token_bucket.Key{UserID: req.UserID, Path: req.Path}
+	cfg := token_bucket.Config{Limit: req.Limit, Refill: req.Refill}
+
+	switch req.Op {
+	case "take":
+		return n.local.Take(ctx, key, cfg, req.N)
+	case "refill":
+		b, err := n.local.Refill(ctx, key, cfg, req.N)
+		return b, false, err
+	case "set":
+		b, err := n.local.Set(ctx, key, cfg, req.N)
+		return b, false, err
+	case "get":
+		b, err := n.local.Get(ctx, key, cfg)
+		return b, false, err
+	case "reset":
+		return token_bucket.Bucket{}, false, n.local.Reset(ctx, key, cfg)
+	default:
+		return token_bucket.Bucket{}, false, fmt.Errorf("%w: %v", errUnknownOperation, req.Op)
+	}
+}
+
+func (n *Node) forward(ctx context.Context, owner string, req request) (token_bucket.Bucket, bool, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return token_bucket.Bucket{}, false, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, owner+BucketsPath, bytes.NewReader(body))
+	if err != nil {
+		return token_bucket.Bucket{}, false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if n.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	res, err := n.client.Do(httpReq)
+	if err != nil {
+		return token_bucket.Bucket{}, false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return token_bucket.Bucket{}, false, fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+
+	var r response
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return token_bucket.Bucket{}, false, err
+	}
+
+	return token_bucket.Bucket{Tokens: r.Tokens, LastRefill: r.LastRefill}, r.Taken, nil
+}
+
+// Handler returns an HTTP handler that applies the operations forwarded by peers to the local store. Requests not
+// allowed by the authorizer are rejected with status 401.
+func (n *Node) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !n.authorizer(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		b, taken, err := n.apply(r.Context(), req)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownOperation) {
+				status = http.StatusBadRequest
+			}
+
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response{Tokens: b.Tokens, LastRefill: b.LastRefill, Taken: taken})
+	})
+}
@@ -0,0 +1,188 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	route = "/bar"
+	token = "secret"
+)
+
+var (
+	cfg = token_bucket.Config{
+		Limit:  common.Rate{Value: 2, Interval: time.Minute},
+		Refill: common.Rate{Value: 2, Interval: time.Minute},
+	}
+)
+
+// startCluster starts size nodes listening on localhost.
+func startCluster(t *testing.T, size int, fallback Fallback) ([]*Node, []*httptest.Server) {
+	servers := make([]*httptest.Server, size)
+	peers := make([]string, size)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+
+	nodes := make([]*Node, size)
+	for i, s := range servers {
+		node, err := NewNode(
+			Config{Self: peers[i], Peers: peers, Timeout: 500 * time.Millisecond, Fallback: fallback, Token: token},
+			token_bucket.NewMemoryStore(),
+		)
+		assert.NoError(t, err)
+
+		mux := http.NewServeMux()
+		mux.Handle(BucketsPath, node.Handler())
+		s.Config.Handler = mux
+		s.Start()
+		t.Cleanup(s.Close)
+
+		nodes[i] = node
+	}
+
+	return nodes, servers
+}
+
+// keyOwnedBy returns a key owned by the provided peer.
+func keyOwnedBy(t *testing.T, node *Node, owner string) token_bucket.Key {
+	for i := 0; i < 1000; i++ {
+		key := token_bucket.Key{UserID: token_bucket.UserID(fmt.Sprintf("user-%d", i)), Path: route}
+		if node.Owner(key) == owner {
+			return key
+		}
+	}
+
+	t.Fatalf("no key owned by %v", owner)
+	return token_bucket.Key{}
+}
+
+func TestNewNode_FailsIfSelfIsNotAPeer(t *testing.T) {
+	node, err := NewNode(Config{Self: "http://a", Peers: []string{"http://b"}, Token: token}, token_bucket.NewMemoryStore())
+
+	assert.Nil(t, node)
+	assert.Error(t, err)
+}
+
+func TestNewNode_FailsWithoutAuthorization(t *testing.T) {
+	node, err := NewNode(Config{Self: "http://a", Peers: []string{"http://a"}}, token_bucket.NewMemoryStore())
+	assert.Error(t, err)
+	assert.Nil(t, node)
+}
+
+func TestNode_Handler_RejectsUnauthorizedRequests(t *testing.T) {
+	_, servers := startCluster(t, 1, FallbackLocal)
+
+	res, err := http.Post(servers[0].URL+BucketsPath, "application/json", strings.NewReader(`{"op":"reset","path":"/bar"}`))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestNode_Handler_RejectsLargeRequests(t *testing.T) {
+	_, servers := startCluster(t, 1, FallbackLocal)
+
+	body := `{"op":"get","path":"` + strings.Repeat("a", maxRequestSize) + `"}`
+	req, err := http.NewRequest(http.MethodPost, servers[0].URL+BucketsPath, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestNode_Take_SharesQuotasAcrossNodes(t *testing.T) {
+	nodes, servers := startCluster(t, 3, FallbackLocal)
+	ctx := context.Background()
+	key := keyOwnedBy(t, nodes[0], "http://"+servers[1].Listener.Addr().String())
+
+	_, taken, err := nodes[0].Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+
+	_, taken, err = nodes[2].Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+
+	b, taken, err := nodes[1].Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.False(t, taken)
+	assert.Equal(t, 0, b.Tokens)
+
+	assert.NoError(t, nodes[0].Reset(ctx, key, cfg))
+	b, err = nodes[2].Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+
+	_, _, _ = nodes[2].Take(ctx, key, cfg, 2)
+	b, err = nodes[0].Refill(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+
+	_, err = nodes[0].Set(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	b, err = nodes[2].Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+}
+
+func TestNode_Take_FallsBack_WhenOwnerIsUnreachable(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback Fallback
+		expected []bool
+	}{
+		{"local", FallbackLocal, []bool{true, true, false}},
+		{"allow", FallbackAllow, []bool{true, true, true}},
+		{"deny", FallbackDeny, []bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, servers := startCluster(t, 2, tt.fallback)
+			ctx := context.Background()
+			key := keyOwnedBy(t, nodes[0], "http://"+servers[1].Listener.Addr().String())
+			servers[1].Close()
+
+			for _, expected := range tt.expected {
+				_, taken, err := nodes[0].Take(ctx, key, cfg, 1)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, taken)
+			}
+		})
+	}
+}
+
+func TestNode_WorksAsRateLimiterStore(t *testing.T) {
+	nodes, _ := startCluster(t, 2, FallbackLocal)
+	build := func(node *Node) *token_bucket.RateLimiter {
+		rl, err := token_bucket.NewRateLimiterBuilder().SetLimit(route, cfg).RegisterUser("alice").SetStore(node).Build()
+		assert.NoError(t, err)
+
+		return rl
+	}
+	rl1, rl2 := build(nodes[0]), build(nodes[1])
+	defer rl1.Stop()
+	defer rl2.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", "alice")
+
+	assert.True(t, rl1.Take(req).Allowed())
+	assert.True(t, rl2.Take(req).Allowed())
+	assert.Equal(t, common.Denied, rl1.Take(req).Outcome)
+	assert.Equal(t, common.Denied, rl2.Take(req).Outcome)
+}
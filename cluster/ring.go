@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring assigns keys to peers using consistent hashing, so that adding or removing a peer only moves a small fraction of
+// the keys. Each peer is placed on the ring several times (as virtual nodes) to spread keys evenly.
+type Ring struct {
+	hashes []uint32
+	peers  map[uint32]string
+}
+
+// NewRing returns a ring containing the provided peers, each one placed on the ring as many times as replicas.
+func NewRing(peers []string, replicas int) *Ring {
+	r := &Ring{
+		peers: make(map[uint32]string),
+	}
+
+	for _, p := range peers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(p + "#" + strconv.Itoa(i)))
+			if _, exists := r.peers[h]; exists {
+				continue
+			}
+
+			r.peers[h] = p
+			r.hashes = append(r.hashes, h)
+		}
+	}
+
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+
+	return r
+}
+
+// Owner returns the peer that owns key, or an empty string if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.peers[r.hashes[i]]
+}
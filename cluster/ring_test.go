@@ -0,0 +1,49 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Owner_IsStable(t *testing.T) {
+	peers := []string{"http://a", "http://b", "http://c"}
+	r1 := NewRing(peers, 100)
+	r2 := NewRing([]string{"http://c", "http://a", "http://b"}, 100)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.Equal(t, r1.Owner(key), r2.Owner(key))
+	}
+}
+
+func TestRing_Owner_SpreadsKeysAcrossPeers(t *testing.T) {
+	peers := []string{"http://a", "http://b", "http://c"}
+	r := NewRing(peers, 100)
+	counts := make(map[string]int)
+
+	for i := 0; i < 3000; i++ {
+		counts[r.Owner(fmt.Sprintf("key-%d", i))]++
+	}
+
+	for _, p := range peers {
+		assert.Greater(t, counts[p], 500)
+	}
+}
+
+func TestRing_Owner_OnlyMovesKeysOfRemovedPeer(t *testing.T) {
+	before := NewRing([]string{"http://a", "http://b", "http://c"}, 100)
+	after := NewRing([]string{"http://a", "http://b"}, 100)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner := before.Owner(key); owner != "http://c" {
+			assert.Equal(t, owner, after.Owner(key))
+		}
+	}
+}
+
+func TestRing_Owner_ReturnsEmptyStringIfRingIsEmpty(t *testing.T) {
+	assert.Empty(t, NewRing(nil, 100).Owner("key"))
+}
@@ -0,0 +1,111 @@
+// Command ratelimitd serves rate-limiting decisions over an HTTP/JSON API, so that services written in any language
+// can share the same limits.
+//
+// Usage:
+//
+//	ratelimitd -config config.json [-addr :8080] [-grpc-addr :8081] [-redis localhost:6379] [-redis-prefix ratelimitd:]
+//
+// If -grpc-addr is provided, the same limits are also served over gRPC, implementing the Envoy rate limit service.
+//
+// Buckets are kept in memory, unless a Redis server is provided, in which case they can be shared by several
+// instances.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fedragon/rate-limiter/envoy_rls"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/redis_store"
+	"github.com/fedragon/rate-limiter/service"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve the Envoy rate limit service on (optional)")
+	configFile := flag.String("config", "", "path to the JSON configuration file")
+	redisAddr := flag.String("redis", "", "address of the Redis server keeping the buckets (optional)")
+	redisPrefix := flag.String("redis-prefix", "ratelimitd:", "prefix of the Redis keys")
+	flag.Parse()
+
+	log := logging.Logger()
+	if *configFile == "" {
+		log.Fatal("missing -config")
+	}
+
+	f, err := os.Open(*configFile)
+	if err != nil {
+		log.Fatal("cannot open configuration", zap.String("file", *configFile), zap.Error(err))
+	}
+
+	cfg, err := service.LoadConfig(f)
+	f.Close()
+	if err != nil {
+		log.Fatal("cannot load configuration", zap.String("file", *configFile), zap.Error(err))
+	}
+
+	var store token_bucket.Store = token_bucket.NewMemoryStore()
+	if *redisAddr != "" {
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		defer client.Close()
+
+		store = redis_store.NewStore(client, *redisPrefix)
+	}
+
+	svc, err := service.New(cfg, store)
+	if err != nil {
+		log.Fatal("cannot create service", zap.Error(err))
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: svc.Handler(),
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("cannot serve HTTP", zap.String("addr", *addr), zap.Error(err))
+		}
+	}()
+
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal("cannot listen", zap.String("addr", *grpcAddr), zap.Error(err))
+		}
+
+		grpcServer := grpc.NewServer()
+		envoy_rls.NewServer(svc).Register(grpcServer)
+		defer grpcServer.GracefulStop()
+
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal("cannot serve gRPC", zap.String("addr", *grpcAddr), zap.Error(err))
+			}
+		}()
+	}
+
+	<-shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("cannot shut down server", zap.Error(err))
+	}
+}
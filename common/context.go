@@ -0,0 +1,18 @@
+package common
+
+import "context"
+
+type decisionKey struct{}
+
+// WithDecision returns a copy of ctx carrying the rate-limiting decision taken on a request, so that downstream
+// handlers can read it using DecisionFromContext.
+func WithDecision(ctx context.Context, d Decision) context.Context {
+	return context.WithValue(ctx, decisionKey{}, d)
+}
+
+// DecisionFromContext returns the rate-limiting decision carried by ctx. The returned boolean is false if ctx does not
+// carry any decision.
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	d, ok := ctx.Value(decisionKey{}).(Decision)
+	return d, ok
+}
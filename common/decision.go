@@ -0,0 +1,63 @@
+package common
+
+import "time"
+
+// Outcome represents the outcome of a rate-limiting decision.
+type Outcome int
+
+const (
+	// Allowed means that the request can be served.
+	Allowed Outcome = iota
+	// Denied means that the request exceeds the configured limits.
+	Denied
+	// Unknown means that no limit is configured for the request (e.g. unknown user or path).
+	Unknown
+	// Banned means that the request has been rejected, without being evaluated, because its issuer is temporarily
+	// banned.
+	Banned
+	// Allowlisted means that the request can be served without being evaluated, because its issuer is exempt from
+	// limits.
+	Allowlisted
+	// Denylisted means that the request has been rejected, without being evaluated, because its issuer is blocked.
+	Denylisted
+	// Failed means that no decision could be made, e.g. because the rate limiter state could not be accessed.
+	Failed
+)
+
+// String returns the outcome name.
+func (o Outcome) String() string {
+	switch o {
+	case Allowed:
+		return "allowed"
+	case Denied:
+		return "denied"
+	case Unknown:
+		return "unknown"
+	case Banned:
+		return "banned"
+	case Allowlisted:
+		return "allowlisted"
+	case Denylisted:
+		return "denylisted"
+	case Failed:
+		return "failed"
+	default:
+		return "invalid"
+	}
+}
+
+// Decision represents the result of a rate-limiting check.
+type Decision struct {
+	Outcome Outcome
+	// Limit is the maximum number of requests allowed in the current interval.
+	Limit int
+	// Remaining is the number of requests still allowed in the current interval.
+	Remaining int
+	// RetryAfter is the time to wait before issuing the next request, when the request has been denied.
+	RetryAfter time.Duration
+}
+
+// Allowed returns true if the request can be served.
+func (d Decision) Allowed() bool {
+	return d.Outcome == Allowed || d.Outcome == Allowlisted
+}
@@ -0,0 +1,12 @@
+package common
+
+import "net/http"
+
+// Observer is notified of the decisions taken by the HTTP middlewares of rate limiters, e.g. to export them as metrics
+// (see metrics.Collector).
+type Observer interface {
+	// Observe records the decision taken by a rate limiter using the provided algorithm on a request. The route
+	// identifies the configured route matched by the request, if any: since it is one of a bounded set, it can be used
+	// to label the decision, unlike the URL path of the request.
+	Observe(r *http.Request, algorithm, route string, d Decision)
+}
@@ -0,0 +1,154 @@
+package composite
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/tracing"
+)
+
+type (
+	// Limiter represents a rate limiter that can be combined with others into a composite one.
+	Limiter interface {
+		// Take consumes a unit of quota for the provided request, if available.
+		Take(r *http.Request) common.Decision
+		// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d. Nothing is
+		// given back unless the request was allowed.
+		Refund(r *http.Request, d common.Decision)
+		// Stop stops the rate limiter, cleaning up all used resources.
+		Stop()
+	}
+
+	// RateLimiter acts as an HTTP middleware that rate-limits traffic according to several limiters at once, which may
+	// use different algorithms and identify requests in different ways (e.g. per-user and global).
+	// A request is only served if all limiters allow it, in which case a unit of quota is consumed from each of them:
+	// if any of them denies it, nothing is consumed. This is not atomic: limiters are consulted one after the other,
+	// and those that allowed the request are refunded once another one denies it. Concurrent requests may therefore
+	// be denied by a limiter whose quota is only temporarily consumed by a request that is eventually denied.
+	// Since it is itself a Limiter, it can be nested in other composite rate limiters.
+	RateLimiter struct {
+		limiters []Limiter
+		observer common.Observer
+	}
+
+	// taken is a limiter that allowed a request, along with its decision.
+	taken struct {
+		limiter  Limiter
+		decision common.Decision
+	}
+)
+
+// NewRateLimiter returns a new rate limiter that combines the provided ones.
+func NewRateLimiter(limiters ...Limiter) *RateLimiter {
+	return &RateLimiter{
+		limiters: limiters,
+	}
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken by the HTTP middleware. Since the
+// combined limiters may limit different paths, decisions are not associated to any route. It must be invoked before
+// the rate limiter is used.
+func (rl *RateLimiter) SetObserver(observer common.Observer) *RateLimiter {
+	rl.observer = observer
+	return rl
+}
+
+// Stop stops all the combined rate limiters.
+func (rl *RateLimiter) Stop() {
+	for _, l := range rl.limiters {
+		l.Stop()
+	}
+}
+
+// Take consumes a unit of quota from every combined rate limiter, if all of them allow the request, otherwise it
+// refunds the limiters that already allowed it.
+// Limiters that exempt the request (i.e. allowlist it) are not consulted any further.
+// When the request is denied, the returned decision reports the most restrictive limit, i.e. the one that requires
+// waiting the longest before retrying. When the request is allowed, the decision reports the limit with the fewest
+// remaining requests.
+func (rl *RateLimiter) Take(r *http.Request) common.Decision {
+	consumed := make([]taken, 0, len(rl.limiters))
+	var allowed, allowlisted, denied *common.Decision
+
+	for _, l := range rl.limiters {
+		d := l.Take(r)
+
+		switch d.Outcome {
+		case common.Allowed:
+			consumed = append(consumed, taken{limiter: l, decision: d})
+			if allowed == nil || d.Remaining < allowed.Remaining {
+				allowed = &d
+			}
+		case common.Allowlisted:
+			allowlisted = &d
+		case common.Denied:
+			if denied == nil || d.RetryAfter > denied.RetryAfter {
+				denied = &d
+			}
+		default:
+			refund(r, consumed)
+			return d
+		}
+	}
+
+	if denied != nil {
+		refund(r, consumed)
+		return *denied
+	}
+
+	if allowed == nil && allowlisted != nil {
+		return *allowlisted
+	}
+
+	if allowed == nil {
+		return common.Decision{Outcome: common.Unknown}
+	}
+
+	return *allowed
+}
+
+// Refund gives back a unit of quota to every combined rate limiter, if the request was allowed. Since the decisions of
+// the individual limiters are not known anymore, d is passed on to all of them: limiters that exempted the request
+// may therefore be given back a unit of quota they did not consume, without exceeding their limits.
+func (rl *RateLimiter) Refund(r *http.Request, d common.Decision) {
+	for _, l := range rl.limiters {
+		l.Refund(r, d)
+	}
+}
+
+func refund(r *http.Request, consumed []taken) {
+	for _, t := range consumed {
+		t.limiter.Refund(r, t.decision)
+	}
+}
+
+// Handle returns an HTTP middleware that only serves requests allowed by all the combined rate limiters.
+func (rl *RateLimiter) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := rl.Take(r)
+		r = tracing.Record(r, "composite", "", r.URL.Path, d)
+		if rl.observer != nil {
+			rl.observer.Observe(r, "composite", "", d)
+		}
+
+		switch d.Outcome {
+		case common.Unknown:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case common.Denylisted:
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case common.Failed:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case common.Denied, common.Banned:
+			w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(d.Limit))
+			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(d.RetryAfter.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
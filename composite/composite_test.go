@@ -0,0 +1,156 @@
+package composite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/leaking_bucket"
+	"github.com/fedragon/rate-limiter/test"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	route  = "/bar"
+	userID = "0-0-0-0-0"
+)
+
+type fakeLimiter struct {
+	quota      int
+	retryAfter time.Duration
+	stopped    bool
+}
+
+func (f *fakeLimiter) Take(_ *http.Request) common.Decision {
+	if f.quota == 0 {
+		return common.Decision{Outcome: common.Denied, RetryAfter: f.retryAfter}
+	}
+
+	f.quota--
+	return common.Decision{Outcome: common.Allowed, Remaining: f.quota}
+}
+
+func (f *fakeLimiter) Refund(_ *http.Request, d common.Decision) {
+	if d.Outcome == common.Allowed {
+		f.quota++
+	}
+}
+
+func (f *fakeLimiter) Stop() {
+	f.stopped = true
+}
+
+func TestRateLimiter_Take_ConsumesFromAllWhenAllowed(t *testing.T) {
+	a := &fakeLimiter{quota: 2}
+	b := &fakeLimiter{quota: 5}
+	rl := NewRateLimiter(a, b)
+
+	d := rl.Take(httptest.NewRequest("GET", route, nil))
+
+	assert.True(t, d.Allowed())
+	assert.Equal(t, 1, d.Remaining)
+	assert.Equal(t, 1, a.quota)
+	assert.Equal(t, 4, b.quota)
+}
+
+func TestRateLimiter_Take_ConsumesNothingWhenDenied(t *testing.T) {
+	a := &fakeLimiter{quota: 2}
+	b := &fakeLimiter{quota: 0, retryAfter: time.Second}
+	c := &fakeLimiter{quota: 0, retryAfter: time.Minute}
+	rl := NewRateLimiter(a, b, c)
+
+	d := rl.Take(httptest.NewRequest("GET", route, nil))
+
+	assert.Equal(t, common.Denied, d.Outcome)
+	assert.Equal(t, time.Minute, d.RetryAfter)
+	assert.Equal(t, 2, a.quota)
+}
+
+func TestRateLimiter_Take_ReturnsUnknownWithoutLimiters(t *testing.T) {
+	rl := NewRateLimiter()
+
+	d := rl.Take(httptest.NewRequest("GET", route, nil))
+
+	assert.Equal(t, common.Unknown, d.Outcome)
+}
+
+func TestRateLimiter_Stop_StopsAllLimiters(t *testing.T) {
+	a := &fakeLimiter{}
+	b := &fakeLimiter{}
+	rl := NewRateLimiter(a, NewRateLimiter(b))
+
+	rl.Stop()
+
+	assert.True(t, a.stopped)
+	assert.True(t, b.stopped)
+}
+
+func Test_ServerReturns429_WhenAnyLimitIsExceeded(t *testing.T) {
+	perUser, err := token_bucket.NewRateLimiterBuilder().
+		SetLimit(route, token_bucket.Config{
+			Limit:  common.Rate{Value: 2, Interval: time.Minute},
+			Refill: common.Rate{Value: 2, Interval: time.Minute},
+		}).
+		RegisterUser(userID).
+		Build()
+	assert.NoError(t, err)
+	global := leaking_bucket.NewRateLimiter(&common.Rate{Value: 1, Interval: time.Minute})
+	rl := NewRateLimiter(perUser, global)
+	defer rl.Stop()
+
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	statusCode, err := sendRequest(server.URL+route, userID, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, err = sendRequest(server.URL+route, userID, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+
+	// the per-user quota has not been consumed by the denied request
+	global.Refund(nil, common.Decision{Outcome: common.Allowed})
+	statusCode, err = sendRequest(server.URL+route, userID, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+}
+
+func Test_ServerReturns401_IfUserIsUnknown(t *testing.T) {
+	perUser, err := token_bucket.NewRateLimiterBuilder().
+		SetLimit(route, token_bucket.Config{
+			Limit:  common.Rate{Value: 1, Interval: time.Minute},
+			Refill: common.Rate{Value: 1, Interval: time.Minute},
+		}).
+		Build()
+	assert.NoError(t, err)
+	global := leaking_bucket.NewRateLimiter(&common.Rate{Value: 1, Interval: time.Minute})
+	rl := NewRateLimiter(global, perUser)
+	defer rl.Stop()
+
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	statusCode, err := sendRequest(server.URL+route, userID, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// the global quota has been given back
+	assert.True(t, global.Take(nil).Allowed())
+}
+
+func sendRequest(route string, userID string, client *http.Client) (int, error) {
+	req, _ := http.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode, nil
+}
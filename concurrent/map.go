@@ -38,6 +38,43 @@ func (m *Map[K, V]) Put(key K, value V) {
 	m.content[key] = value
 }
 
+// Delete removes key and its associated value, if any.
+func (m *Map[K, V]) Delete(key K) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	delete(m.content, key)
+}
+
+// DeleteIf atomically removes all keys whose value satisfies f. It returns the number of removed keys.
+func (m *Map[K, V]) DeleteIf(f func(key K, value V) bool) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var n int
+	for k, v := range m.content {
+		if f(k, v) {
+			delete(m.content, k)
+			n++
+		}
+	}
+
+	return n
+}
+
+// Update atomically replaces the value associated to key with the one returned by f, which receives the current value
+// (or its type's zero value) and a boolean indicating whether it exists. It returns the new value.
+func (m *Map[K, V]) Update(key K, f func(value V, exists bool) V) V {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	value, exists := m.content[key]
+	value = f(value, exists)
+	m.content[key] = value
+
+	return value
+}
+
 // Size returns the current map size.
 func (m *Map[K, V]) Size() int {
 	m.mux.RLock()
@@ -51,7 +88,7 @@ func (m *Map[K, V]) Iterate() <-chan Tuple[K, V] {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 
-	tuples := make(chan Tuple[K, V], m.Size())
+	tuples := make(chan Tuple[K, V], len(m.content))
 	defer close(tuples)
 	for k, v := range m.content {
 		tuples <- Tuple[K, V]{k, v}
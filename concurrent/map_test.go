@@ -92,6 +92,64 @@ func TestMap_ConcurrentGet(t *testing.T) {
 	assert.Equal(t, expected, mostRecent(outputs))
 }
 
+func TestMap_Delete(t *testing.T) {
+	m := NewMap[int, string]()
+	key := 1
+	m.Put(key, "a")
+
+	m.Delete(key)
+
+	_, ok := m.Get(key)
+	assert.False(t, ok)
+}
+
+func TestMap_DeleteIf(t *testing.T) {
+	m := NewMap[int, string]()
+	m.Put(1, "a")
+	m.Put(2, "b")
+	m.Put(3, "a")
+
+	assert.Equal(t, 2, m.DeleteIf(func(_ int, value string) bool { return value == "a" }))
+
+	assert.Equal(t, 1, m.Size())
+	_, ok := m.Get(2)
+	assert.True(t, ok)
+}
+
+func TestMap_Update(t *testing.T) {
+	m := NewMap[int, int]()
+	key := 1
+	incr := func(value int, _ bool) int { return value + 1 }
+
+	assert.Equal(t, 1, m.Update(key, incr))
+	assert.Equal(t, 2, m.Update(key, incr))
+
+	got, ok := m.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, 2, got)
+}
+
+func TestMap_ConcurrentUpdate(t *testing.T) {
+	m := NewMap[int, int]()
+	key := 1
+	producer := func(wg *sync.WaitGroup, m *Map[int, int]) {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			m.Update(key, func(value int, _ bool) int { return value + 1 })
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go producer(&wg, m)
+	go producer(&wg, m)
+	go producer(&wg, m)
+	wg.Wait()
+
+	got, _ := m.Get(key)
+	assert.Equal(t, 30, got)
+}
+
 func TestMap_Size(t *testing.T) {
 	m := NewMap[int, string]()
 
@@ -148,3 +206,33 @@ func mostRecent(msgs <-chan msg) string {
 
 	return value
 }
+
+func TestMap_IterateWhileWriting(t *testing.T) {
+	m := NewMap[int, string]()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		go func() {
+			for ctx.Err() == nil {
+				m.Iterate()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			for i := 0; i < 100; i++ {
+				m.Put(i, "x")
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "writer is blocked")
+	}
+}
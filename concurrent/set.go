@@ -33,6 +33,14 @@ func (s *Set[V]) Put(value V) {
 	s.content[value] = struct{}{}
 }
 
+// Remove removes value from the set, if it exists.
+func (s *Set[V]) Remove(value V) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.content, value)
+}
+
 // Size returns the current set size.
 func (s *Set[V]) Size() int {
 	s.mux.RLock()
@@ -46,7 +54,7 @@ func (s *Set[V]) Iterate() <-chan V {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
 
-	values := make(chan V, s.Size())
+	values := make(chan V, len(s.content))
 	defer close(values)
 	for v := range s.content {
 		values <- v
@@ -26,6 +26,15 @@ func TestSet_Put(t *testing.T) {
 	assert.True(t, s.Contains(1))
 }
 
+func TestSet_Remove(t *testing.T) {
+	s := NewSet[int]()
+	s.Put(1)
+
+	s.Remove(1)
+
+	assert.False(t, s.Contains(1))
+}
+
 func TestSet_ConcurrentPut(t *testing.T) {
 	s := NewSet[int]()
 	key := 1
@@ -112,3 +121,33 @@ func TestSet_ConcurrentIterate(t *testing.T) {
 	go client(ctx, m)
 	go client(ctx, m)
 }
+
+func TestSet_IterateWhileWriting(t *testing.T) {
+	m := NewSet[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		go func() {
+			for ctx.Err() == nil {
+				m.Iterate()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			for i := 0; i < 100; i++ {
+				m.Put(i)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "writer is blocked")
+	}
+}
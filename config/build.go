@@ -0,0 +1,387 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fedragon/rate-limiter/access"
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/composite"
+	"github.com/fedragon/rate-limiter/leaking_bucket"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/fedragon/rate-limiter/tracing"
+)
+
+type (
+	route struct {
+		id        string
+		algorithm string
+		signature string
+		methods   map[string]bool
+		limiter   composite.Limiter
+	}
+
+	// routeStore keeps the buckets of a route apart from those of other routes on the same path, by keying them by the
+	// route ID (i.e. its methods and path) rather than by the request path.
+	routeStore struct {
+		token_bucket.Store
+		id token_bucket.Path
+	}
+
+	// tiered dispatches requests to the limiter of the tier of their user.
+	tiered struct {
+		extractor token_bucket.UserExtractor
+		tiers     map[token_bucket.UserID]string
+		limiters  map[string]*token_bucket.RateLimiter
+	}
+
+	// Middleware acts as an HTTP middleware that applies the limiters declared in a configuration to the matching
+	// requests. Requests not matching any route are not limited.
+	// It needs to be stopped, by invoking the Stop() method during the HTTP server shutdown process, to clean up all
+	// used resources.
+	Middleware struct {
+		routes    map[string][]*route
+		all       []*route
+		extractor token_bucket.UserExtractor
+		status    int
+		headers   bool
+		body      string
+		observer  common.Observer
+	}
+)
+
+// Extractor returns the function identifying users, as declared by the key.
+func (k Key) Extractor() token_bucket.UserExtractor {
+	switch {
+	case k.Query != "":
+		return func(r *http.Request) token_bucket.UserID {
+			return token_bucket.UserID(r.URL.Query().Get(k.Query))
+		}
+	case k.IP:
+		return func(r *http.Request) token_bucket.UserID {
+			if ip := access.RemoteIP(r); ip != nil {
+				return token_bucket.UserID(ip.String())
+			}
+
+			return ""
+		}
+	case k.Header != "":
+		return token_bucket.FromHeader(k.Header)
+	default:
+		return token_bucket.FromHeader("X-User-ID")
+	}
+}
+
+// config returns the token bucket configuration of the limit.
+func (l *Limit) config() token_bucket.Config {
+	refill := l.Refill
+	if refill == 0 {
+		refill = l.Limit
+	}
+
+	return token_bucket.Config{
+		Limit:  common.Rate{Value: l.Limit, Interval: time.Duration(l.Interval)},
+		Refill: common.Rate{Value: refill, Interval: time.Duration(l.Interval)},
+	}
+}
+
+// Build builds the limiters declared in the configuration, keeping the state of token buckets in store. Limiters
+// built from different configurations sharing the same store also share the state of the buckets of the same users
+// and routes. Routes on the same path but with different methods have separate buckets. If store is nil, buckets are
+// kept in memory.
+func (c *Config) Build(store token_bucket.Store) (*Middleware, error) {
+	return c.build(store, nil)
+}
+
+// build builds the limiters declared in the configuration, reusing the limiters of prev, if any, whose routes have not
+// changed.
+func (c *Config) build(store token_bucket.Store, prev *Middleware) (*Middleware, error) {
+	if store == nil {
+		store = token_bucket.NewMemoryStore()
+	}
+
+	m := &Middleware{
+		routes:  make(map[string][]*route),
+		status:  http.StatusTooManyRequests,
+		headers: true,
+		body:    c.Response.Body,
+	}
+
+	if c.Response.Status != 0 {
+		m.status = c.Response.Status
+	}
+
+	if c.Response.Headers != nil {
+		m.headers = *c.Response.Headers
+	}
+
+	tiers := make(map[token_bucket.UserID]string)
+	for name, t := range c.Tiers {
+		for _, u := range t.Users {
+			tiers[token_bucket.UserID(u)] = name
+		}
+	}
+
+	reusable := make(map[string]*route)
+	if prev != nil {
+		for _, rt := range prev.all {
+			reusable[rt.id] = rt
+		}
+	}
+
+	m.extractor = c.Key.Extractor()
+	for _, r := range c.Routes {
+		rt := &route{id: r.id(), algorithm: r.Algorithm, signature: c.signature(r), methods: make(map[string]bool)}
+		if rt.algorithm == "" {
+			rt.algorithm = TokenBucket
+		}
+
+		for _, method := range r.Methods {
+			rt.methods[method] = true
+		}
+
+		if old, ok := reusable[rt.id]; ok && old.signature == rt.signature {
+			rt.limiter = old.limiter
+		} else {
+			limiter, err := c.buildRoute(r, tiers, m.extractor, store)
+			if err != nil {
+				m.release(prev)
+				return nil, err
+			}
+			rt.limiter = limiter
+		}
+
+		m.routes[r.Path] = append(m.routes[r.Path], rt)
+		m.all = append(m.all, rt)
+	}
+
+	return m, nil
+}
+
+func (c *Config) buildRoute(
+	r *Route,
+	tiers map[token_bucket.UserID]string,
+	extractor token_bucket.UserExtractor,
+	store token_bucket.Store,
+) (composite.Limiter, error) {
+	if r.Algorithm == LeakingBucket {
+		rate := common.Rate{Value: r.Rate.Limit, Interval: time.Duration(r.Rate.Interval)}
+		return leaking_bucket.NewRateLimiter(&rate), nil
+	}
+
+	store = &routeStore{Store: store, id: token_bucket.Path(r.id())}
+	t := &tiered{
+		extractor: extractor,
+		tiers:     tiers,
+		limiters:  make(map[string]*token_bucket.RateLimiter),
+	}
+
+	for tier, limit := range r.Limits {
+		cfg := limit.config()
+		if r.Global != nil {
+			global := r.Global.config()
+			cfg.Global = &global
+		}
+
+		b := token_bucket.NewRateLimiterBuilder().
+			SetLimit(r.Path, cfg).
+			SetUserExtractor(extractor).
+			SetStore(store)
+
+		for _, u := range c.Tiers[tier].Users {
+			b.RegisterUser(u)
+		}
+
+		rl, err := b.Build()
+		if err != nil {
+			t.Stop()
+			return nil, err
+		}
+
+		t.limiters[tier] = rl
+	}
+
+	return t, nil
+}
+
+func (s *routeStore) key(key token_bucket.Key) token_bucket.Key {
+	key.Path = s.id
+	return key
+}
+
+// Take refills the bucket of the route identified by key according to cfg, then consumes n tokens from it if
+// available.
+func (s *routeStore) Take(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, bool, error) {
+	return s.Store.Take(ctx, s.key(key), cfg, n)
+}
+
+// Refill adds n tokens to the bucket of the route identified by key, without exceeding its limit.
+func (s *routeStore) Refill(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	return s.Store.Refill(ctx, s.key(key), cfg, n)
+}
+
+// Set refills the bucket of the route identified by key according to cfg, then sets its number of tokens to n.
+func (s *routeStore) Set(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	return s.Store.Set(ctx, s.key(key), cfg, n)
+}
+
+// Get returns the current state of the bucket of the route identified by key, refilled according to cfg.
+func (s *routeStore) Get(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) (token_bucket.Bucket, error) {
+	return s.Store.Get(ctx, s.key(key), cfg)
+}
+
+// Reset fills up the bucket of the route identified by key.
+func (s *routeStore) Reset(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) error {
+	return s.Store.Reset(ctx, s.key(key), cfg)
+}
+
+// Take consumes a unit of quota from the limiter of the tier of the user issuing the request. Users not belonging to
+// any tier limited on the route are Unknown.
+func (t *tiered) Take(r *http.Request) common.Decision {
+	if rl, ok := t.limiter(r); ok {
+		return rl.Take(r)
+	}
+
+	return common.Decision{Outcome: common.Unknown}
+}
+
+// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d.
+func (t *tiered) Refund(r *http.Request, d common.Decision) {
+	if rl, ok := t.limiter(r); ok {
+		rl.Refund(r, d)
+	}
+}
+
+// Stop stops the limiters of all tiers.
+func (t *tiered) Stop() {
+	for _, rl := range t.limiters {
+		rl.Stop()
+	}
+}
+
+func (t *tiered) limiter(r *http.Request) (*token_bucket.RateLimiter, bool) {
+	tier, ok := t.tiers[t.extractor(r)]
+	if !ok {
+		return nil, false
+	}
+
+	rl, ok := t.limiters[tier]
+	return rl, ok
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken on requests matching any
+// route, which are associated to the ID of the route (e.g. "GET,POST /api/search"). It must be invoked before the
+// middleware is used.
+func (m *Middleware) SetObserver(observer common.Observer) *Middleware {
+	m.observer = observer
+	return m
+}
+
+// Stop stops all limiters.
+func (m *Middleware) Stop() {
+	m.release(nil)
+}
+
+// release stops the limiters that are not used by next.
+func (m *Middleware) release(next *Middleware) {
+	used := make(map[composite.Limiter]bool)
+	if next != nil {
+		for _, rt := range next.all {
+			used[rt.limiter] = true
+		}
+	}
+
+	for _, rt := range m.all {
+		if !used[rt.limiter] {
+			rt.limiter.Stop()
+		}
+	}
+}
+
+// route returns the route matching the request, if any.
+func (m *Middleware) route(r *http.Request) (*route, bool) {
+	for _, rt := range m.routes[r.URL.Path] {
+		if len(rt.methods) == 0 || rt.methods[r.Method] {
+			return rt, true
+		}
+	}
+
+	return nil, false
+}
+
+// Take consumes a unit of quota for the request from the limiter of the matching route. Requests not matching any
+// route are always allowed.
+func (m *Middleware) Take(r *http.Request) common.Decision {
+	rt, ok := m.route(r)
+	if !ok {
+		return common.Decision{Outcome: common.Allowed}
+	}
+
+	return rt.limiter.Take(r)
+}
+
+// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d.
+func (m *Middleware) Refund(r *http.Request, d common.Decision) {
+	if rt, ok := m.route(r); ok {
+		rt.limiter.Refund(r, d)
+	}
+}
+
+// Handle returns an HTTP middleware that applies the declared limits to all received requests, responding as declared
+// to requests exceeding them.
+func (m *Middleware) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.serve(w, r, next)
+	})
+}
+
+func (m *Middleware) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	rt, ok := m.route(r)
+	if !ok {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	d := rt.limiter.Take(r)
+	// leaking buckets are shared by all users
+	var key string
+	if rt.algorithm == TokenBucket {
+		key = string(m.extractor(r))
+	}
+	r = tracing.Record(r, rt.algorithm, key, rt.id, d)
+	if m.observer != nil {
+		m.observer.Observe(r, rt.algorithm, rt.id, d)
+	}
+
+	switch d.Outcome {
+	case common.Unknown:
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case common.Denylisted:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case common.Failed:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case common.Denied, common.Banned:
+		if m.headers {
+			w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(d.Limit))
+			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(d.RetryAfter.Seconds())))
+		}
+
+		w.WriteHeader(m.status)
+		if m.body != "" {
+			w.Write([]byte(m.body))
+		}
+		return
+	}
+
+	if m.headers && d.Outcome == common.Allowed {
+		w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(d.Limit))
+		w.Header().Add("X-Ratelimit-Remaining", strconv.Itoa(d.Remaining))
+	}
+
+	next.ServeHTTP(w, r)
+}
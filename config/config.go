@@ -0,0 +1,268 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Algorithms supported by routes.
+const (
+	TokenBucket   = "token_bucket"
+	LeakingBucket = "leaking_bucket"
+)
+
+type (
+	// Duration is a time.Duration written as a string, e.g. "1m30s".
+	Duration time.Duration
+
+	// node records the position of a configuration element, along with any unknown field it contains.
+	node struct {
+		pos     Position
+		unknown []Error
+	}
+
+	// Config declares rate limiters and how they are applied to HTTP requests. It can be written in YAML or JSON:
+	//
+	//	version: 1
+	//	key:
+	//	  header: X-User-ID
+	//	response:
+	//	  status: 429
+	//	  headers: true
+	//	tiers:
+	//	  free:
+	//	    users: [alice, bob]
+	//	  pro:
+	//	    users: [carol]
+	//	routes:
+	//	  - path: /api/search
+	//	    methods: [GET]
+	//	    limits:
+	//	      free: {limit: 10, interval: 1m}
+	//	      pro: {limit: 100, refill: 10, interval: 1s}
+	//	    global: {limit: 1000, interval: 1m}
+	//	  - path: /api/upload
+	//	    algorithm: leaking_bucket
+	//	    rate: {limit: 5, interval: 1s}
+	Config struct {
+		node
+		file string
+
+		Version  int              `yaml:"version"`
+		Key      Key              `yaml:"key"`
+		Response Response         `yaml:"response"`
+		Tiers    map[string]*Tier `yaml:"tiers"`
+		Routes   []*Route         `yaml:"routes"`
+	}
+
+	// Key declares how users are identified. At most one field can be set: by default, users are identified by the
+	// value of the `X-User-ID` header.
+	Key struct {
+		node
+
+		// Header identifies users by the value of a request header.
+		Header string `yaml:"header"`
+		// Query identifies users by the value of a query parameter.
+		Query string `yaml:"query"`
+		// IP identifies users by their IP address.
+		IP bool `yaml:"ip"`
+	}
+
+	// Response declares the response to requests exceeding the limits.
+	Response struct {
+		node
+
+		// Status is the status code. Defaults to 429.
+		Status int `yaml:"status"`
+		// Headers, if true, adds the `X-Ratelimit-Limit` and `X-Ratelimit-Retry-After` headers to all limited
+		// responses, and the `X-Ratelimit-Limit` and `X-Ratelimit-Remaining` headers to all allowed ones. Defaults to
+		// true.
+		Headers *bool `yaml:"headers"`
+		// Body is the body of the response. Defaults to none.
+		Body string `yaml:"body"`
+	}
+
+	// Tier is a group of users sharing the same limits.
+	Tier struct {
+		node
+
+		Users []string `yaml:"users"`
+	}
+
+	// Route declares the limits of the requests on a path.
+	Route struct {
+		node
+
+		// Path is the absolute path of the requests, which needs to match exactly.
+		Path string `yaml:"path"`
+		// Methods are the methods of the requests. Defaults to all methods.
+		Methods []string `yaml:"methods"`
+		// Algorithm is either token_bucket (the default) or leaking_bucket.
+		Algorithm string `yaml:"algorithm"`
+		// Limits are the limits of each user, by tier (token_bucket only). Users not belonging to any of these tiers
+		// are rejected.
+		Limits map[string]*Limit `yaml:"limits"`
+		// Global is the limit shared by all users (token_bucket only).
+		Global *Limit `yaml:"global"`
+		// Rate is the rate at which requests are served (leaking_bucket only), regardless of the user.
+		Rate *Limit `yaml:"rate"`
+	}
+
+	// Limit declares a rate.
+	Limit struct {
+		node
+
+		// Limit is the maximum number of requests allowed at once.
+		Limit int `yaml:"limit"`
+		// Refill is the number of requests given back every Interval (token_bucket only). Defaults to Limit.
+		Refill   int      `yaml:"refill"`
+		Interval Duration `yaml:"interval"`
+	}
+)
+
+// Load loads the configuration from a YAML or JSON file.
+func Load(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(file, data)
+}
+
+// Parse parses a YAML or JSON configuration and validates it, returning all the errors found as Errors. The file name
+// is only used to report errors.
+func Parse(file string, data []byte) (*Config, error) {
+	cfg := &Config{file: file}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, Errors{{File: file, Message: err.Error()}}
+		}
+
+		return nil, typeErrors(file, typeErr)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+func typeErrors(file string, err *yaml.TypeError) Errors {
+	errs := make(Errors, len(err.Errors))
+	for i, e := range err.Errors {
+		errs[i] = Error{File: file, Message: e}
+		if m := typeErrorLine.FindStringSubmatch(e); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs[i].Line = line
+			errs[i].Message = m[2]
+		}
+	}
+
+	return errs
+}
+
+// decode decodes n into v, which must be a pointer to a plain type (i.e. without an UnmarshalYAML method), recording
+// its position and unknown fields.
+func (nd *node) decode(n *yaml.Node, v any, fields ...string) error {
+	nd.pos = Position{Line: n.Line, Column: n.Column}
+
+	if n.Kind == yaml.MappingNode {
+		known := make(map[string]bool, len(fields))
+		for _, f := range fields {
+			known[f] = true
+		}
+
+		for i := 0; i < len(n.Content); i += 2 {
+			k := n.Content[i]
+			if !known[k.Value] {
+				nd.unknown = append(nd.unknown, Error{
+					Position: Position{Line: k.Line, Column: k.Column},
+					Message:  fmt.Sprintf("unknown field %q", k.Value),
+				})
+			}
+		}
+	}
+
+	return n.Decode(v)
+}
+
+// UnmarshalYAML decodes the configuration.
+func (c *Config) UnmarshalYAML(n *yaml.Node) error {
+	type plain Config
+	return c.node.decode(n, (*plain)(c), "version", "key", "response", "tiers", "routes")
+}
+
+// UnmarshalYAML decodes the key.
+func (k *Key) UnmarshalYAML(n *yaml.Node) error {
+	type plain Key
+	return k.node.decode(n, (*plain)(k), "header", "query", "ip")
+}
+
+// UnmarshalYAML decodes the response.
+func (r *Response) UnmarshalYAML(n *yaml.Node) error {
+	type plain Response
+	return r.node.decode(n, (*plain)(r), "status", "headers", "body")
+}
+
+// UnmarshalYAML decodes the tier.
+func (t *Tier) UnmarshalYAML(n *yaml.Node) error {
+	type plain Tier
+	return t.node.decode(n, (*plain)(t), "users")
+}
+
+// UnmarshalYAML decodes the route.
+func (r *Route) UnmarshalYAML(n *yaml.Node) error {
+	type plain Route
+	return r.node.decode(n, (*plain)(r), "path", "methods", "algorithm", "limits", "global", "rate")
+}
+
+// UnmarshalYAML decodes the limit.
+func (l *Limit) UnmarshalYAML(n *yaml.Node) error {
+	type plain Limit
+	return l.node.decode(n, (*plain)(l), "limit", "refill", "interval")
+}
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes the duration from a string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalYAML decodes the duration from a string.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	v, err := time.ParseDuration(n.Value)
+	if n.Kind != yaml.ScalarNode || err != nil {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: invalid duration %q", n.Line, n.Value)}}
+	}
+
+	*d = Duration(v)
+	return nil
+}
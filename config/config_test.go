@@ -0,0 +1,220 @@
+package config
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/test"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/example.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "X-User-ID", cfg.Key.Header)
+	assert.Len(t, cfg.Routes, 3)
+	assert.Equal(t, Duration(time.Second), cfg.Routes[0].Limits["pro"].Interval)
+	assert.Equal(t, LeakingBucket, cfg.Routes[2].Algorithm)
+
+	cfg, err = Load("testdata/example.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", cfg.Key.Query)
+}
+
+func TestParse_ReportsAllErrorsWithPositions(t *testing.T) {
+	_, err := Parse("limits.yaml", []byte(`version: 1
+key:
+  header: X-User-ID
+  ip: true
+tiers:
+  free:
+    users: [alice]
+    quota: 3
+  pro:
+    users: [alice]
+routes:
+  - path: api
+    methods: [FETCH]
+    limits:
+      gold: {limit: 0, interval: 1m}
+  - path: /upload
+    algorithm: leaking_bucket
+  - path: /upload
+    algorithm: magic
+`))
+
+	var errs Errors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(
+		t,
+		"limits.yaml:3:3: key: only one of header, query and ip can be set\n"+
+			"limits.yaml:8:5: unknown field \"quota\"\n"+
+			"limits.yaml:10:5: user \"alice\" belongs to tiers \"free\" and \"pro\"\n"+
+			"limits.yaml:12:5: routes[0]: path \"api\" must start with '/'\n"+
+			"limits.yaml:12:5: routes[0]: unknown method \"FETCH\"\n"+
+			"limits.yaml:12:5: routes[0]: unknown tier \"gold\"\n"+
+			"limits.yaml:15:13: routes[0].limits.gold: limit must be positive\n"+
+			"limits.yaml:16:5: routes[1]: missing rate\n"+
+			"limits.yaml:18:5: routes[2]: unknown algorithm \"magic\"\n"+
+			"limits.yaml:18:5: routes[2]: /upload overlaps with the route at line 16",
+		errs.Error(),
+	)
+}
+
+func TestParse_RejectsRefillOnLeakingBucketRoutes(t *testing.T) {
+	_, err := Parse("limits.yaml", []byte(`version: 1
+routes:
+  - path: /upload
+    algorithm: leaking_bucket
+    rate: {limit: 5, refill: 1, interval: 1s}
+`))
+
+	var errs Errors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, "limits.yaml:5:11: routes[0].rate: refill is only supported by token_bucket", errs.Error())
+}
+
+func TestParse_TypeErrors(t *testing.T) {
+	_, err := Parse("limits.json", []byte(`{
+  "version": 1,
+  "tiers": {"free": {"users": ["alice"]}},
+  "routes": [
+    {"path": "/a", "limits": {"free": {"limit": "ten", "interval": "1m"}}},
+    {"path": "/b", "limits": {"free": {"limit": 1, "interval": "soon"}}}
+  ]
+}`))
+
+	var errs Errors
+	assert.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 2)
+	assert.Equal(t, 5, errs[0].Line)
+	assert.Contains(t, errs[0].Message, "cannot unmarshal")
+	assert.Equal(t, `limits.json:6: invalid duration "soon"`, errs[1].Error())
+}
+
+func TestParse_SyntaxError(t *testing.T) {
+	_, err := Parse("limits.yaml", []byte("routes: [\n"))
+	assert.Error(t, err)
+}
+
+func request(method, path, user string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("X-User-ID", user)
+
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	cfg, err := Load("testdata/example.yaml")
+	assert.NoError(t, err)
+
+	m, err := cfg.Build(nil)
+	assert.NoError(t, err)
+	defer m.Stop()
+
+	h := m.Handle(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// free tier: 2 requests per minute
+	for i := 0; i < 2; i++ {
+		w := serve(h, request(http.MethodGet, "/api/search", "alice"))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("X-Ratelimit-Limit"))
+		assert.Equal(t, strconv.Itoa(1-i), w.Header().Get("X-Ratelimit-Remaining"))
+	}
+
+	w := serve(h, request(http.MethodGet, "/api/search", "alice"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "too many requests", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("X-Ratelimit-Retry-After"))
+
+	// pro tier: higher limit, but bound by the global one (2 already taken by alice)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if serve(h, request(http.MethodGet, "/api/search", "carol")).Code == http.StatusOK {
+			allowed++
+		}
+	}
+	assert.Equal(t, 4, allowed)
+
+	// methods have their own routes
+	assert.Equal(t, http.StatusOK, serve(h, request(http.MethodPost, "/api/search", "carol")).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(h, request(http.MethodPost, "/api/search", "alice")).Code)
+
+	// unknown users and other methods
+	assert.Equal(t, http.StatusUnauthorized, serve(h, request(http.MethodGet, "/api/search", "dave")).Code)
+	assert.Equal(t, http.StatusOK, serve(h, request(http.MethodDelete, "/api/search", "dave")).Code)
+
+	// leaking bucket, shared by all users
+	assert.Equal(t, http.StatusOK, serve(h, request(http.MethodPut, "/api/upload", "dave")).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(h, request(http.MethodPut, "/api/upload", "alice")).Code)
+
+	// other paths are not limited
+	assert.Equal(t, http.StatusOK, serve(h, request(http.MethodGet, "/", "")).Code)
+}
+
+func TestMiddleware_MethodsHaveSeparateBuckets(t *testing.T) {
+	cfg, err := Load("testdata/example.yaml")
+	assert.NoError(t, err)
+
+	m, err := cfg.Build(nil)
+	assert.NoError(t, err)
+	defer m.Stop()
+
+	h := m.Handle(test.ItsOK())
+
+	// POST allows 1 request per minute
+	assert.Equal(t, http.StatusOK, serve(h, request(http.MethodPost, "/api/search", "carol")).Code)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, serve(h, request(http.MethodPost, "/api/search", "carol")).Code)
+	}
+
+	// GET allows 5 requests per second, regardless of POST
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, serve(h, request(http.MethodGet, "/api/search", "carol")).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve(h, request(http.MethodGet, "/api/search", "carol")).Code)
+}
+
+func TestMiddleware_SharedStore(t *testing.T) {
+	cfg, err := Load("testdata/example.json")
+	assert.NoError(t, err)
+
+	store := token_bucket.NewMemoryStore()
+	first, err := cfg.Build(store)
+	assert.NoError(t, err)
+	defer first.Stop()
+
+	second, err := cfg.Build(store)
+	assert.NoError(t, err)
+	defer second.Stop()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/search?user=alice", nil)
+	assert.True(t, first.Take(r).Allowed())
+	assert.False(t, second.Take(r).Allowed())
+}
+
+func TestKey_Extractor(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?user=abc", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-User-ID", "def")
+	r.Header.Set("X-Api-Key", "ghi")
+
+	assert.Equal(t, token_bucket.UserID("def"), Key{}.Extractor()(r))
+	assert.Equal(t, token_bucket.UserID("ghi"), Key{Header: "X-API-Key"}.Extractor()(r))
+	assert.Equal(t, token_bucket.UserID("abc"), Key{Query: "user"}.Extractor()(r))
+	assert.Equal(t, token_bucket.UserID("10.0.0.1"), Key{IP: true}.Extractor()(r))
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Position is a position in a configuration file.
+	Position struct {
+		Line   int
+		Column int
+	}
+
+	// Error is an error found at a position of a configuration file.
+	Error struct {
+		File string
+		Position
+		Message string
+	}
+
+	// Errors are all the errors found in a configuration file.
+	Errors []Error
+)
+
+// Error returns the error message, prefixed by its position, if known.
+func (e Error) Error() string {
+	switch {
+	case e.Line == 0:
+		return fmt.Sprintf("%v: %v", e.File, e.Message)
+	case e.Column == 0:
+		return fmt.Sprintf("%v:%d: %v", e.File, e.Line, e.Message)
+	default:
+		return fmt.Sprintf("%v:%d:%d: %v", e.File, e.Line, e.Column, e.Message)
+	}
+}
+
+// Error returns the messages of all errors, one per line.
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
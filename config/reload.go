@@ -0,0 +1,469 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/composite"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+// ErrStopped is returned when reloading a configuration after the reloader has been stopped.
+var ErrStopped = errors.New("reloader stopped")
+
+// Kinds of changes between two configurations.
+const (
+	Added ChangeKind = iota
+	Removed
+	Modified
+)
+
+type (
+	// ChangeKind is the kind of change applied to a route.
+	ChangeKind int
+
+	// Change describes a route that differs between two configurations.
+	Change struct {
+		// Route identifies the route by its methods and path, e.g. "GET,POST /api/search".
+		Route string
+		Kind  ChangeKind
+	}
+
+	// ReloaderBuilder builds a reloader.
+	ReloaderBuilder struct {
+		file     string
+		store    token_bucket.Store
+		interval time.Duration
+		signals  []os.Signal
+		observer common.Observer
+	}
+
+	// state is a loaded configuration, along with the limiters built from it.
+	state struct {
+		cfg  *Config
+		data []byte
+		m    *Middleware
+		// refs is the number of requests being served by the limiters of the state
+		refs    atomic.Int64
+		retired atomic.Bool
+		once    sync.Once
+	}
+
+	// Reloader acts as an HTTP middleware that applies the limiters declared in a configuration file, reloading them
+	// whenever the file changes or the process receives a SIGHUP.
+	// Reloads are atomic: requests are served either by the previous or by the new limiters. The limiters of unchanged
+	// routes are kept as they are, while the limiters of changed routes share the state of their buckets with the
+	// previous ones through the store, so that quota consumed before a reload is not given back. If the new
+	// configuration is invalid, the running one is kept.
+	// Limiters that are not used anymore after a reload are only stopped once the requests they are serving have been
+	// handled.
+	// It needs to be stopped, by invoking the Stop() method during the HTTP server shutdown process, to clean up all
+	// used resources.
+	Reloader struct {
+		file     string
+		store    token_bucket.Store
+		interval time.Duration
+		observer common.Observer
+		signals  chan os.Signal
+		current  atomic.Pointer[state]
+		mux      sync.Mutex
+		// stopped is set once the reloader has been stopped, after which configurations are not applied anymore
+		stopped bool
+		// limiters counts the states using each limiter, so that limiters are stopped once no state uses them anymore
+		limiters    map[composite.Limiter]int
+		limitersMux sync.Mutex
+		stop        chan struct{}
+		done        chan struct{}
+		once        sync.Once
+	}
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	default:
+		return "unknown"
+	}
+}
+
+// id identifies the route by its methods and path.
+func (r *Route) id() string {
+	if len(r.Methods) == 0 {
+		return r.Path
+	}
+
+	methods := append([]string(nil), r.Methods...)
+	sort.Strings(methods)
+
+	return strings.Join(methods, ",") + " " + r.Path
+}
+
+// signature describes everything the limiter of a route depends on: routes with the same signature can share the same
+// limiter.
+func (c *Config) signature(r *Route) string {
+	tiers := make(map[string][]string)
+	for tier := range r.Limits {
+		if t, ok := c.Tiers[tier]; ok {
+			users := append([]string(nil), t.Users...)
+			sort.Strings(users)
+			tiers[tier] = users
+		}
+	}
+
+	// maps are marshaled with sorted keys, so the result is stable
+	data, _ := json.Marshal(struct {
+		Key   Key
+		Tiers map[string][]string
+		Route *Route
+	}{c.Key, tiers, r})
+
+	return string(data)
+}
+
+// Diff returns the routes that have been added, removed or modified in next, compared to prev. Routes are modified if
+// anything their limits depend on has changed, including the way users are identified and the users of their tiers.
+func Diff(prev, next *Config) []Change {
+	routes := make(map[string]*Route)
+	for _, r := range prev.Routes {
+		routes[r.id()] = r
+	}
+
+	var changes []Change
+	for _, r := range next.Routes {
+		id := r.id()
+		old, exists := routes[id]
+		delete(routes, id)
+
+		switch {
+		case !exists:
+			changes = append(changes, Change{Route: id, Kind: Added})
+		case prev.signature(old) != next.signature(r):
+			changes = append(changes, Change{Route: id, Kind: Modified})
+		}
+	}
+
+	for _, id := range sortedKeys(routes) {
+		changes = append(changes, Change{Route: id, Kind: Removed})
+	}
+
+	return changes
+}
+
+// NewReloaderBuilder instantiates a builder of a reloader of the provided configuration file.
+func NewReloaderBuilder(file string) *ReloaderBuilder {
+	return &ReloaderBuilder{
+		file:     file,
+		interval: 5 * time.Second,
+		signals:  []os.Signal{syscall.SIGHUP},
+	}
+}
+
+// SetStore sets the store that keeps the state of all token buckets. By default, buckets are kept in memory.
+func (b *ReloaderBuilder) SetStore(store token_bucket.Store) *ReloaderBuilder {
+	b.store = store
+	return b
+}
+
+// SetPollInterval sets how often the file is checked for changes. By default, it is checked every 5 seconds: if
+// interval is zero, it is only reloaded upon signals.
+func (b *ReloaderBuilder) SetPollInterval(interval time.Duration) *ReloaderBuilder {
+	b.interval = interval
+	return b
+}
+
+// SetSignals sets the signals that trigger a reload. By default, the file is reloaded upon SIGHUP.
+func (b *ReloaderBuilder) SetSignals(signals ...os.Signal) *ReloaderBuilder {
+	b.signals = signals
+	return b
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken on requests matching any
+// route (see Middleware.SetObserver).
+func (b *ReloaderBuilder) SetObserver(observer common.Observer) *ReloaderBuilder {
+	b.observer = observer
+	return b
+}
+
+// Build loads the configuration file and builds its limiters, then starts watching it for changes.
+// It returns an error if the file cannot be loaded, or its configuration is invalid.
+func (b *ReloaderBuilder) Build() (*Reloader, error) {
+	store := b.store
+	if store == nil {
+		store = token_bucket.NewMemoryStore()
+	}
+
+	rl := &Reloader{
+		file:     b.file,
+		store:    store,
+		interval: b.interval,
+		observer: b.observer,
+		signals:  make(chan os.Signal, 1),
+		limiters: make(map[composite.Limiter]int),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if _, err := rl.Reload(); err != nil {
+		return nil, err
+	}
+
+	// signals are registered before returning, so that they cannot terminate the process in the meantime
+	if len(b.signals) > 0 {
+		signal.Notify(rl.signals, b.signals...)
+	}
+
+	go rl.watch()
+
+	return rl, nil
+}
+
+// Config returns the running configuration.
+func (rl *Reloader) Config() *Config {
+	return rl.current.Load().cfg
+}
+
+// Reload reloads the configuration file, swapping the running limiters for the new ones, and returns the changed
+// routes. If the file cannot be loaded or is invalid, the running configuration is kept and an error is returned.
+// It returns ErrStopped if the reloader has been stopped.
+func (rl *Reloader) Reload() ([]Change, error) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	data, err := os.ReadFile(rl.file)
+	if err != nil {
+		return nil, err
+	}
+
+	return rl.apply(data)
+}
+
+// apply applies a new configuration. It must be invoked while holding the lock.
+func (rl *Reloader) apply(data []byte) ([]Change, error) {
+	if rl.stopped {
+		return nil, ErrStopped
+	}
+
+	cfg, err := Parse(rl.file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := rl.current.Load()
+	if prev == nil {
+		m, err := cfg.Build(rl.store)
+		if err != nil {
+			return nil, err
+		}
+
+		rl.swap(&state{cfg: cfg, data: data, m: m})
+		return nil, nil
+	}
+
+	m, err := cfg.build(rl.store, prev.m)
+	if err != nil {
+		return nil, err
+	}
+
+	rl.swap(&state{cfg: cfg, data: data, m: m})
+
+	return Diff(prev.cfg, cfg), nil
+}
+
+// swap makes next the running state, retiring the previous one, if any. It must be invoked while holding the lock.
+func (rl *Reloader) swap(next *state) {
+	next.m.observer = rl.observer
+
+	rl.limitersMux.Lock()
+	for _, rt := range next.m.all {
+		rl.limiters[rt.limiter]++
+	}
+	rl.limitersMux.Unlock()
+
+	if prev := rl.current.Swap(next); prev != nil {
+		rl.retire(prev)
+	}
+}
+
+// acquire returns the running state, which cannot be retired until it is given back using release.
+func (rl *Reloader) acquire() *state {
+	for {
+		s := rl.current.Load()
+		s.refs.Add(1)
+		// the state may have been retired before being acquired
+		if s == rl.current.Load() {
+			return s
+		}
+
+		rl.release(s)
+	}
+}
+
+// release gives back a state acquired by a request, stopping its limiters if it has been retired in the meantime and
+// this was the last request it was serving.
+func (rl *Reloader) release(s *state) {
+	if s.refs.Add(-1) == 0 && s.retired.Load() {
+		rl.drained(s)
+	}
+}
+
+// retire marks a state as not running anymore, stopping its limiters as soon as it is not serving any request.
+func (rl *Reloader) retire(s *state) {
+	s.retired.Store(true)
+	if s.refs.Load() == 0 {
+		rl.drained(s)
+	}
+}
+
+// drained stops the limiters of a retired state that are not used by any other state.
+func (rl *Reloader) drained(s *state) {
+	s.once.Do(func() {
+		rl.limitersMux.Lock()
+		defer rl.limitersMux.Unlock()
+
+		for _, rt := range s.m.all {
+			rl.limiters[rt.limiter]--
+			if rl.limiters[rt.limiter] <= 0 {
+				delete(rl.limiters, rt.limiter)
+				rt.limiter.Stop()
+			}
+		}
+	})
+}
+
+// watch reloads the configuration file whenever it changes or a signal is received, until the reloader is stopped.
+func (rl *Reloader) watch() {
+	defer close(rl.done)
+
+	defer signal.Stop(rl.signals)
+
+	var tick <-chan time.Time
+	if rl.interval > 0 {
+		ticker := time.NewTicker(rl.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// the contents of the last file that failed to load, so that the same errors are only reported once
+	var failed []byte
+
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case <-rl.signals:
+			rl.reload(nil)
+		case <-tick:
+			data, err := os.ReadFile(rl.file)
+			if err != nil {
+				logging.Logger().Warn("cannot read configuration", zap.String("file", rl.file), zap.Error(err))
+				continue
+			}
+
+			if bytes.Equal(data, rl.current.Load().data) || bytes.Equal(data, failed) {
+				continue
+			}
+
+			if rl.reload(data) {
+				failed = nil
+			} else {
+				failed = data
+			}
+		}
+	}
+}
+
+// reload applies the provided configuration, or the contents of the file if nil, logging the outcome.
+func (rl *Reloader) reload(data []byte) bool {
+	log := logging.Logger()
+
+	var (
+		changes []Change
+		err     error
+	)
+
+	if data == nil {
+		changes, err = rl.Reload()
+	} else {
+		rl.mux.Lock()
+		changes, err = rl.apply(data)
+		rl.mux.Unlock()
+	}
+
+	if err != nil {
+		var errs Errors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				log.Error("invalid configuration", zap.String("error", e.Error()))
+			}
+		}
+
+		log.Error("cannot reload configuration, keeping the running one", zap.String("file", rl.file), zap.Error(err))
+		return false
+	}
+
+	log.Info("configuration reloaded", zap.String("file", rl.file), zap.Int("changes", len(changes)))
+	for _, c := range changes {
+		log.Info("route "+c.Kind.String(), zap.String("route", c.Route))
+	}
+
+	return true
+}
+
+// Stop stops watching the configuration file and stops all limiters, once the requests they are serving have been
+// handled. The configuration cannot be reloaded anymore afterwards.
+func (rl *Reloader) Stop() {
+	rl.once.Do(func() {
+		close(rl.stop)
+		<-rl.done
+
+		rl.mux.Lock()
+		defer rl.mux.Unlock()
+		rl.stopped = true
+		rl.retire(rl.current.Load())
+	})
+}
+
+// Take consumes a unit of quota for the request from the running limiters.
+func (rl *Reloader) Take(r *http.Request) common.Decision {
+	s := rl.acquire()
+	defer rl.release(s)
+
+	return s.m.Take(r)
+}
+
+// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d.
+func (rl *Reloader) Refund(r *http.Request, d common.Decision) {
+	s := rl.acquire()
+	defer rl.release(s)
+
+	s.m.Refund(r, d)
+}
+
+// Handle returns an HTTP middleware that applies the running limits to all received requests.
+func (rl *Reloader) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := rl.acquire()
+		defer rl.release(s)
+
+		s.m.serve(w, r, next)
+	})
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadConfig = `version: 1
+tiers:
+  free:
+    users: [alice]
+routes:
+  - path: /a
+    limits:
+      free: {limit: %d, interval: 1h}
+  - path: /b
+    limits:
+      free: {limit: 2, interval: 1h}
+`
+
+func writeConfig(t *testing.T, file string, data string) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(file, []byte(data), 0o600))
+}
+
+func take(rl *Reloader, path string) bool {
+	return rl.Take(request(http.MethodGet, path, "alice")).Allowed()
+}
+
+func TestReloader_PollsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).
+		SetPollInterval(10 * time.Millisecond).
+		SetSignals().
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	assert.True(t, take(rl, "/a"))
+	assert.False(t, take(rl, "/a"))
+	assert.True(t, take(rl, "/b"))
+
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 3))
+	assert.Eventually(t, func() bool {
+		return rl.Config().Routes[0].Limits["free"].Limit == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// the quota consumed before the reload is kept
+	assert.False(t, take(rl, "/a"))
+	assert.True(t, take(rl, "/b"))
+	assert.False(t, take(rl, "/b"))
+}
+
+func TestReloader_KeepsRunningConfigOnErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).SetPollInterval(0).SetSignals().Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	writeConfig(t, file, "version: 2\n")
+	_, err = rl.Reload()
+	assert.Error(t, err)
+
+	assert.Equal(t, 2, len(rl.Config().Routes))
+	assert.True(t, take(rl, "/a"))
+	assert.False(t, take(rl, "/a"))
+}
+
+func TestReloader_ReloadsOnSignal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).
+		SetPollInterval(0).
+		SetSignals(syscall.SIGUSR1).
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 5))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+
+	assert.Eventually(t, func() bool {
+		return rl.Config().Routes[0].Limits["free"].Limit == 5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReloader_Handle(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).SetPollInterval(0).SetSignals().Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	h := rl.Handle(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	assert.Equal(t, http.StatusOK, serve(h, request(http.MethodGet, "/a", "alice")).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(h, request(http.MethodGet, "/a", "alice")).Code)
+
+	writeConfig(t, file, `version: 1
+response:
+  status: 503
+tiers:
+  free:
+    users: [alice]
+routes:
+  - path: /a
+    limits:
+      free: {limit: 1, interval: 1h}
+`)
+	changes, err := rl.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{{Route: "/b", Kind: Removed}}, changes)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(h, request(http.MethodGet, "/a", "alice")).Code)
+	assert.Equal(t, http.StatusOK, serve(h, httptest.NewRequest(http.MethodGet, "/b", nil)).Code)
+}
+
+const leakingConfig = `version: 1
+routes:
+  - path: /a
+    algorithm: leaking_bucket
+    rate: {limit: %d, interval: 1h}
+`
+
+func TestReloader_StopsLimitersOnceRequestsAreHandled(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(leakingConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).SetPollInterval(0).SetSignals().Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	old := rl.Config()
+	limiter := rl.current.Load().m.all[0].limiter
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	h := rl.Handle(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(entered)
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan int)
+	go func() {
+		done <- serve(h, httptest.NewRequest(http.MethodGet, "/a", nil)).Code
+	}()
+	<-entered
+
+	writeConfig(t, file, fmt.Sprintf(leakingConfig, 2))
+	_, err = rl.Reload()
+	assert.NoError(t, err)
+	assert.NotEqual(t, old, rl.Config())
+
+	// the previous limiter is still serving a request: it is not stopped, so its queue is still empty
+	assert.Equal(t, common.Denied, limiter.Take(httptest.NewRequest(http.MethodGet, "/a", nil)).Outcome)
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	assert.Eventually(t, func() bool {
+		rl.limitersMux.Lock()
+		defer rl.limitersMux.Unlock()
+
+		_, used := rl.limiters[limiter]
+		return !used
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReloader_Reload_FailsOnceStopped(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).SetPollInterval(0).SetSignals().Build()
+	assert.NoError(t, err)
+	rl.Stop()
+
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 3))
+	changes, err := rl.Reload()
+	assert.ErrorIs(t, err, ErrStopped)
+	assert.Nil(t, changes)
+	assert.Equal(t, 1, rl.Config().Routes[0].Limits["free"].Limit)
+}
+
+func TestReloader_ServesRequestsWhileReloading(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.yaml")
+	writeConfig(t, file, fmt.Sprintf(reloadConfig, 1))
+
+	rl, err := NewReloaderBuilder(file).SetPollInterval(0).SetSignals().Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	h := rl.Handle(test.ItsOK())
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					code := serve(h, request(http.MethodGet, "/a", "alice")).Code
+					assert.Contains(t, []int{http.StatusOK, http.StatusTooManyRequests}, code)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 20; i++ {
+		writeConfig(t, file, fmt.Sprintf(reloadConfig, i))
+		_, err := rl.Reload()
+		assert.NoError(t, err)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// all limiters but the running ones have been stopped
+	rl.limitersMux.Lock()
+	defer rl.limitersMux.Unlock()
+	assert.Len(t, rl.limiters, 2)
+}
+
+func TestDiff(t *testing.T) {
+	prev, err := Parse("prev.yaml", []byte(`version: 1
+tiers:
+  free:
+    users: [alice]
+  pro:
+    users: [bob]
+routes:
+  - path: /a
+    limits:
+      free: {limit: 1, interval: 1h}
+  - path: /b
+    methods: [POST, GET]
+    limits:
+      pro: {limit: 1, interval: 1h}
+  - path: /c
+    limits:
+      free: {limit: 1, interval: 1h}
+`))
+	assert.NoError(t, err)
+
+	next, err := Parse("next.yaml", []byte(`version: 1
+tiers:
+  free:
+    users: [alice]
+  pro:
+    users: [bob, carol]
+routes:
+  - path: /a
+    limits:
+      free: {limit: 1, interval: 1h}
+  - path: /b
+    methods: [GET, POST]
+    limits:
+      pro: {limit: 1, interval: 1h}
+  - path: /d
+    limits:
+      free: {limit: 1, interval: 1h}
+`))
+	assert.NoError(t, err)
+
+	assert.Equal(
+		t,
+		[]Change{
+			{Route: "GET,POST /b", Kind: Modified},
+			{Route: "/d", Kind: Added},
+			{Route: "/c", Kind: Removed},
+		},
+		Diff(prev, next),
+	)
+}
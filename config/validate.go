@@ -0,0 +1,224 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+type validator struct {
+	file string
+	errs Errors
+}
+
+func (v *validator) add(pos Position, format string, args ...any) {
+	v.errs = append(v.errs, Error{File: v.file, Position: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) unknown(nd node) {
+	for _, e := range nd.unknown {
+		e.File = v.file
+		v.errs = append(v.errs, e)
+	}
+}
+
+// sortedKeys returns the keys of m in a stable order, so that errors are always reported in the same order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Validate returns all the errors found in the configuration as Errors, or nil if there are none.
+func (c *Config) Validate() error {
+	v := &validator{file: c.file}
+	v.unknown(c.node)
+
+	if c.Version != 1 {
+		v.add(c.pos, "unsupported version %d, expected 1", c.Version)
+	}
+
+	v.key(c.Key)
+	v.response(c.Response)
+
+	tiers := make(map[string]string)
+	for _, name := range sortedKeys(c.Tiers) {
+		t := c.Tiers[name]
+		if t == nil {
+			v.add(c.pos, "tier %q: missing users", name)
+			continue
+		}
+
+		v.unknown(t.node)
+		if len(t.Users) == 0 {
+			v.add(t.pos, "tier %q: missing users", name)
+		}
+
+		for _, u := range t.Users {
+			if u == "" {
+				v.add(t.pos, "tier %q: empty user", name)
+			} else if other, exists := tiers[u]; exists {
+				v.add(t.pos, "user %q belongs to tiers %q and %q", u, other, name)
+			} else {
+				tiers[u] = name
+			}
+		}
+	}
+
+	if len(c.Routes) == 0 {
+		v.add(c.pos, "no route configured")
+	}
+
+	for i, r := range c.Routes {
+		if r == nil {
+			v.add(c.pos, "routes[%d]: empty route", i)
+			continue
+		}
+
+		v.route(c, i, r)
+
+		for _, other := range c.Routes[:i] {
+			if other != nil && other.Path == r.Path && overlap(other.Methods, r.Methods) {
+				v.add(r.pos, "routes[%d]: %v overlaps with the route at line %d", i, r.Path, other.pos.Line)
+				break
+			}
+		}
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+
+	return nil
+}
+
+// overlap returns true if both lists contain the same method. An empty list contains all methods.
+func overlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+
+	for _, m := range a {
+		for _, n := range b {
+			if m == n {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (v *validator) key(k Key) {
+	v.unknown(k.node)
+
+	set := 0
+	for _, ok := range []bool{k.Header != "", k.Query != "", k.IP} {
+		if ok {
+			set++
+		}
+	}
+
+	if set > 1 {
+		v.add(k.pos, "key: only one of header, query and ip can be set")
+	}
+}
+
+func (v *validator) response(r Response) {
+	v.unknown(r.node)
+
+	if r.Status != 0 && (r.Status < 400 || r.Status > 599) {
+		v.add(r.pos, "response: status %d is not an error status", r.Status)
+	}
+}
+
+func (v *validator) route(c *Config, i int, r *Route) {
+	v.unknown(r.node)
+
+	if !strings.HasPrefix(r.Path, "/") {
+		v.add(r.pos, "routes[%d]: path %q must start with '/'", i, r.Path)
+	}
+
+	for _, m := range r.Methods {
+		if !methods[m] {
+			v.add(r.pos, "routes[%d]: unknown method %q", i, m)
+		}
+	}
+
+	switch r.Algorithm {
+	case "", TokenBucket:
+		if len(r.Limits) == 0 {
+			v.add(r.pos, "routes[%d]: missing limits", i)
+		}
+
+		for _, tier := range sortedKeys(r.Limits) {
+			if _, exists := c.Tiers[tier]; !exists {
+				v.add(r.pos, "routes[%d]: unknown tier %q", i, tier)
+			}
+
+			v.limit(fmt.Sprintf("routes[%d].limits.%v", i, tier), r.pos, r.Limits[tier])
+		}
+
+		if r.Global != nil {
+			v.limit(fmt.Sprintf("routes[%d].global", i), r.pos, r.Global)
+		}
+
+		if r.Rate != nil {
+			v.add(r.Rate.pos, "routes[%d]: rate is only supported by %v", i, LeakingBucket)
+		}
+	case LeakingBucket:
+		if r.Rate == nil {
+			v.add(r.pos, "routes[%d]: missing rate", i)
+		} else {
+			v.limit(fmt.Sprintf("routes[%d].rate", i), r.pos, r.Rate)
+
+			if r.Rate.Refill != 0 {
+				v.add(r.Rate.pos, "routes[%d].rate: refill is only supported by %v", i, TokenBucket)
+			}
+		}
+
+		if len(r.Limits) > 0 || r.Global != nil {
+			v.add(r.pos, "routes[%d]: limits and global are only supported by %v", i, TokenBucket)
+		}
+	default:
+		v.add(r.pos, "routes[%d]: unknown algorithm %q", i, r.Algorithm)
+	}
+}
+
+func (v *validator) limit(name string, parent Position, l *Limit) {
+	if l == nil {
+		v.add(parent, "%v: missing limit", name)
+		return
+	}
+
+	v.unknown(l.node)
+
+	if l.Limit <= 0 {
+		v.add(l.pos, "%v: limit must be positive", name)
+	}
+
+	if l.Refill < 0 {
+		v.add(l.pos, "%v: refill must not be negative", name)
+	}
+
+	if l.Interval <= 0 {
+		v.add(l.pos, "%v: interval must be positive", name)
+	}
+}
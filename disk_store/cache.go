@@ -0,0 +1,77 @@
+package disk_store
+
+import (
+	"container/list"
+
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+type (
+	entry struct {
+		key    string
+		bucket token_bucket.Bucket
+		// seq is the sequence number of the transaction that wrote the bucket
+		seq uint64
+	}
+
+	// cache is a least-recently-used cache of buckets, which keeps the most recent version of each bucket, according
+	// to the sequence number of the transaction that wrote it. It is not safe for concurrent use.
+	cache struct {
+		size    int
+		entries map[string]*list.Element
+		order   *list.List
+		// evicted is the highest sequence number of all evicted entries: buckets written before it may be older than
+		// an evicted version of themselves, and are therefore not cached
+		evicted uint64
+	}
+)
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *cache) get(key string) (token_bucket.Bucket, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return token_bucket.Bucket{}, false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(*entry).bucket, true
+}
+
+// put caches the bucket written by the transaction with sequence number seq, unless a more recent version of it may
+// have been cached already.
+func (c *cache) put(key string, b token_bucket.Bucket, seq uint64) {
+	if c.size <= 0 {
+		return
+	}
+
+	if e, ok := c.entries[key]; ok {
+		if en := e.Value.(*entry); seq > en.seq {
+			en.bucket = b
+			en.seq = seq
+		}
+		c.order.MoveToFront(e)
+		return
+	}
+
+	if seq <= c.evicted {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, bucket: b, seq: seq})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+
+		en := oldest.Value.(*entry)
+		delete(c.entries, en.key)
+		c.evicted = max(c.evicted, en.seq)
+	}
+}
@@ -0,0 +1,392 @@
+package disk_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var bucketsName = []byte("buckets")
+
+type (
+	// Options configures a store.
+	Options struct {
+		// CacheSize is the maximum number of buckets cached in memory.
+		CacheSize int
+		// BatchDelay is the maximum time an update waits for concurrent ones, to be written to disk in the same
+		// transaction. Defaults to 1ms.
+		BatchDelay time.Duration
+		// CompactInterval is how often the store checks whether its file needs to be compacted. Defaults to 1 minute:
+		// if negative, the file is only compacted when invoking Compact().
+		CompactInterval time.Duration
+		// CompactRatio is the fraction of the file that needs to be unused (e.g. after many buckets have been
+		// deleted) before it is compacted. Defaults to 0.5.
+		CompactRatio float64
+		// CompactMinSize is the size, in bytes, below which the file is never compacted. Defaults to 16 MiB.
+		CompactMinSize int64
+	}
+
+	// Store is a token_bucket.Store that keeps buckets on disk, in an embedded key-value store (bbolt), so that the
+	// number of buckets is not bounded by the available memory: only a bounded cache of the most recently updated
+	// buckets is kept in memory.
+	// Every update is synced to disk before returning. Concurrent updates are batched into the same transaction, so
+	// that they share the cost of syncing, at the price of some additional latency (see Options.BatchDelay).
+	// Full buckets are deleted, since a missing bucket is considered full: the file therefore only grows with the
+	// number of buckets in use, and is compacted in the background once most of it is unused.
+	// It needs to be closed, using its Close() method, to release the underlying file.
+	Store struct {
+		path     string
+		opts     Options
+		db       *bolt.DB
+		pageSize int
+		mux      sync.RWMutex
+		cacheMux sync.Mutex
+		cache    *cache
+		// seq is the sequence number of the last write transaction: it is only accessed within write transactions,
+		// which are serialized
+		seq  uint64
+		now  func() time.Time
+		stop chan struct{}
+		done chan struct{}
+	}
+)
+
+// Open opens the store kept in the file at path, creating it if needed.
+func Open(path string, opts Options) (*Store, error) {
+	if opts.BatchDelay <= 0 {
+		opts.BatchDelay = time.Millisecond
+	}
+
+	if opts.CompactInterval == 0 {
+		opts.CompactInterval = time.Minute
+	}
+
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = 0.5
+	}
+
+	if opts.CompactMinSize <= 0 {
+		opts.CompactMinSize = 16 << 20
+	}
+
+	db, err := openDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketsName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		path: path,
+		opts: opts,
+		db:   db,
+		// the page size is read once, since reading it concurrently with updates is not safe
+		pageSize: db.Info().PageSize,
+		cache:    newCache(opts.CacheSize),
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if opts.CompactInterval > 0 {
+		go s.compactPeriodically()
+	} else {
+		close(s.done)
+	}
+
+	return s, nil
+}
+
+func openDB(path string, opts Options) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	db.MaxBatchDelay = opts.BatchDelay
+
+	return db, nil
+}
+
+// Close stops compacting the store and closes it, releasing the underlying file.
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.db.Close()
+}
+
+// Size returns the current size of the file, in bytes.
+func (s *Store) Size() int64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var size int64
+	s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+
+	return size
+}
+
+func encodeKey(key token_bucket.Key) string {
+	// the path length makes the key unambiguous, even if the path contains the separator
+	return fmt.Sprintf("%d:%s:%s", len(key.Path), key.Path, key.UserID)
+}
+
+func (s *Store) cached(f func(c *cache)) {
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+
+	f(s.cache)
+}
+
+func (s *Store) update(key token_bucket.Key, cfg token_bucket.Config, f func(b token_bucket.Bucket) token_bucket.Bucket) (token_bucket.Bucket, error) {
+	k := encodeKey(key)
+	if len(k) > bolt.MaxKeySize {
+		return token_bucket.Bucket{}, fmt.Errorf("key too long: %v bytes", len(k))
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var (
+		b   token_bucket.Bucket
+		seq uint64
+	)
+	// the function may be invoked more than once, if the batch it belongs to fails: it must only depend on the
+	// transaction
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		buckets := tx.Bucket(bucketsName)
+		now := s.now()
+		s.seq++
+		seq = s.seq
+
+		b = token_bucket.NewBucket(cfg, now)
+		if v := buckets.Get([]byte(k)); v != nil {
+			var err error
+			if b, err = decode(v); err != nil {
+				return err
+			}
+		}
+
+		b = f(b.Refilled(cfg, now))
+
+		var err error
+		if b.Tokens >= cfg.Limit.Value {
+			err = buckets.Delete([]byte(k))
+		} else {
+			err = buckets.Put([]byte(k), encode(b))
+		}
+		return err
+	})
+
+	if err != nil {
+		return token_bucket.Bucket{}, err
+	}
+
+	// buckets are only cached once their transaction has been committed, so that readers never see updates that may
+	// still be rolled back. Concurrent updates may be cached in a different order than they were committed: the
+	// sequence number keeps the most recent one.
+	s.cached(func(c *cache) { c.put(k, b, seq) })
+
+	return b, nil
+}
+
+// Take refills the bucket identified by key according to cfg, then consumes n tokens from it if available.
+func (s *Store) Take(_ context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, bool, error) {
+	var taken bool
+	b, err := s.update(key, cfg, func(b token_bucket.Bucket) token_bucket.Bucket {
+		taken = false
+		if b.Tokens >= n {
+			b.Tokens -= n
+			taken = true
+		}
+
+		return b
+	})
+
+	return b, taken, err
+}
+
+// Refill adds n tokens to the bucket identified by key, without exceeding its limit.
+func (s *Store) Refill(_ context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	return s.update(key, cfg, func(b token_bucket.Bucket) token_bucket.Bucket {
+		b.Tokens += n
+		if b.Tokens > cfg.Limit.Value {
+			b.Tokens = cfg.Limit.Value
+		}
+
+		return b
+	})
+}
+
+// Set refills the bucket identified by key according to cfg, then sets its number of tokens to n.
+func (s *Store) Set(_ context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	return s.update(key, cfg, func(b token_bucket.Bucket) token_bucket.Bucket {
+		b.Tokens = n
+		return b
+	})
+}
+
+// Get returns the current state of the bucket identified by key, refilled according to cfg.
+func (s *Store) Get(_ context.Context, key token_bucket.Key, cfg token_bucket.Config) (token_bucket.Bucket, error) {
+	k := encodeKey(key)
+	now := s.now()
+
+	var (
+		b      token_bucket.Bucket
+		exists bool
+	)
+	s.cached(func(c *cache) { b, exists = c.get(k) })
+	if exists {
+		return b.Refilled(cfg, now), nil
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketsName).Get([]byte(k))
+		if v == nil {
+			return nil
+		}
+
+		var err error
+		b, err = decode(v)
+		exists = err == nil
+		return err
+	})
+	if err != nil {
+		return token_bucket.Bucket{}, err
+	}
+
+	if !exists {
+		return token_bucket.NewBucket(cfg, now), nil
+	}
+
+	return b.Refilled(cfg, now), nil
+}
+
+// Reset fills up the bucket identified by key.
+func (s *Store) Reset(_ context.Context, key token_bucket.Key, cfg token_bucket.Config) error {
+	_, err := s.update(key, cfg, func(_ token_bucket.Bucket) token_bucket.Bucket {
+		return token_bucket.NewBucket(cfg, s.now())
+	})
+
+	return err
+}
+
+// unused returns the fraction of the file that is not used by any bucket.
+func (s *Store) unused() (float64, int64) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var size int64
+	s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+
+	if size == 0 {
+		return 0, 0
+	}
+
+	stats := s.db.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(s.pageSize)
+
+	return float64(free) / float64(size), size
+}
+
+// compactPeriodically compacts the file whenever most of it is unused, until the store is closed.
+func (s *Store) compactPeriodically() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ratio, size := s.unused()
+			if size < s.opts.CompactMinSize || ratio < s.opts.CompactRatio {
+				continue
+			}
+
+			if err := s.Compact(); err != nil {
+				logging.Logger().Error("cannot compact store", zap.String("path", s.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Compact rewrites the file so that it only takes the space needed by the current buckets. Updates are blocked while
+// compacting. If compaction fails, the store keeps using the current file.
+func (s *Store) Compact() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// the compacted file is written next to the current one, so that it can be atomically renamed
+	tmp := s.path + ".compact"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	dst, err := openDB(tmp, s.opts)
+	if err != nil {
+		return err
+	}
+
+	abort := func(err error) error {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := bolt.Compact(dst, s.db, 0); err != nil {
+		return abort(err)
+	}
+
+	// the compacted file is already open, so the store can switch to it as soon as it has been renamed, without
+	// reopening anything
+	if err := os.Rename(tmp, s.path); err != nil {
+		return abort(err)
+	}
+
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		if err := dir.Sync(); err != nil {
+			logging.Logger().Warn("cannot sync directory", zap.String("path", s.path), zap.Error(err))
+		}
+		dir.Close()
+	}
+
+	if err := s.db.Close(); err != nil {
+		logging.Logger().Warn("cannot close compacted file", zap.String("path", s.path), zap.Error(err))
+	}
+	s.db = dst
+	s.pageSize = dst.Info().PageSize
+
+	return nil
+}
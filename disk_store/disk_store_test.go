@@ -0,0 +1,269 @@
+package disk_store
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	route  = "/bar"
+	userID = "0-0-0-0-0"
+)
+
+var (
+	key = token_bucket.Key{UserID: userID, Path: route}
+	cfg = token_bucket.Config{
+		Limit:  common.Rate{Value: 3, Interval: time.Minute},
+		Refill: common.Rate{Value: 1, Interval: time.Minute},
+	}
+)
+
+func open(t *testing.T, path string, cacheSize int, now *time.Time) *Store {
+	s, err := Open(path, Options{CacheSize: cacheSize, CompactInterval: -1})
+	assert.NoError(t, err)
+	s.now = func() time.Time { return *now }
+
+	return s
+}
+
+func TestStore_Take(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := open(t, filepath.Join(t.TempDir(), "buckets.db"), 10, &now)
+	defer s.Close()
+	ctx := context.Background()
+
+	b, taken, err := s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, 1, b.Tokens)
+
+	_, taken, err = s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.False(t, taken)
+
+	now = now.Add(time.Minute)
+	b, taken, err = s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, 0, b.Tokens)
+}
+
+func TestStore_RefillGetAndReset(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := open(t, filepath.Join(t.TempDir(), "buckets.db"), 10, &now)
+	defer s.Close()
+	ctx := context.Background()
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Tokens)
+
+	_, _, _ = s.Take(ctx, key, cfg, 3)
+	b, err = s.Refill(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+
+	assert.NoError(t, s.Reset(ctx, key, cfg))
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Tokens)
+
+	b, err = s.Set(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+}
+
+func TestStore_ReadsEvictedBucketsFromDisk(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := open(t, filepath.Join(t.TempDir(), "buckets.db"), 1, &now)
+	defer s.Close()
+	ctx := context.Background()
+	other := token_bucket.Key{UserID: "1-1-1-1-1", Path: route}
+
+	_, _, _ = s.Take(ctx, key, cfg, 1)
+	_, _, _ = s.Take(ctx, other, cfg, 2)
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+
+	b, err = s.Get(ctx, other, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+}
+
+func TestCache_KeepsMostRecentVersion(t *testing.T) {
+	c := newCache(1)
+
+	c.put("a", token_bucket.Bucket{Tokens: 2}, 2)
+	c.put("a", token_bucket.Bucket{Tokens: 1}, 1)
+	b, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, b.Tokens)
+
+	// "a" is evicted, so an older version of it must not be cached again
+	c.put("b", token_bucket.Bucket{Tokens: 3}, 3)
+	c.put("a", token_bucket.Bucket{Tokens: 1}, 1)
+	_, ok = c.get("a")
+	assert.False(t, ok)
+}
+
+func TestStore_PersistsBucketsAcrossRestarts(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "buckets.db")
+	ctx := context.Background()
+
+	s := open(t, path, 10, &now)
+	_, _, _ = s.Take(ctx, key, cfg, 1)
+	_, _, _ = s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, s.Close())
+
+	s = open(t, path, 10, &now)
+	defer s.Close()
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+	assert.True(t, now.Equal(b.LastRefill))
+}
+
+// fill creates n half-empty buckets, then fills them up again, leaving most of the file unused.
+func fill(t *testing.T, s *Store, n int) {
+	ctx := context.Background()
+
+	for _, f := range []func(k token_bucket.Key) error{
+		func(k token_bucket.Key) error {
+			_, _, err := s.Take(ctx, k, cfg, 1)
+			return err
+		},
+		func(k token_bucket.Key) error {
+			_, err := s.Refill(ctx, k, cfg, 1)
+			return err
+		},
+	} {
+		// updates are issued concurrently, so that they are batched together
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, f(token_bucket.Key{UserID: token_bucket.UserID(fmt.Sprintf("user-%d", i)), Path: route}))
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestStore_DeletesFullBuckets(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := open(t, filepath.Join(t.TempDir(), "buckets.db"), 0, &now)
+	defer s.Close()
+	ctx := context.Background()
+
+	_, _, _ = s.Take(ctx, key, cfg, 1)
+	_, _ = s.Refill(ctx, key, cfg, 1)
+
+	assert.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 0, tx.Bucket(bucketsName).Stats().KeyN)
+		return nil
+	}))
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Tokens)
+}
+
+func TestStore_Compact(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "buckets.db")
+	s := open(t, path, 10, &now)
+	ctx := context.Background()
+
+	_, _, _ = s.Take(ctx, key, cfg, 3)
+	fill(t, s, 5000)
+	size := s.Size()
+
+	assert.NoError(t, s.Compact())
+	assert.Less(t, s.Size(), size)
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Tokens)
+
+	b, _, err = s.Take(ctx, token_bucket.Key{UserID: "other", Path: route}, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+
+	// the compacted file is the one reopened after a restart
+	assert.NoError(t, s.Close())
+	s = open(t, path, 10, &now)
+	defer s.Close()
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Tokens)
+}
+
+func TestStore_CompactFailureKeepsCurrentFile(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	s := open(t, filepath.Join(dir, "buckets.db"), 10, &now)
+	defer s.Close()
+	ctx := context.Background()
+
+	_, _, _ = s.Take(ctx, key, cfg, 2)
+
+	// the compacted file cannot be created
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "buckets.db.compact"), 0o700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "buckets.db.compact", "file"), nil, 0o600))
+	assert.Error(t, s.Compact())
+
+	b, _, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Tokens)
+}
+
+func TestStore_CompactsAutomatically(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "buckets.db"), Options{
+		CompactInterval: 10 * time.Millisecond,
+		CompactMinSize:  1,
+	})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	fill(t, s, 5000)
+
+	// all buckets are full, hence deleted: once compacted, the file only contains a few pages
+	assert.Eventually(t, func() bool {
+		return s.Size() < 64<<10
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStore_WorksAsRateLimiterStore(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "buckets.db"), Options{CacheSize: 10})
+	assert.NoError(t, err)
+	defer s.Close()
+	rl, err := token_bucket.NewRateLimiterBuilder().SetLimit(route, cfg).RegisterUser(userID).SetStore(s).Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	for i := 0; i < cfg.Limit.Value; i++ {
+		assert.True(t, rl.Take(req).Allowed())
+	}
+	assert.Equal(t, common.Denied, rl.Take(req).Outcome)
+}
@@ -0,0 +1,35 @@
+package disk_store
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+// Buckets are stored as follows, all integers being big-endian:
+//
+//	tokens (8 bytes) | last refill, in Unix nanoseconds (8 bytes)
+const recordSize = 16
+
+var errCorrupted = errors.New("corrupted record")
+
+func encode(b token_bucket.Bucket) []byte {
+	buf := make([]byte, recordSize)
+	binary.BigEndian.PutUint64(buf, uint64(b.Tokens))
+	binary.BigEndian.PutUint64(buf[8:], uint64(b.LastRefill.UnixNano()))
+
+	return buf
+}
+
+func decode(buf []byte) (token_bucket.Bucket, error) {
+	if len(buf) != recordSize {
+		return token_bucket.Bucket{}, errCorrupted
+	}
+
+	return token_bucket.Bucket{
+		Tokens:     int(int64(binary.BigEndian.Uint64(buf))),
+		LastRefill: time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:]))),
+	}, nil
+}
@@ -0,0 +1,146 @@
+package envoy_rls
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/service"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Server implements the Envoy rate limit service (`envoy.service.ratelimit.v3`) on top of a service.Service: each
+// descriptor sent by Envoy is evaluated against the rules of the requested domain, and the request is over limit if
+// any of its descriptors is.
+// Per-descriptor limit overrides are ignored: limits are always those of the matching rules.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	svc *service.Service
+}
+
+// NewServer returns a new server that makes decisions using svc.
+func NewServer(svc *service.Service) *Server {
+	return &Server{svc: svc}
+}
+
+// Register registers the server on a gRPC server.
+func (s *Server) Register(g *grpc.Server) {
+	rlsv3.RegisterRateLimitServiceServer(g, s)
+}
+
+// ShouldRateLimit evaluates all the descriptors of the request, returning the status of each one, in the same order.
+// It also returns the `X-RateLimit-*` headers of the most restrictive descriptor, for Envoy to add to the response.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing domain")
+	}
+
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing descriptors")
+	}
+
+	res := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+
+	var restrictive *common.Decision
+	for _, desc := range req.GetDescriptors() {
+		d := make(service.Descriptor, len(desc.GetEntries()))
+		for i, e := range desc.GetEntries() {
+			d[i] = service.Entry{Key: e.GetKey(), Value: e.GetValue()}
+		}
+
+		hits := int(req.GetHitsAddend())
+		if desc.GetHitsAddend() != nil {
+			hits = int(desc.GetHitsAddend().GetValue())
+		}
+		if hits == 0 {
+			hits = 1
+		}
+
+		decision, err := s.svc.Take(ctx, req.GetDomain(), d, hits)
+		if err != nil {
+			logging.Logger().Error("cannot evaluate descriptor", zap.String("domain", req.GetDomain()), zap.Error(err))
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+
+		st := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+		if decision.Outcome != common.Unknown {
+			rule, _ := s.svc.Rule(req.GetDomain(), d)
+			st.CurrentLimit = &rlsv3.RateLimitResponse_RateLimit{
+				RequestsPerUnit: uint32(rule.Limit),
+				Unit:            unit(time.Duration(rule.Interval)),
+			}
+			st.LimitRemaining = uint32(decision.Remaining)
+
+			if !decision.Allowed() {
+				st.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+				st.DurationUntilReset = durationpb.New(decision.RetryAfter)
+				res.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			}
+
+			if restrictive == nil || moreRestrictive(decision, *restrictive) {
+				restrictive = &decision
+			}
+		}
+
+		res.Statuses = append(res.Statuses, st)
+	}
+
+	if restrictive != nil {
+		res.ResponseHeadersToAdd = headers(*restrictive)
+	}
+
+	return res, nil
+}
+
+// moreRestrictive returns true if a is more restrictive than b: denials win over approvals, then the lowest remaining
+// quota wins.
+func moreRestrictive(a, b common.Decision) bool {
+	if a.Allowed() != b.Allowed() {
+		return !a.Allowed()
+	}
+
+	return a.Remaining < b.Remaining
+}
+
+func headers(d common.Decision) []*corev3.HeaderValue {
+	h := []*corev3.HeaderValue{
+		{Key: "X-Ratelimit-Limit", Value: strconv.Itoa(d.Limit)},
+		{Key: "X-Ratelimit-Remaining", Value: strconv.Itoa(d.Remaining)},
+	}
+
+	if !d.Allowed() {
+		h = append(h, &corev3.HeaderValue{
+			Key:   "X-Ratelimit-Retry-After",
+			Value: strconv.Itoa(int(d.RetryAfter.Seconds())),
+		})
+	}
+
+	return h
+}
+
+// unit returns the unit matching interval, or UNKNOWN if there is none.
+func unit(interval time.Duration) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch interval {
+	case time.Second:
+		return rlsv3.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return rlsv3.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	case 7 * 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_WEEK
+	default:
+		return rlsv3.RateLimitResponse_RateLimit_UNKNOWN
+	}
+}
@@ -0,0 +1,167 @@
+package envoy_rls
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/fedragon/rate-limiter/service"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const configJSON = `{
+  "domains": [
+    {
+      "name": "edge",
+      "rules": [
+        {"descriptor": [{"key": "remote_address"}], "limit": 2, "interval": "1m"},
+        {"descriptor": [{"key": "path", "value": "/login"}], "limit": 5, "interval": "1h"}
+      ]
+    }
+  ]
+}`
+
+func newClient(t *testing.T) rlsv3.RateLimitServiceClient {
+	cfg, err := service.LoadConfig(strings.NewReader(configJSON))
+	assert.NoError(t, err)
+
+	svc, err := service.New(cfg, token_bucket.NewMemoryStore())
+	assert.NoError(t, err)
+
+	lis := bufconn.Listen(1024 * 1024)
+	g := grpc.NewServer()
+	NewServer(svc).Register(g)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(entries ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+
+	return d
+}
+
+func responseHeaders(res *rlsv3.RateLimitResponse) map[string]string {
+	h := make(map[string]string)
+	for _, v := range res.GetResponseHeadersToAdd() {
+		h[v.GetKey()] = v.GetValue()
+	}
+
+	return h
+}
+
+func TestServer_ShouldRateLimit(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+	req := &rlsv3.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			descriptor("remote_address", "10.0.0.1"),
+			descriptor("path", "/login"),
+			descriptor("unknown", "x"),
+		},
+	}
+
+	res, err := client.ShouldRateLimit(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, res.GetOverallCode())
+	assert.Len(t, res.GetStatuses(), 3)
+
+	st := res.GetStatuses()[0]
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, st.GetCode())
+	assert.Equal(t, uint32(2), st.GetCurrentLimit().GetRequestsPerUnit())
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_MINUTE, st.GetCurrentLimit().GetUnit())
+	assert.Equal(t, uint32(1), st.GetLimitRemaining())
+
+	st = res.GetStatuses()[1]
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_HOUR, st.GetCurrentLimit().GetUnit())
+	assert.Equal(t, uint32(4), st.GetLimitRemaining())
+
+	// descriptors without a matching rule are not limited
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, res.GetStatuses()[2].GetCode())
+	assert.Nil(t, res.GetStatuses()[2].GetCurrentLimit())
+
+	assert.Equal(t, map[string]string{"X-Ratelimit-Limit": "2", "X-Ratelimit-Remaining": "1"}, responseHeaders(res))
+
+	_, err = client.ShouldRateLimit(ctx, req)
+	assert.NoError(t, err)
+
+	res, err = client.ShouldRateLimit(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, res.GetOverallCode())
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, res.GetStatuses()[0].GetCode())
+	assert.InDelta(t, time.Minute, res.GetStatuses()[0].GetDurationUntilReset().AsDuration(), float64(time.Second))
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, res.GetStatuses()[1].GetCode())
+	assert.Equal(t, "0", responseHeaders(res)["X-Ratelimit-Remaining"])
+	assert.Contains(t, responseHeaders(res), "X-Ratelimit-Retry-After")
+}
+
+func TestServer_HitsAddend(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+
+	res, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("path", "/login")},
+		HitsAddend:  3,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), res.GetStatuses()[0].GetLimitRemaining())
+
+	// the descriptor addend overrides the request one
+	d := descriptor("path", "/login")
+	d.HitsAddend = wrapperspb.UInt64(2)
+	res, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{d},
+		HitsAddend:  3,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, res.GetOverallCode())
+	assert.Equal(t, uint32(0), res.GetStatuses()[0].GetLimitRemaining())
+}
+
+func TestServer_InvalidRequest(t *testing.T) {
+	client := newClient(t)
+
+	_, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{Domain: "edge"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("path", "/")},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUnit(t *testing.T) {
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_SECOND, unit(time.Second))
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_DAY, unit(24*time.Hour))
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_UNKNOWN, unit(90*time.Second))
+}
@@ -0,0 +1,67 @@
+package gossip
+
+// NodeID identifies a node participating in gossip.
+type NodeID string
+
+// PNCounter is a conflict-free replicated counter that can be both incremented and decremented: each node only updates
+// its own entries, so that replicas can be merged in any order, any number of times, and still converge to the same
+// value.
+type PNCounter struct {
+	P map[NodeID]uint64 `json:"p"`
+	N map[NodeID]uint64 `json:"n"`
+}
+
+// NewPNCounter returns a new counter, whose value is zero.
+func NewPNCounter() *PNCounter {
+	return &PNCounter{
+		P: make(map[NodeID]uint64),
+		N: make(map[NodeID]uint64),
+	}
+}
+
+// Increment adds n to the entry of node.
+func (c *PNCounter) Increment(node NodeID, n uint64) {
+	c.P[node] += n
+}
+
+// Decrement subtracts n from the entry of node.
+func (c *PNCounter) Decrement(node NodeID, n uint64) {
+	c.N[node] += n
+}
+
+// Value returns the current value of the counter, across all nodes.
+func (c *PNCounter) Value() int64 {
+	var v int64
+	for _, p := range c.P {
+		v += int64(p)
+	}
+
+	for _, n := range c.N {
+		v -= int64(n)
+	}
+
+	return v
+}
+
+// Merge merges other into this counter, keeping the highest value of each entry.
+func (c *PNCounter) Merge(other *PNCounter) {
+	for node, p := range other.P {
+		if p > c.P[node] {
+			c.P[node] = p
+		}
+	}
+
+	for node, n := range other.N {
+		if n > c.N[node] {
+			c.N[node] = n
+		}
+	}
+}
+
+// Clone returns a copy of this counter.
+func (c *PNCounter) Clone() *PNCounter {
+	clone := NewPNCounter()
+	clone.Merge(c)
+
+	return clone
+}
@@ -0,0 +1,47 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPNCounter_Value(t *testing.T) {
+	c := NewPNCounter()
+	c.Increment("a", 3)
+	c.Increment("b", 2)
+	c.Decrement("a", 1)
+
+	assert.Equal(t, int64(4), c.Value())
+}
+
+func TestPNCounter_Merge(t *testing.T) {
+	a := NewPNCounter()
+	a.Increment("a", 3)
+	a.Decrement("a", 1)
+
+	b := NewPNCounter()
+	b.Increment("b", 2)
+
+	ab := a.Clone()
+	ab.Merge(b)
+
+	ba := b.Clone()
+	ba.Merge(a)
+
+	// commutative
+	assert.Equal(t, ab, ba)
+	assert.Equal(t, int64(4), ab.Value())
+
+	// idempotent
+	ab.Merge(a)
+	ab.Merge(b)
+	assert.Equal(t, ba, ab)
+
+	// stale replicas do not move the counter backwards
+	a.Increment("a", 5)
+	stale := a.Clone()
+	a.Increment("a", 1)
+	a.Merge(stale)
+	assert.Equal(t, int64(8), a.Value())
+}
@@ -0,0 +1,414 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/fedragon/rate-limiter/tracing"
+
+	"go.uber.org/zap"
+)
+
+type (
+	key struct {
+		userID token_bucket.UserID
+		path   token_bucket.Path
+	}
+
+	// RateLimiterBuilder builds a gossip rate limiter.
+	RateLimiterBuilder struct {
+		self      NodeID
+		transport Transport
+		peers     []NodeID
+		interval  time.Duration
+		paths     *concurrent.Map[token_bucket.Path, common.Rate]
+		users     *concurrent.Set[token_bucket.UserID]
+		extractor token_bucket.UserExtractor
+		observer  common.Observer
+	}
+
+	// RateLimiter acts as an HTTP middleware that rate-limits traffic according to the `sliding window` algorithm, which
+	// means that users can only issue a given number of requests (configurable by endpoint) in any window of time: the
+	// number of requests issued in the current window is estimated as the sum of the requests counted in the current
+	// fixed window and of those counted in the previous one, weighted by how much the two overlap.
+	// Counters are replicated across nodes as PNCounters, which each node periodically gossips to its peers: each node
+	// therefore estimates the global rate locally, without any coordination, and converges with its peers once they
+	// can reach each other. Limits can be exceeded by up to what the other nodes allowed since the last gossip round.
+	// It needs to be stopped, by invoking the Stop() method during the HTTP server shutdown process, to stop gossiping.
+	RateLimiter struct {
+		self      NodeID
+		transport Transport
+		peers     []NodeID
+		interval  time.Duration
+		paths     *concurrent.Map[token_bucket.Path, common.Rate]
+		users     *concurrent.Set[token_bucket.UserID]
+		extractor token_bucket.UserExtractor
+		observer  common.Observer
+		mux       sync.Mutex
+		counters  map[key]map[int64]*PNCounter
+		ctx       context.Context
+		cancel    context.CancelFunc
+		now       func() time.Time
+	}
+)
+
+// NewRateLimiterBuilder instantiates a gossip rate limiter builder for the node identified by self, which gossips with
+// its peers using the provided transport.
+func NewRateLimiterBuilder(self NodeID, transport Transport) *RateLimiterBuilder {
+	return &RateLimiterBuilder{
+		self:      self,
+		transport: transport,
+		interval:  time.Second,
+		paths:     concurrent.NewMap[token_bucket.Path, common.Rate](),
+		users:     concurrent.NewSet[token_bucket.UserID](),
+		extractor: token_bucket.FromHeader("X-User-ID"),
+	}
+}
+
+// SetLimit sets a limit on a path, allowing up to rate.Value requests in any rate.Interval. The path needs to be
+// absolute and start with a leading '/'.
+func (b *RateLimiterBuilder) SetLimit(path string, rate common.Rate) *RateLimiterBuilder {
+	b.paths.Put(token_bucket.Path(path), rate)
+	return b
+}
+
+// RegisterUser registers a user.
+func (b *RateLimiterBuilder) RegisterUser(ID string) *RateLimiterBuilder {
+	b.users.Put(token_bucket.UserID(ID))
+	return b
+}
+
+// SetUserExtractor sets the function used to identify the user issuing a request. By default, users are identified by
+// the value of the `X-User-ID` header.
+func (b *RateLimiterBuilder) SetUserExtractor(extractor token_bucket.UserExtractor) *RateLimiterBuilder {
+	b.extractor = extractor
+	return b
+}
+
+// SetPeers sets the peers this node gossips with. It may include the node itself, which is then ignored.
+func (b *RateLimiterBuilder) SetPeers(peers ...NodeID) *RateLimiterBuilder {
+	b.peers = peers
+	return b
+}
+
+// SetGossipInterval sets how often the node gossips with its peers, which trades accuracy for network traffic.
+// Defaults to 1 second.
+func (b *RateLimiterBuilder) SetGossipInterval(interval time.Duration) *RateLimiterBuilder {
+	b.interval = interval
+	return b
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken by the HTTP middleware.
+func (b *RateLimiterBuilder) SetObserver(observer common.Observer) *RateLimiterBuilder {
+	b.observer = observer
+	return b
+}
+
+// Build builds a rate limiter and starts gossiping with its peers.
+// It returns an error if no limits have been configured, if any limit is not positive, or if the gossip interval is
+// not positive.
+func (b *RateLimiterBuilder) Build() (*RateLimiter, error) {
+	if b.paths.Size() == 0 {
+		return nil, errors.New("no rate limit configured")
+	}
+
+	for t := range b.paths.Iterate() {
+		if t.Value.Value <= 0 || t.Value.Interval <= 0 {
+			return nil, fmt.Errorf("rate limit of %v must be positive", t.Key)
+		}
+	}
+
+	if b.interval <= 0 {
+		return nil, errors.New("gossip interval must be positive")
+	}
+
+	var peers []NodeID
+	for _, p := range b.peers {
+		if p != b.self {
+			peers = append(peers, p)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &RateLimiter{
+		self:      b.self,
+		transport: b.transport,
+		peers:     peers,
+		interval:  b.interval,
+		paths:     b.paths,
+		users:     b.users,
+		extractor: b.extractor,
+		observer:  b.observer,
+		counters:  make(map[key]map[int64]*PNCounter),
+		ctx:       ctx,
+		cancel:    cancel,
+		now:       time.Now,
+	}
+
+	go rl.gossip()
+
+	return rl, nil
+}
+
+// Stop stops gossiping with peers.
+func (rl *RateLimiter) Stop() {
+	rl.cancel()
+}
+
+// window returns the index of the fixed window containing now, along with the fraction of it that has elapsed.
+func window(rate common.Rate, now time.Time) (int64, float64) {
+	interval := int64(rate.Interval)
+	t := now.UnixNano()
+
+	return t / interval, float64(t%interval) / float64(interval)
+}
+
+// count returns the value of the counter of window. It must be invoked while holding the lock.
+func (rl *RateLimiter) count(k key, window int64) int64 {
+	c, ok := rl.counters[k][window]
+	if !ok {
+		return 0
+	}
+
+	if v := c.Value(); v > 0 {
+		return v
+	}
+
+	return 0
+}
+
+// counter returns the counter of window, creating it if needed. It must be invoked while holding the lock.
+func (rl *RateLimiter) counter(k key, window int64) *PNCounter {
+	windows, ok := rl.counters[k]
+	if !ok {
+		windows = make(map[int64]*PNCounter)
+		rl.counters[k] = windows
+	}
+
+	c, ok := windows[window]
+	if !ok {
+		c = NewPNCounter()
+		windows[window] = c
+	}
+
+	return c
+}
+
+// Take counts a request for the user and path of the provided request, if the estimated number of requests issued in
+// the sliding window, across all nodes, is below the limit.
+func (rl *RateLimiter) Take(r *http.Request) common.Decision {
+	d, _, _ := rl.take(r)
+	return d
+}
+
+// take counts the request, returning the decision along with the user and path it was taken on.
+func (rl *RateLimiter) take(r *http.Request) (common.Decision, token_bucket.UserID, token_bucket.Path) {
+	userID, path := rl.identify(r)
+	return rl.decide(userID, path), userID, path
+}
+
+func (rl *RateLimiter) decide(userID token_bucket.UserID, path token_bucket.Path) common.Decision {
+	rate, exists := rl.paths.Get(path)
+	if !exists || !rl.users.Contains(userID) {
+		return common.Decision{Outcome: common.Unknown}
+	}
+
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	k := key{userID: userID, path: path}
+	current, elapsed := window(rate, rl.now())
+	cur := float64(rl.count(k, current))
+	prev := float64(rl.count(k, current-1))
+	estimate := cur + prev*(1-elapsed)
+
+	if estimate+1 > float64(rate.Value) {
+		return common.Decision{
+			Outcome:    common.Denied,
+			Limit:      rate.Value,
+			RetryAfter: retryAfter(rate, cur, prev, elapsed),
+		}
+	}
+
+	rl.counter(k, current).Increment(rl.self, 1)
+
+	return common.Decision{
+		Outcome:   common.Allowed,
+		Limit:     rate.Value,
+		Remaining: rate.Value - int(math.Ceil(estimate+1)),
+	}
+}
+
+// retryAfter returns the time after which the estimate drops enough to allow another request, assuming no further
+// requests are counted in the meantime.
+func retryAfter(rate common.Rate, cur, prev, elapsed float64) time.Duration {
+	limit := float64(rate.Value)
+	untilNext := time.Duration((1 - elapsed) * float64(rate.Interval))
+
+	if cur+1 > limit {
+		// the current window is full: wait until it becomes the previous one and has been partially left behind
+		return untilNext + time.Duration((1-(limit-1)/cur)*float64(rate.Interval))
+	}
+
+	// wait until the previous window overlaps the sliding window little enough
+	target := 1 - (limit-1-cur)/prev
+	if target <= elapsed {
+		return 0
+	}
+
+	return time.Duration((target - elapsed) * float64(rate.Interval))
+}
+
+// Refund gives back the request counted by a previous invocation of Take, which returned d, if the request was
+// allowed.
+func (rl *RateLimiter) Refund(r *http.Request, d common.Decision) {
+	if d.Outcome != common.Allowed {
+		return
+	}
+
+	userID, path := rl.identify(r)
+	rate, exists := rl.paths.Get(path)
+	if !exists || !rl.users.Contains(userID) {
+		return
+	}
+
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	k := key{userID: userID, path: path}
+	current, _ := window(rate, rl.now())
+	if rl.count(k, current) > 0 {
+		rl.counter(k, current).Decrement(rl.self, 1)
+	}
+}
+
+// Receive merges the state gossiped by a peer. Entries of unknown users or paths, and of windows that are no longer,
+// or not yet, relevant are discarded.
+func (rl *RateLimiter) Receive(s State) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	now := rl.now()
+	for _, e := range s.Entries {
+		if e.Counter == nil || !rl.users.Contains(e.UserID) {
+			continue
+		}
+
+		rate, exists := rl.paths.Get(e.Path)
+		if !exists {
+			continue
+		}
+
+		// the next window is accepted as well, since the clocks of peers may be slightly ahead
+		if current, _ := window(rate, now); e.Window < current-1 || e.Window > current+1 {
+			continue
+		}
+
+		rl.counter(key{userID: e.UserID, path: e.Path}, e.Window).Merge(e.Counter)
+	}
+}
+
+// state returns the state of all counters that are still relevant, discarding the others.
+func (rl *RateLimiter) state() State {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	now := rl.now()
+	s := State{From: rl.self}
+	for k, windows := range rl.counters {
+		rate, exists := rl.paths.Get(k.path)
+		if !exists {
+			delete(rl.counters, k)
+			continue
+		}
+
+		current, _ := window(rate, now)
+		for w, c := range windows {
+			if w < current-1 {
+				delete(windows, w)
+				continue
+			}
+
+			s.Entries = append(s.Entries, Entry{UserID: k.userID, Path: k.path, Window: w, Counter: c.Clone()})
+		}
+
+		if len(windows) == 0 {
+			delete(rl.counters, k)
+		}
+	}
+
+	return s
+}
+
+// gossip periodically sends the state of all counters to all peers, until the rate limiter is stopped.
+func (rl *RateLimiter) gossip() {
+	ticker := time.NewTicker(rl.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.ctx.Done():
+			return
+		case <-ticker.C:
+			rl.Gossip(rl.ctx)
+		}
+	}
+}
+
+// Gossip immediately sends the state of all counters to all peers. Unreachable peers are skipped: they will converge
+// in a later round, since the state is sent in full every time.
+func (rl *RateLimiter) Gossip(ctx context.Context) {
+	s := rl.state()
+	for _, peer := range rl.peers {
+		if err := rl.transport.Send(ctx, peer, s); err != nil {
+			logging.Logger().Debug("cannot gossip", zap.String("peer", string(peer)), zap.Error(err))
+		}
+	}
+}
+
+// Handle returns an HTTP middleware that applies preconfigured rate-limiting rules to all received requests.
+func (rl *RateLimiter) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, userID, path := rl.take(r)
+		r = tracing.Record(r, "gossip", string(userID), string(path), d)
+		if rl.observer != nil {
+			rl.observer.Observe(r, "gossip", rl.route(path), d)
+		}
+
+		switch d.Outcome {
+		case common.Unknown:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case common.Denied:
+			w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(d.Limit))
+			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(d.RetryAfter.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// route returns the path if it is configured, or an empty string otherwise.
+func (rl *RateLimiter) route(path token_bucket.Path) string {
+	if _, ok := rl.paths.Get(path); ok {
+		return string(path)
+	}
+
+	return ""
+}
+
+func (rl *RateLimiter) identify(r *http.Request) (token_bucket.UserID, token_bucket.Path) {
+	return rl.extractor(r), token_bucket.Path(r.URL.Path)
+}
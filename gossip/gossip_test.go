@@ -0,0 +1,253 @@
+package gossip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/admin"
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	route  = "/foo"
+	userID = "abc"
+)
+
+var rate = common.Rate{Value: 6, Interval: time.Minute}
+
+func newRateLimiter(t *testing.T, self NodeID, transport Transport, now *time.Time, peers ...NodeID) *RateLimiter {
+	rl, err := NewRateLimiterBuilder(self, transport).
+		SetLimit(route, rate).
+		RegisterUser(userID).
+		SetPeers(peers...).
+		SetGossipInterval(time.Hour).
+		Build()
+	assert.NoError(t, err)
+
+	rl.now = func() time.Time { return *now }
+
+	return rl
+}
+
+func newRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, route, nil)
+	r.Header.Set("X-User-ID", userID)
+
+	return r
+}
+
+func take(rl *RateLimiter, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if rl.Take(newRequest()).Allowed() {
+			allowed++
+		}
+	}
+
+	return allowed
+}
+
+func TestRateLimiterBuilder_Build_FailsIfLimitIsNotPositive(t *testing.T) {
+	for _, r := range []common.Rate{{Value: 6}, {Interval: time.Minute}, {Value: -1, Interval: time.Minute}} {
+		_, err := NewRateLimiterBuilder("a", NewNetwork()).SetLimit(route, r).Build()
+		assert.Error(t, err)
+	}
+}
+
+func TestRateLimiter_SlidingWindow(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(t, "a", NewNetwork(), &now)
+	defer rl.Stop()
+
+	assert.Equal(t, 6, take(rl, 10))
+
+	d := rl.Take(newRequest())
+	assert.Equal(t, common.Denied, d.Outcome)
+	assert.Equal(t, 6, d.Limit)
+	// the window becomes the previous one in 1m, then 1/6 of it needs to be left behind
+	assert.InDelta(t, time.Minute+10*time.Second, d.RetryAfter, float64(time.Millisecond))
+
+	// half of the previous window still overlaps the sliding window: 3 requests are counted
+	now = now.Add(90 * time.Second)
+	assert.Equal(t, 3, take(rl, 10))
+
+	now = now.Add(2 * time.Minute)
+	d = rl.Take(newRequest())
+	assert.Equal(t, common.Allowed, d.Outcome)
+	assert.Equal(t, 5, d.Remaining)
+}
+
+func TestRateLimiter_Refund(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(t, "a", NewNetwork(), &now)
+	defer rl.Stop()
+
+	assert.Equal(t, 6, take(rl, 6))
+	rl.Refund(newRequest(), common.Decision{Outcome: common.Allowed})
+	assert.Equal(t, 1, take(rl, 2))
+}
+
+func TestRateLimiter_UnknownUser(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(t, "a", NewNetwork(), &now)
+	defer rl.Stop()
+
+	r := httptest.NewRequest(http.MethodGet, route, nil)
+	r.Header.Set("X-User-ID", "xyz")
+
+	assert.Equal(t, common.Unknown, rl.Take(r).Outcome)
+}
+
+func TestRateLimiter_Gossip(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	network := NewNetwork()
+	peers := []NodeID{"a", "b", "c"}
+
+	a := newRateLimiter(t, "a", network, &now, peers...)
+	defer a.Stop()
+	b := newRateLimiter(t, "b", network, &now, peers...)
+	defer b.Stop()
+	c := newRateLimiter(t, "c", network, &now, peers...)
+	defer c.Stop()
+
+	network.Join("a", a)
+	network.Join("b", b)
+	network.Join("c", c)
+
+	assert.Equal(t, 2, take(a, 2))
+	assert.Equal(t, 2, take(b, 2))
+	a.Gossip(ctx)
+	b.Gossip(ctx)
+
+	// c knows about the 4 requests served by a and b
+	assert.Equal(t, 2, take(c, 5))
+	c.Gossip(ctx)
+
+	assert.Equal(t, 0, take(a, 1))
+	assert.Equal(t, 0, take(b, 1))
+}
+
+func TestRateLimiter_Partition(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	network := NewNetwork()
+	peers := []NodeID{"a", "b", "c"}
+
+	a := newRateLimiter(t, "a", network, &now, peers...)
+	defer a.Stop()
+	b := newRateLimiter(t, "b", network, &now, peers...)
+	defer b.Stop()
+	c := newRateLimiter(t, "c", network, &now, peers...)
+	defer c.Stop()
+
+	network.Join("a", a)
+	network.Join("b", b)
+	network.Join("c", c)
+
+	network.Partition([]NodeID{"a"}, []NodeID{"b", "c"})
+
+	assert.Equal(t, 3, take(a, 3))
+	a.Gossip(ctx)
+	assert.Equal(t, 4, take(b, 4))
+	b.Gossip(ctx)
+
+	// each side of the partition only enforces the limit on its own
+	assert.Equal(t, 2, take(c, 5))
+	assert.Equal(t, 3, take(a, 5))
+
+	network.Heal()
+	a.Gossip(ctx)
+	b.Gossip(ctx)
+	c.Gossip(ctx)
+
+	// all nodes converge once the partition heals
+	for _, rl := range []*RateLimiter{a, b, c} {
+		rl.mux.Lock()
+		count := rl.count(key{userID: userID, path: route}, now.UnixNano()/int64(rate.Interval))
+		rl.mux.Unlock()
+
+		assert.Equal(t, int64(12), count)
+		assert.Equal(t, 0, take(rl, 1))
+	}
+}
+
+func TestRateLimiter_HTTPTransport(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	transport := NewHTTPTransport(time.Second, "secret")
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	b := newRateLimiter(t, NodeID(server.URL), transport, &now)
+	defer b.Stop()
+	h, err := Handler(b, admin.BearerToken("secret"))
+	assert.NoError(t, err)
+	mux.Handle(StatePath, h)
+
+	a := newRateLimiter(t, "a", transport, &now, NodeID(server.URL))
+	defer a.Stop()
+
+	assert.Equal(t, 6, take(a, 6))
+	a.Gossip(ctx)
+
+	assert.Equal(t, 0, take(b, 1))
+}
+
+func TestHandler_FailsWithoutAuthorizer(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(t, "a", NewNetwork(), &now)
+	defer rl.Stop()
+
+	_, err := Handler(rl, nil)
+	assert.Error(t, err)
+}
+
+func TestHandler_RejectsUnauthorizedAndLargeRequests(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(t, "a", NewNetwork(), &now)
+	defer rl.Stop()
+
+	h, err := Handler(rl, admin.BearerToken("secret"))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, StatePath, strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest(http.MethodPost, StatePath, strings.NewReader(`"`+strings.Repeat("x", maxStateSize)+`"`))
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestRateLimiter_Receive_DiscardsUnknownEntries(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(t, "a", NewNetwork(), &now)
+	defer rl.Stop()
+
+	current := now.UnixNano() / int64(rate.Interval)
+	counter := NewPNCounter()
+	counter.Increment("b", 1)
+
+	rl.Receive(State{From: "b", Entries: []Entry{
+		{UserID: "unknown", Path: route, Window: current, Counter: counter},
+		{UserID: userID, Path: "/unknown", Window: current, Counter: counter},
+		{UserID: userID, Path: route, Window: current - 2, Counter: counter},
+		{UserID: userID, Path: route, Window: current + 2, Counter: counter},
+		{UserID: userID, Path: route, Window: current, Counter: counter},
+	}})
+
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	assert.Len(t, rl.counters, 1)
+	assert.Len(t, rl.counters[key{userID: userID, path: route}], 1)
+}
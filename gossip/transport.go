@@ -0,0 +1,198 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fedragon/rate-limiter/admin"
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+const (
+	// StatePath is the path where nodes receive the state gossiped by their peers, when using HTTPTransport.
+	StatePath = "/gossip/v1/state"
+	// maxStateSize is the maximum size, in bytes, of the state gossiped by peers.
+	maxStateSize = 1 << 20
+)
+
+var errUnreachable = errors.New("peer unreachable")
+
+type (
+	// State is the state of all the counters known by a node, as gossiped to its peers.
+	State struct {
+		From    NodeID  `json:"from"`
+		Entries []Entry `json:"entries"`
+	}
+
+	// Entry is the counter of the requests issued by a user on a path during a window.
+	Entry struct {
+		UserID  token_bucket.UserID `json:"user_id"`
+		Path    token_bucket.Path   `json:"path"`
+		Window  int64               `json:"window"`
+		Counter *PNCounter          `json:"counter"`
+	}
+
+	// Receiver receives the state gossiped by peers.
+	Receiver interface {
+		Receive(s State)
+	}
+
+	// Transport delivers state to peers.
+	Transport interface {
+		Send(ctx context.Context, peer NodeID, s State) error
+	}
+
+	// HTTPTransport delivers state to peers over HTTP, by POSTing it to StatePath. Peers are identified by their base
+	// URLs (e.g. http://10.0.0.1:8080) and need to serve the handler returned by Handler() at StatePath.
+	HTTPTransport struct {
+		client *http.Client
+		token  string
+	}
+
+	// Network is an in-memory Transport connecting nodes running in the same process, which can be partitioned to
+	// simulate network failures, e.g. in tests.
+	Network struct {
+		mux    sync.RWMutex
+		nodes  map[NodeID]Receiver
+		groups map[NodeID]int
+	}
+)
+
+// NewHTTPTransport returns a new HTTP transport, which waits at most timeout for a peer to respond. The token is a
+// secret shared by all peers, which is sent as a bearer token: peers can check it using admin.BearerToken(token).
+func NewHTTPTransport(timeout time.Duration, token string) *HTTPTransport {
+	return &HTTPTransport{client: &http.Client{Timeout: timeout}, token: token}
+}
+
+// Send sends the state to peer.
+func (t *HTTPTransport) Send(ctx context.Context, peer NodeID, s State) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, string(peer)+StatePath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Handler returns an HTTP handler that passes the state gossiped by peers to the receiver. Requests not allowed by the
+// authorizer, e.g. admin.BearerToken, are rejected with status 401.
+// It returns an error if no authorizer is provided.
+func Handler(receiver Receiver, authorizer admin.Authorizer) (http.Handler, error) {
+	if authorizer == nil {
+		return nil, errors.New("no authorizer configured")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorizer(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var s State
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxStateSize)).Decode(&s); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		receiver.Receive(s)
+		w.WriteHeader(http.StatusNoContent)
+	}), nil
+}
+
+// NewNetwork returns a new, fully connected, in-memory network.
+func NewNetwork() *Network {
+	return &Network{
+		nodes:  make(map[NodeID]Receiver),
+		groups: make(map[NodeID]int),
+	}
+}
+
+// Join connects a node to the network.
+func (n *Network) Join(id NodeID, receiver Receiver) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.nodes[id] = receiver
+}
+
+// Partition splits the network into the provided groups of nodes: nodes can only reach other nodes in the same group.
+// Nodes not listed in any group are isolated.
+func (n *Network) Partition(groups ...[]NodeID) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.groups = make(map[NodeID]int)
+	for i, group := range groups {
+		for _, id := range group {
+			n.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions, so that all nodes can reach each other again.
+func (n *Network) Heal() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.groups = make(map[NodeID]int)
+}
+
+func (n *Network) reachable(from, to NodeID) bool {
+	if len(n.groups) == 0 {
+		return true
+	}
+
+	g, ok := n.groups[from]
+	return ok && g == n.groups[to]
+}
+
+// Send delivers the state to peer, unless the sender and peer are in different partitions.
+func (n *Network) Send(_ context.Context, peer NodeID, s State) error {
+	n.mux.RLock()
+	receiver, ok := n.nodes[peer]
+	reachable := n.reachable(s.From, peer)
+	n.mux.RUnlock()
+
+	if !ok || !reachable {
+		return fmt.Errorf("%w: %v", errUnreachable, peer)
+	}
+
+	receiver.Receive(s)
+	return nil
+}
@@ -0,0 +1,130 @@
+package grpc_interceptor
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/composite"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type (
+	// Interceptor applies rate limiters to gRPC calls. Since limiters evaluate HTTP requests, each call is presented to
+	// them as a request whose path is the full method name (e.g. /package.Service/Method), whose headers are the
+	// incoming metadata (e.g. the `x-user-id` key is read as the `X-User-ID` header) and whose remote address is the
+	// one of the peer. Limits are therefore configured as usual, e.g. using token_bucket.RateLimiterBuilder.SetLimit
+	// with the full method name as path.
+	Interceptor struct {
+		limiter  composite.Limiter
+		messages composite.Limiter
+	}
+
+	// limitedStream is a server stream whose received messages are rate-limited.
+	limitedStream struct {
+		grpc.ServerStream
+		limiter composite.Limiter
+		method  string
+	}
+)
+
+// NewInterceptor returns a new interceptor that limits calls using the provided limiter.
+func NewInterceptor(limiter composite.Limiter) *Interceptor {
+	return &Interceptor{limiter: limiter}
+}
+
+// SetMessageLimiter sets a limiter that is applied to each message received on a stream, in addition to the limiter
+// applied when the stream is opened. A message that exceeds the limit terminates the stream.
+func (i *Interceptor) SetMessageLimiter(limiter composite.Limiter) *Interceptor {
+	i.messages = limiter
+	return i
+}
+
+// Unary returns a unary server interceptor that rejects calls exceeding the limits.
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := Error(i.limiter.Take(Request(ctx, info.FullMethod))); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns a stream server interceptor that rejects streams exceeding the limits and, if a message limiter is
+// set, terminates them as soon as a received message exceeds its limits.
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := Error(i.limiter.Take(Request(ss.Context(), info.FullMethod))); err != nil {
+			return err
+		}
+
+		if i.messages != nil {
+			ss = &limitedStream{ServerStream: ss, limiter: i.messages, method: info.FullMethod}
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// RecvMsg receives a message, if allowed by the limiter.
+func (s *limitedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return Error(s.limiter.Take(Request(s.Context(), s.method)))
+}
+
+// Request returns the HTTP request evaluated by limiters on behalf of the call to method.
+func Request(ctx context.Context, method string) *http.Request {
+	r := (&http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: method},
+		Header: make(http.Header),
+	}).WithContext(ctx)
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, values := range md {
+			for _, v := range values {
+				r.Header.Add(k, v)
+			}
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	return r
+}
+
+// Error returns the gRPC error matching the decision, or nil if the call is allowed. Calls exceeding the limits are
+// rejected with ResourceExhausted, along with a RetryInfo detail telling clients when to retry.
+func Error(d common.Decision) error {
+	switch d.Outcome {
+	case common.Allowed, common.Allowlisted:
+		return nil
+	case common.Unknown:
+		return status.Error(codes.Unauthenticated, "unknown caller or method")
+	case common.Denylisted:
+		return status.Error(codes.PermissionDenied, "caller is blocked")
+	case common.Failed:
+		return status.Error(codes.Unavailable, "cannot evaluate rate limit")
+	default:
+		st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(d.RetryAfter)}); err == nil {
+			st = detailed
+		}
+
+		return st.Err()
+	}
+}
@@ -0,0 +1,160 @@
+package grpc_interceptor
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testServer struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (testServer) UnaryCall(context.Context, *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return &testpb.SimpleResponse{}, nil
+}
+
+func (testServer) StreamingInputCall(stream testpb.TestService_StreamingInputCallServer) error {
+	size := 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&testpb.StreamingInputCallResponse{AggregatedPayloadSize: int32(size)})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		size += len(req.GetPayload().GetBody())
+	}
+}
+
+func newLimiter(t *testing.T, method string, value int) *token_bucket.RateLimiter {
+	rate := common.Rate{Value: value, Interval: time.Minute}
+	rl, err := token_bucket.NewRateLimiterBuilder().
+		SetLimit(method, token_bucket.Config{Limit: rate, Refill: rate}).
+		RegisterUser("abc").
+		Build()
+	assert.NoError(t, err)
+	t.Cleanup(rl.Stop)
+
+	return rl
+}
+
+func newClient(t *testing.T, i *Interceptor) testpb.TestServiceClient {
+	lis := bufconn.Listen(1024 * 1024)
+	g := grpc.NewServer(grpc.UnaryInterceptor(i.Unary()), grpc.StreamInterceptor(i.Stream()))
+	testpb.RegisterTestServiceServer(g, testServer{})
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return testpb.NewTestServiceClient(conn)
+}
+
+func withUser(id string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-user-id", id)
+}
+
+func TestInterceptor_Unary(t *testing.T) {
+	client := newClient(t, NewInterceptor(newLimiter(t, testpb.TestService_UnaryCall_FullMethodName, 2)))
+	ctx := withUser("abc")
+
+	for i := 0; i < 2; i++ {
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		assert.NoError(t, err)
+	}
+
+	_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Len(t, st.Details(), 1)
+
+	info, ok := st.Details()[0].(*errdetails.RetryInfo)
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute, info.GetRetryDelay().AsDuration(), float64(time.Second))
+
+	_, err = client.UnaryCall(withUser("xyz"), &testpb.SimpleRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestInterceptor_StreamMessages(t *testing.T) {
+	method := testpb.TestService_StreamingInputCall_FullMethodName
+	i := NewInterceptor(newLimiter(t, method, 1)).SetMessageLimiter(newLimiter(t, method, 3))
+	client := newClient(t, i)
+	ctx := withUser("abc")
+
+	stream, err := client.StreamingInputCall(ctx)
+	assert.NoError(t, err)
+
+	for j := 0; j < 3; j++ {
+		assert.NoError(t, stream.Send(&testpb.StreamingInputCallRequest{Payload: &testpb.Payload{Body: []byte("a")}}))
+	}
+	res, err := stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), res.GetAggregatedPayloadSize())
+
+	// only one stream per minute
+	stream, err = client.StreamingInputCall(ctx)
+	assert.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestInterceptor_StreamMessagesExceedingLimit(t *testing.T) {
+	method := testpb.TestService_StreamingInputCall_FullMethodName
+	i := NewInterceptor(newLimiter(t, method, 10)).SetMessageLimiter(newLimiter(t, method, 2))
+	client := newClient(t, i)
+
+	stream, err := client.StreamingInputCall(withUser("abc"))
+	assert.NoError(t, err)
+
+	for j := 0; j < 3; j++ {
+		// sending may fail once the server has terminated the stream
+		stream.Send(&testpb.StreamingInputCallRequest{Payload: &testpb.Payload{Body: []byte("a")}})
+	}
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRequest(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user-id", "abc", "x-api-key", "k"))
+	r := Request(ctx, "/pkg.Service/Method")
+
+	assert.Equal(t, "/pkg.Service/Method", r.URL.Path)
+	assert.Equal(t, "abc", r.Header.Get("X-User-ID"))
+	assert.Equal(t, "k", r.Header.Get("X-API-Key"))
+}
+
+func TestError(t *testing.T) {
+	assert.NoError(t, Error(common.Decision{Outcome: common.Allowed}))
+	assert.NoError(t, Error(common.Decision{Outcome: common.Allowlisted}))
+	assert.Equal(t, codes.PermissionDenied, status.Code(Error(common.Decision{Outcome: common.Denylisted})))
+	assert.Equal(t, codes.Unavailable, status.Code(Error(common.Decision{Outcome: common.Failed})))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(Error(common.Decision{Outcome: common.Banned})))
+}
@@ -0,0 +1,144 @@
+package hierarchy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/fedragon/rate-limiter/composite"
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+type (
+	OrganizationID string
+	UserID         string
+	APIKey         string
+
+	// Limits defines the limits applied, on a given path, at each level of the hierarchy.
+	Limits struct {
+		Organization token_bucket.Config
+		User         token_bucket.Config
+		Key          token_bucket.Config
+	}
+
+	// RateLimiterBuilder builds a hierarchical rate limiter, where organizations own users, who in turn own API keys.
+	RateLimiterBuilder struct {
+		paths         *concurrent.Map[token_bucket.Path, Limits]
+		organizations *concurrent.Set[OrganizationID]
+		users         *concurrent.Map[UserID, OrganizationID]
+		keys          *concurrent.Map[APIKey, UserID]
+	}
+)
+
+// NewRateLimiterBuilder instantiates a hierarchical rate limiter builder.
+func NewRateLimiterBuilder() *RateLimiterBuilder {
+	return &RateLimiterBuilder{
+		paths:         concurrent.NewMap[token_bucket.Path, Limits](),
+		organizations: concurrent.NewSet[OrganizationID](),
+		users:         concurrent.NewMap[UserID, OrganizationID](),
+		keys:          concurrent.NewMap[APIKey, UserID](),
+	}
+}
+
+// SetLimits sets the limits on a path. The path needs to be absolute and start with a leading '/'.
+func (b *RateLimiterBuilder) SetLimits(path string, limits Limits) *RateLimiterBuilder {
+	b.paths.Put(token_bucket.Path(path), limits)
+	return b
+}
+
+// RegisterOrganization registers an organization.
+func (b *RateLimiterBuilder) RegisterOrganization(ID string) *RateLimiterBuilder {
+	b.organizations.Put(OrganizationID(ID))
+	return b
+}
+
+// RegisterUser registers a user belonging to an organization.
+func (b *RateLimiterBuilder) RegisterUser(organizationID, ID string) *RateLimiterBuilder {
+	b.users.Put(UserID(ID), OrganizationID(organizationID))
+	return b
+}
+
+// RegisterKey registers an API key belonging to a user.
+func (b *RateLimiterBuilder) RegisterKey(userID, key string) *RateLimiterBuilder {
+	b.keys.Put(APIKey(key), UserID(userID))
+	return b
+}
+
+// Build builds a rate limiter that identifies requests by the value of their `X-API-Key` header and consumes a unit
+// of quota from the API key, its user and its organization: the request is only served if all three allow it.
+// Since each request also consumes from its parents, the limit of a parent caps the sum of its children's requests,
+// regardless of the children's own limits.
+// It returns an error if no limits have been configured, or if any user or key belongs to an unregistered parent.
+func (b *RateLimiterBuilder) Build() (*composite.RateLimiter, error) {
+	for t := range b.users.Iterate() {
+		if !b.organizations.Contains(t.Value) {
+			return nil, fmt.Errorf("user %v belongs to unknown organization %v", t.Key, t.Value)
+		}
+	}
+
+	for t := range b.keys.Iterate() {
+		if _, ok := b.users.Get(t.Value); !ok {
+			return nil, fmt.Errorf("API key belongs to unknown user %v", t.Value)
+		}
+	}
+
+	// extractors use copies of the registrations, so that later changes to the builder do not affect the limiter
+	owners := make(map[APIKey]UserID)
+	for t := range b.keys.Iterate() {
+		owners[t.Key] = t.Value
+	}
+
+	parents := make(map[UserID]OrganizationID)
+	for t := range b.users.Iterate() {
+		parents[t.Key] = t.Value
+	}
+
+	key := func(r *http.Request) token_bucket.UserID {
+		return token_bucket.UserID(r.Header.Get("X-API-Key"))
+	}
+	user := func(r *http.Request) token_bucket.UserID {
+		return token_bucket.UserID(owners[APIKey(key(r))])
+	}
+	organization := func(r *http.Request) token_bucket.UserID {
+		return token_bucket.UserID(parents[UserID(user(r))])
+	}
+
+	keys := token_bucket.NewRateLimiterBuilder().SetUserExtractor(key)
+	users := token_bucket.NewRateLimiterBuilder().SetUserExtractor(user)
+	organizations := token_bucket.NewRateLimiterBuilder().SetUserExtractor(organization)
+
+	for t := range b.paths.Iterate() {
+		path := string(t.Key)
+		keys.SetLimit(path, t.Value.Key)
+		users.SetLimit(path, t.Value.User)
+		organizations.SetLimit(path, t.Value.Organization)
+	}
+
+	for k := range owners {
+		keys.RegisterUser(string(k))
+	}
+
+	for u := range parents {
+		users.RegisterUser(string(u))
+	}
+
+	for o := range b.organizations.Iterate() {
+		organizations.RegisterUser(string(o))
+	}
+
+	var limiters []composite.Limiter
+	for _, builder := range []*token_bucket.RateLimiterBuilder{keys, users, organizations} {
+		rl, err := builder.Build()
+		if err != nil {
+			for _, l := range limiters {
+				l.Stop()
+			}
+
+			return nil, err
+		}
+
+		limiters = append(limiters, rl)
+	}
+
+	return composite.NewRateLimiter(limiters...), nil
+}
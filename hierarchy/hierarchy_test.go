@@ -0,0 +1,147 @@
+package hierarchy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/test"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	route = "/bar"
+)
+
+func config(value int) token_bucket.Config {
+	return token_bucket.Config{
+		Limit:  common.Rate{Value: value, Interval: time.Minute},
+		Refill: common.Rate{Value: value, Interval: time.Minute},
+	}
+}
+
+func TestRateLimiterBuilder_Build_FailsIfUserBelongsToUnknownOrganization(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().
+		SetLimits(route, Limits{Organization: config(1), User: config(1), Key: config(1)}).
+		RegisterUser("acme", "alice").
+		Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiterBuilder_Build_FailsIfKeyBelongsToUnknownUser(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().
+		SetLimits(route, Limits{Organization: config(1), User: config(1), Key: config(1)}).
+		RegisterOrganization("acme").
+		RegisterKey("alice", "k1").
+		Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiterBuilder_Build_FailsIfLimitsAreNotConfigured(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiterBuilder_Build_IgnoresLaterRegistrations(t *testing.T) {
+	b := NewRateLimiterBuilder().
+		SetLimits(route, Limits{Organization: config(10), User: config(10), Key: config(10)}).
+		RegisterOrganization("acme").
+		RegisterUser("acme", "alice").
+		RegisterKey("alice", "k1")
+	rl, err := b.Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	b.RegisterKey("bob", "k1")
+
+	req := httptest.NewRequest(http.MethodGet, route, nil)
+	req.Header.Set("X-API-Key", "k1")
+	assert.True(t, rl.Take(req).Allowed())
+}
+
+func Test_ServerReturns401_IfKeyIsUnknown(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().
+		SetLimits(route, Limits{Organization: config(1), User: config(1), Key: config(1)}).
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	statusCode, err := sendRequest(server.URL+route, "k1", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, statusCode)
+}
+
+func Test_ServerReturns429_WhenUserExceedsItsLimit(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().
+		SetLimits(route, Limits{Organization: config(10), User: config(2), Key: config(2)}).
+		RegisterOrganization("acme").
+		RegisterUser("acme", "alice").
+		RegisterKey("alice", "k1").
+		RegisterKey("alice", "k2").
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	for _, key := range []string{"k1", "k2"} {
+		statusCode, err := sendRequest(server.URL+route, key, client)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, statusCode)
+	}
+
+	// both keys still have quota, but their user does not
+	statusCode, err := sendRequest(server.URL+route, "k1", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+}
+
+func Test_ServerReturns429_WhenOrganizationExceedsItsLimit(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().
+		SetLimits(route, Limits{Organization: config(1), User: config(5), Key: config(5)}).
+		RegisterOrganization("acme").
+		RegisterUser("acme", "alice").
+		RegisterUser("acme", "bob").
+		RegisterKey("alice", "k1").
+		RegisterKey("bob", "k2").
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	statusCode, err := sendRequest(server.URL+route, "k1", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, err = sendRequest(server.URL+route, "k2", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+}
+
+func sendRequest(route string, key string, client *http.Client) (int, error) {
+	req, _ := http.NewRequest("GET", route, nil)
+	req.Header.Set("X-API-Key", key)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode, nil
+}
@@ -6,8 +6,10 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/fedragon/rate-limiter/access"
 	"github.com/fedragon/rate-limiter/common"
 	q "github.com/fedragon/rate-limiter/queue"
+	"github.com/fedragon/rate-limiter/tracing"
 )
 
 // RateLimiter acts as an HTTP middleware that rate-limits traffic according to the `leaking bucket` algorithm, which
@@ -16,37 +18,119 @@ import (
 // Since it uses goroutines to manage the queue refilling logic, it needs to be explicitly stopped by invoking the
 // Stop() method during the HTTP server shutdown process.
 type RateLimiter struct {
-	queue  *q.Queue
-	cancel context.CancelFunc
-	once   sync.Once
+	queue     *q.Queue
+	cancel    context.CancelFunc
+	once      sync.Once
+	lists     *access.Lists
+	extractor access.Extractor
+	observer  common.Observer
 }
 
 // NewRateLimiter returns a new rate limiter that is refilled at the provided rate.
 func NewRateLimiter(rate *common.Rate) *RateLimiter {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &RateLimiter{
-		queue:  q.NewQueue(ctx, rate),
-		cancel: cancel,
+		queue:     q.NewQueue(ctx, rate),
+		cancel:    cancel,
+		extractor: access.FromHeader("X-User-ID"),
 	}
 }
 
+// SetAccessLists sets the allow and deny lists that are checked before consuming from the queue: allowlisted requests
+// are always served, while denylisted ones are always rejected. It must be invoked before the rate limiter is used.
+func (rl *RateLimiter) SetAccessLists(lists *access.Lists) *RateLimiter {
+	rl.lists = lists
+	return rl
+}
+
+// SetUserExtractor sets the function used to identify the user issuing a request, when checking it against the access
+// lists. By default, users are identified by the value of the `X-User-ID` header. It must be invoked before the rate
+// limiter is used.
+func (rl *RateLimiter) SetUserExtractor(extractor access.Extractor) *RateLimiter {
+	rl.extractor = extractor
+	return rl
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken by the HTTP middleware. Since all
+// requests share the same queue, decisions are not associated to any route. It must be invoked before the rate
+// limiter is used.
+func (rl *RateLimiter) SetObserver(observer common.Observer) *RateLimiter {
+	rl.observer = observer
+	return rl
+}
+
 // Stop stops the rate limiter, cleaning up all used resources.
 func (rl *RateLimiter) Stop() {
 	rl.cancel()
 }
 
-func (rl *RateLimiter) Handle(next http.Handler) http.Handler {
+// QueueDepth returns the number of requests that can currently be served before the queue is refilled.
+func (rl *RateLimiter) QueueDepth() int {
+	return rl.queue.Len()
+}
+
+func (rl *RateLimiter) start() {
 	rl.once.Do(func() {
 		go rl.queue.Start()
 	})
+}
+
+// Take consumes a slot from the queue, if available. The request is only inspected to check it against the access
+// lists, if any, since all requests share the same queue.
+func (rl *RateLimiter) Take(r *http.Request) common.Decision {
+	rl.start()
+
+	if rl.lists != nil {
+		if outcome, ok := rl.lists.Check(r, rl.extractor(r)); ok {
+			return common.Decision{Outcome: outcome}
+		}
+	}
+
+	rate := rl.queue.Rate()
+	if !rl.queue.Pop() {
+		return common.Decision{
+			Outcome:    common.Denied,
+			Limit:      rate.Value,
+			RetryAfter: rate.Interval,
+		}
+	}
+
+	return common.Decision{
+		Outcome: common.Allowed,
+		Limit:   rate.Value,
+	}
+}
+
+// Refund gives back the slot consumed by a previous invocation of Take, which returned d, if the request was allowed.
+func (rl *RateLimiter) Refund(_ *http.Request, d common.Decision) {
+	if d.Outcome != common.Allowed {
+		return
+	}
+
+	rl.queue.Push()
+}
+
+// Handle returns an HTTP middleware that drops all requests exceeding the configured rate.
+func (rl *RateLimiter) Handle(next http.Handler) http.Handler {
+	rl.start()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !rl.queue.Pop() {
+		d := rl.Take(r)
+		r = tracing.Record(r, "leaking_bucket", "", r.URL.Path, d)
+		if rl.observer != nil {
+			rl.observer.Observe(r, "leaking_bucket", "", d)
+		}
+		if d.Outcome == common.Denylisted {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if !d.Allowed() {
 			rate := rl.queue.Rate()
 
-			w.WriteHeader(http.StatusTooManyRequests)
 			w.Header().Add("X-Ratelimit-Retry-Limit", strconv.Itoa(rate.Value))
 			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(rate.Interval.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
 			return
 		}
 
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fedragon/rate-limiter/access"
 	"github.com/fedragon/rate-limiter/common"
 	"github.com/fedragon/rate-limiter/test"
 	"github.com/stretchr/testify/assert"
@@ -43,6 +44,26 @@ func Test_ServerReturns429_OnTooManyRequests(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, statusCode)
 }
 
+func Test_ServerReturnsRetryHeaders_OnTooManyRequests(t *testing.T) {
+	rl := NewRateLimiter(&common.Rate{Value: 1, Interval: time.Second})
+	defer rl.Stop()
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+
+	client := &http.Client{Timeout: 500 * time.Millisecond}
+
+	statusCode, err := sendRequest(server.URL+route, client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	res, err := client.Get(server.URL + route)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("X-Ratelimit-Retry-Limit"))
+	assert.Equal(t, "1", res.Header.Get("X-Ratelimit-Retry-After"))
+}
+
 func Test_ServerReturns200_AfterRefill(t *testing.T) {
 	rl := NewRateLimiter(&common.Rate{Value: 1, Interval: time.Second})
 	defer rl.Stop()
@@ -65,11 +86,40 @@ func Test_ServerReturns200_AfterRefill(t *testing.T) {
 	assert.Equal(t, http.StatusOK, statusCode)
 }
 
+func TestRateLimiter_Refund_GivesBackQuota(t *testing.T) {
+	rl := NewRateLimiter(&common.Rate{Value: 1, Interval: time.Minute})
+	defer rl.Stop()
+
+	d := rl.Take(nil)
+	assert.True(t, d.Allowed())
+	assert.Equal(t, common.Denied, rl.Take(nil).Outcome)
+
+	rl.Refund(nil, d)
+	assert.True(t, rl.Take(nil).Allowed())
+}
+
+func Test_ServerReturns403_IfClientIsDenylisted(t *testing.T) {
+	lists := access.NewLists()
+	assert.NoError(t, lists.Deny.AddCIDR("127.0.0.0/8"))
+	rl := NewRateLimiter(&common.Rate{Value: 1, Interval: time.Second}).SetAccessLists(lists)
+	defer rl.Stop()
+	server := httptest.NewServer(rl.Handle(test.ItsOK()))
+
+	client := &http.Client{Timeout: 500 * time.Millisecond}
+	statusCode, err := sendRequest(server.URL+route, client)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+}
+
 func sendRequest(route string, client *http.Client) (int, error) {
 	req, _ := http.NewRequest("GET", route, nil)
 
 	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
 	defer res.Body.Close()
 
-	return res.StatusCode, err
+	return res.StatusCode, nil
 }
@@ -0,0 +1,326 @@
+package lease
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+type (
+	// Config configures the trade-off between accuracy and latency of a leasing store.
+	Config struct {
+		// BatchSize is the number of tokens leased at once from the central store. Larger batches mean fewer round
+		// trips, but less accurate limits, since leased tokens cannot be used by other instances until they are
+		// returned.
+		BatchSize int
+		// LowWatermark is the number of locally available tokens below which a new batch is leased in the background,
+		// so that requests rarely need to wait for the central store. If zero, batches are only leased once the local
+		// buffer is empty, while serving a request.
+		LowWatermark int
+		// MaxIdle is the time after which unused tokens are returned to the central store, and idle leases are
+		// forgotten. If zero, tokens are only returned when the store is closed.
+		MaxIdle time.Duration
+	}
+
+	lease struct {
+		mux        sync.Mutex
+		cfg        token_bucket.Config
+		tokens     int
+		lastRefill time.Time
+		lastUsed   time.Time
+		leasing    bool
+		// resets is incremented whenever the lease is reset, so that batches leased in the meantime are discarded
+		resets int
+		// removed is set once the lease has been removed from the store, so that it is not used anymore
+		removed bool
+	}
+
+	// Store is a token_bucket.Store that leases batches of tokens from a central store (e.g. Redis) and serves requests
+	// from a local buffer, so that most requests do not need a round trip to the central store. Limits are therefore
+	// approximate, but can never be exceeded, since tokens are always taken from the central store before being used.
+	// It needs to be closed, using its Close() method, to return all unused tokens to the central store.
+	Store struct {
+		central token_bucket.Store
+		cfg     Config
+		leases  *concurrent.Map[token_bucket.Key, *lease]
+		ctx     context.Context
+		cancel  context.CancelFunc
+		now     func() time.Time
+	}
+)
+
+// NewStore returns a new store that leases tokens from the central store.
+func NewStore(central token_bucket.Store, cfg Config) *Store {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Store{
+		central: central,
+		cfg:     cfg,
+		leases:  concurrent.NewMap[token_bucket.Key, *lease](),
+		ctx:     ctx,
+		cancel:  cancel,
+		now:     time.Now,
+	}
+
+	if cfg.MaxIdle > 0 {
+		go s.releaseIdle()
+	}
+
+	return s
+}
+
+// lock returns the lease of key, locked, creating it if needed.
+func (s *Store) lock(key token_bucket.Key) *lease {
+	for {
+		l := s.leases.Update(key, func(l *lease, exists bool) *lease {
+			if !exists {
+				l = &lease{}
+			}
+
+			return l
+		})
+
+		l.mux.Lock()
+		if !l.removed {
+			return l
+		}
+		// the lease has been removed in the meantime: a new one is created
+		l.mux.Unlock()
+	}
+}
+
+// lease leases up to a batch of tokens from the central store, requiring at least need of them. It returns the
+// number of leased tokens, if taken.
+func (s *Store) lease(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, need int) (token_bucket.Bucket, int, bool, error) {
+	batch := s.cfg.BatchSize
+	if batch < need {
+		batch = need
+	}
+
+	b, taken, err := s.central.Take(ctx, key, cfg, batch)
+	if err != nil {
+		return b, 0, false, err
+	}
+
+	// the central store does not have a full batch anymore: take whatever is left, if enough
+	if !taken && b.Tokens >= need && need > 0 {
+		batch = b.Tokens
+		b, taken, err = s.central.Take(ctx, key, cfg, batch)
+		if err != nil {
+			return b, 0, false, err
+		}
+	}
+
+	return b, batch, taken, nil
+}
+
+// acquire leases up to a batch of tokens from the central store, requiring at least need of them, and adds them to
+// the lease. It must be invoked while holding the lease lock.
+func (s *Store) acquire(ctx context.Context, key token_bucket.Key, l *lease, need int) (token_bucket.Bucket, bool, error) {
+	b, batch, taken, err := s.lease(ctx, key, l.cfg, need)
+	if err != nil {
+		return b, false, err
+	}
+
+	if taken {
+		l.tokens += batch
+	}
+	l.lastRefill = b.LastRefill
+
+	return b, taken, nil
+}
+
+// Take consumes n tokens from the local buffer, leasing a new batch from the central store if needed.
+func (s *Store) Take(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, bool, error) {
+	l := s.lock(key)
+	defer l.mux.Unlock()
+
+	l.cfg = cfg
+	l.lastUsed = s.now()
+
+	if l.tokens < n {
+		b, taken, err := s.acquire(ctx, key, l, n-l.tokens)
+		if err != nil || !taken {
+			return b, false, err
+		}
+	}
+
+	l.tokens -= n
+
+	if s.cfg.LowWatermark > 0 && l.tokens <= s.cfg.LowWatermark && !l.leasing {
+		l.leasing = true
+		go s.renew(key, l)
+	}
+
+	return token_bucket.Bucket{Tokens: l.tokens, LastRefill: l.lastRefill}, true, nil
+}
+
+// renew leases a new batch of tokens in the background. The lease is not locked while waiting for the central
+// store, so that requests can still be served from the local buffer in the meantime.
+func (s *Store) renew(key token_bucket.Key, l *lease) {
+	l.mux.Lock()
+	cfg, resets := l.cfg, l.resets
+	l.mux.Unlock()
+
+	if s.ctx.Err() != nil {
+		// the store has been closed: leased tokens would never be returned
+		l.mux.Lock()
+		l.leasing = false
+		l.mux.Unlock()
+		return
+	}
+
+	b, batch, taken, err := s.lease(s.ctx, key, cfg, 0)
+	if err != nil {
+		logging.Logger().Warn("cannot lease tokens", zap.String("path", string(key.Path)), zap.Error(err))
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.leasing = false
+	if err != nil || !taken {
+		return
+	}
+
+	if l.resets != resets {
+		// the bucket has been reset in the meantime, and the central store already filled up: the batch is discarded
+		return
+	}
+
+	l.tokens += batch
+	l.lastRefill = b.LastRefill
+
+	if s.ctx.Err() != nil {
+		// the store has been closed in the meantime, after returning the other tokens
+		s.release(context.Background(), key, l)
+	}
+}
+
+// Refill gives back n tokens to the local buffer, from which they will eventually be returned to the central store.
+func (s *Store) Refill(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	l := s.lock(key)
+	defer l.mux.Unlock()
+
+	l.cfg = cfg
+	l.tokens += n
+	if l.tokens > cfg.Limit.Value {
+		l.tokens = cfg.Limit.Value
+	}
+
+	return token_bucket.Bucket{Tokens: l.tokens, LastRefill: l.lastRefill}, nil
+}
+
+// Get returns the current state of the bucket identified by key, including the tokens leased by this store.
+func (s *Store) Get(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) (token_bucket.Bucket, error) {
+	b, err := s.central.Get(ctx, key, cfg)
+	if err != nil {
+		return b, err
+	}
+
+	if l, ok := s.leases.Get(key); ok {
+		l.mux.Lock()
+		b.Tokens += l.tokens
+		l.mux.Unlock()
+	}
+
+	if b.Tokens > cfg.Limit.Value {
+		b.Tokens = cfg.Limit.Value
+	}
+
+	return b, nil
+}
+
+// Reset discards the tokens leased by this store and fills up the bucket in the central store.
+func (s *Store) Reset(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) error {
+	s.discard(key)
+	return s.central.Reset(ctx, key, cfg)
+}
+
+// Set discards the tokens leased by this store and sets the number of tokens of the bucket in the central store.
+func (s *Store) Set(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	s.discard(key)
+	return s.central.Set(ctx, key, cfg, n)
+}
+
+// discard drops the tokens leased for key, along with the batches being leased, before its bucket is overwritten in
+// the central store.
+func (s *Store) discard(key token_bucket.Key) {
+	if l, ok := s.leases.Get(key); ok {
+		l.mux.Lock()
+		l.tokens = 0
+		l.resets++
+		l.mux.Unlock()
+	}
+}
+
+// release returns all unused tokens of a lease to the central store. It must be invoked while holding the lease lock.
+func (s *Store) release(ctx context.Context, key token_bucket.Key, l *lease) {
+	if l.tokens == 0 {
+		return
+	}
+
+	if _, err := s.central.Refill(ctx, key, l.cfg, l.tokens); err != nil {
+		logging.Logger().Warn("cannot return leased tokens", zap.String("path", string(key.Path)), zap.Error(err))
+		return
+	}
+
+	l.tokens = 0
+}
+
+// releaseIdle periodically returns the tokens of idle leases to the central store, then forgets them, until the store
+// is closed.
+func (s *Store) releaseIdle() {
+	ticker := time.NewTicker(s.cfg.MaxIdle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			now := s.now()
+			for t := range s.leases.Iterate() {
+				l := t.Value
+				l.mux.Lock()
+				if now.Sub(l.lastUsed) >= s.cfg.MaxIdle {
+					s.release(s.ctx, t.Key, l)
+				}
+				l.mux.Unlock()
+			}
+
+			s.leases.DeleteIf(func(_ token_bucket.Key, l *lease) bool {
+				// leases in use are not idle
+				if !l.mux.TryLock() {
+					return false
+				}
+				defer l.mux.Unlock()
+
+				l.removed = l.tokens == 0 && !l.leasing && now.Sub(l.lastUsed) >= s.cfg.MaxIdle
+				return l.removed
+			})
+		}
+	}
+}
+
+// Close returns all unused tokens to the central store.
+func (s *Store) Close() {
+	s.cancel()
+
+	ctx := context.Background()
+	for t := range s.leases.Iterate() {
+		l := t.Value
+		l.mux.Lock()
+		s.release(ctx, t.Key, l)
+		l.mux.Unlock()
+	}
+}
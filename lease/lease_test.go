@@ -0,0 +1,254 @@
+package lease
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	key = token_bucket.Key{UserID: "abc", Path: "/foo"}
+	cfg = token_bucket.Config{
+		Limit:  common.Rate{Value: 10, Interval: time.Hour},
+		Refill: common.Rate{Value: 1, Interval: time.Hour},
+	}
+)
+
+func TestStore_TakeLeasesBatch(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 4})
+	defer s.Close()
+
+	b, taken, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, 3, b.Tokens)
+
+	cb, err := central.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, cb.Tokens)
+
+	// served from the local buffer
+	for i := 0; i < 3; i++ {
+		_, taken, err = s.Take(ctx, key, cfg, 1)
+		assert.NoError(t, err)
+		assert.True(t, taken)
+	}
+
+	cb, err = central.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, cb.Tokens)
+
+	sb, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, sb.Tokens)
+}
+
+func TestStore_TakeLeasesWhatIsLeft(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 4})
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		_, taken, err := s.Take(ctx, key, cfg, 1)
+		assert.NoError(t, err)
+		assert.True(t, taken, "take %d", i)
+	}
+
+	_, taken, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.False(t, taken)
+}
+
+func TestStore_NeverExceedsLimit(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	stores := []*Store{
+		NewStore(central, Config{BatchSize: 3, LowWatermark: 1}),
+		NewStore(central, Config{BatchSize: 3, LowWatermark: 1}),
+		NewStore(central, Config{BatchSize: 3, LowWatermark: 1}),
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mux   sync.Mutex
+		total int
+	)
+	for _, s := range stores {
+		wg.Add(1)
+		go func(s *Store) {
+			defer wg.Done()
+
+			for i := 0; i < 10; i++ {
+				if _, taken, _ := s.Take(ctx, key, cfg, 1); taken {
+					mux.Lock()
+					total++
+					mux.Unlock()
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	for _, s := range stores {
+		s.Close()
+	}
+
+	assert.LessOrEqual(t, total, cfg.Limit.Value)
+
+	b, err := central.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Limit.Value-total, b.Tokens)
+}
+
+func TestStore_LowWatermarkRenewsInBackground(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 3, LowWatermark: 1})
+	defer s.Close()
+
+	_, taken, err := s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+
+	assert.Eventually(t, func() bool {
+		b, err := central.Get(ctx, key, cfg)
+		return err == nil && b.Tokens == 4
+	}, time.Second, 10*time.Millisecond)
+}
+
+// blockingStore blocks the Take operations of a store until unblocked.
+type blockingStore struct {
+	token_bucket.Store
+	unblock chan struct{}
+}
+
+func (s *blockingStore) Take(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, bool, error) {
+	<-s.unblock
+	return s.Store.Take(ctx, key, cfg, n)
+}
+
+func TestStore_RenewDoesNotBlockTake(t *testing.T) {
+	ctx := context.Background()
+	central := &blockingStore{Store: token_bucket.NewMemoryStore(), unblock: make(chan struct{})}
+	s := NewStore(central, Config{BatchSize: 4, LowWatermark: 2})
+	defer s.Close()
+
+	// the first batch is leased while serving the request
+	go func() { central.unblock <- struct{}{} }()
+	_, taken, err := s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+
+	// the background renewal is blocked, but the local buffer can still be used
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, taken, err := s.Take(ctx, key, cfg, 1)
+		assert.NoError(t, err)
+		assert.True(t, taken)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "take blocked by renewal")
+	}
+
+	close(central.unblock)
+	assert.Eventually(t, func() bool {
+		b, err := s.Get(ctx, key, cfg)
+		return err == nil && b.Tokens == 7
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStore_RefillStaysLocal(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 4})
+
+	_, _, err := s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+
+	b, err := s.Refill(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Tokens)
+
+	cb, err := central.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, cb.Tokens)
+
+	s.Close()
+
+	cb, err = central.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, cb.Tokens)
+}
+
+func TestStore_ReleasesIdleLeases(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 4, MaxIdle: 20 * time.Millisecond})
+	defer s.Close()
+
+	_, _, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		b, err := central.Get(ctx, key, cfg)
+		return err == nil && b.Tokens == 9
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return s.leases.Size() == 0 }, time.Second, 10*time.Millisecond)
+
+	// forgotten leases are recreated when needed
+	_, taken, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+}
+
+func TestStore_Reset(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 4})
+	defer s.Close()
+
+	_, _, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Reset(ctx, key, cfg))
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, b.Tokens)
+
+	cb, err := central.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, cb.Tokens)
+}
+
+func TestStore_Set(t *testing.T) {
+	ctx := context.Background()
+	central := token_bucket.NewMemoryStore()
+	s := NewStore(central, Config{BatchSize: 4})
+	defer s.Close()
+
+	_, _, err := s.Take(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+
+	b, err := s.Set(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+
+	// the leased tokens have been discarded
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Tokens)
+}
@@ -0,0 +1,337 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+// Action defines what happens to connections exceeding the limits.
+type Action int
+
+const (
+	// Close closes excess connections as soon as they are accepted.
+	Close Action = iota
+	// Delay holds excess connections until they are within the limits, closing them if that takes longer than the
+	// configured maximum delay.
+	Delay
+)
+
+type (
+	// ListenerBuilder builds a rate-limited listener.
+	ListenerBuilder struct {
+		inner    net.Listener
+		rate     *token_bucket.Config
+		maxPerIP int
+		maxConns int
+		action   Action
+		maxDelay time.Duration
+	}
+
+	// Listener is a net.Listener that limits the rate at which connections are accepted from each source IP, as well as
+	// the number of concurrent connections from each source IP and overall, so that connection floods are stopped
+	// before reaching the server. It can be used with http.Server.Serve as well as with raw TCP servers.
+	// Connections are checked in the background, so that excess connections being delayed do not hold back the others.
+	// The accept rate of source IPs is forgotten once they have been idle long enough for it to be fully refilled.
+	Listener struct {
+		net.Listener
+		store    *token_bucket.MemoryStore
+		rate     *token_bucket.Config
+		maxPerIP int
+		maxConns int
+		action   Action
+		maxDelay time.Duration
+
+		mux      sync.Mutex
+		conns    map[string]int
+		total    int
+		released chan struct{}
+
+		ready     chan net.Conn
+		errs      chan error
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+
+	// conn is an accepted connection, which frees its slot when closed.
+	conn struct {
+		net.Conn
+		once    sync.Once
+		release func()
+	}
+)
+
+// NewListenerBuilder instantiates a builder of a listener that accepts connections from inner.
+func NewListenerBuilder(inner net.Listener) *ListenerBuilder {
+	return &ListenerBuilder{
+		inner:    inner,
+		maxDelay: time.Second,
+	}
+}
+
+// SetAcceptRate sets the rate at which connections are accepted from each source IP.
+func (b *ListenerBuilder) SetAcceptRate(cfg token_bucket.Config) *ListenerBuilder {
+	b.rate = &cfg
+	return b
+}
+
+// SetMaxConnsPerIP sets the maximum number of concurrent connections from each source IP.
+func (b *ListenerBuilder) SetMaxConnsPerIP(n int) *ListenerBuilder {
+	b.maxPerIP = n
+	return b
+}
+
+// SetMaxConns sets the maximum number of concurrent connections overall.
+func (b *ListenerBuilder) SetMaxConns(n int) *ListenerBuilder {
+	b.maxConns = n
+	return b
+}
+
+// SetAction sets what happens to connections exceeding the limits. Defaults to Close.
+func (b *ListenerBuilder) SetAction(action Action) *ListenerBuilder {
+	b.action = action
+	return b
+}
+
+// SetMaxDelay sets for how long connections can be delayed, when the action is Delay. Defaults to 1 second.
+func (b *ListenerBuilder) SetMaxDelay(d time.Duration) *ListenerBuilder {
+	b.maxDelay = d
+	return b
+}
+
+// Build builds a rate-limited listener and starts accepting connections.
+// It returns an error if no limits have been configured, or if the accept rate is not positive.
+func (b *ListenerBuilder) Build() (*Listener, error) {
+	if b.rate == nil && b.maxPerIP <= 0 && b.maxConns <= 0 {
+		return nil, errors.New("no limit configured")
+	}
+
+	if b.rate != nil {
+		if err := b.rate.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid accept rate: %w", err)
+		}
+	}
+
+	l := &Listener{
+		Listener: b.inner,
+		store:    token_bucket.NewMemoryStore(),
+		rate:     b.rate,
+		maxPerIP: b.maxPerIP,
+		maxConns: b.maxConns,
+		action:   b.action,
+		maxDelay: b.maxDelay,
+		conns:    make(map[string]int),
+		released: make(chan struct{}),
+		ready:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+
+	go l.serve()
+	if idle := l.idle(); idle > 0 {
+		go l.evict(idle)
+	}
+
+	return l, nil
+}
+
+// Accept returns the next connection within the limits.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections already accepted are not closed.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+
+	return err
+}
+
+// serve accepts connections from the inner listener, until it is closed.
+func (l *Listener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.Close()
+				return
+			}
+
+			// let the caller decide whether to go on, e.g. after a temporary error
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+
+		go l.admit(c)
+	}
+}
+
+// idle returns for how long a source IP needs to be idle before its accept rate is fully refilled, or zero if it
+// never is.
+func (l *Listener) idle() time.Duration {
+	if l.rate == nil || l.rate.Refill.Value <= 0 || l.rate.Refill.Interval <= 0 {
+		return 0
+	}
+
+	intervals := (l.rate.Limit.Value + l.rate.Refill.Value - 1) / l.rate.Refill.Value
+	return time.Duration(intervals) * l.rate.Refill.Interval
+}
+
+// evict periodically forgets the accept rate of source IPs that have been idle for longer than idle, until the
+// listener is closed.
+func (l *Listener) evict(idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.store.Evict(idle)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// admit hands the connection over to Accept once it is within the limits, or closes it.
+func (l *Listener) admit(c net.Conn) {
+	ip := remoteIP(c)
+	deadline := time.Now().Add(l.maxDelay)
+
+	if !l.allowRate(ip, deadline) || !l.acquire(ip, deadline) {
+		logging.Logger().Debug("closing excess connection", zap.String("ip", ip))
+		c.Close()
+		return
+	}
+
+	wrapped := &conn{Conn: c, release: func() { l.release(ip) }}
+	select {
+	case l.ready <- wrapped:
+	case <-l.done:
+		wrapped.Close()
+	}
+}
+
+// allowRate consumes a unit of the accept rate of ip, waiting until the deadline if the action is Delay.
+func (l *Listener) allowRate(ip string, deadline time.Time) bool {
+	if l.rate == nil {
+		return true
+	}
+
+	key := token_bucket.Key{UserID: token_bucket.UserID(ip)}
+	for {
+		b, taken, err := l.store.Take(context.Background(), key, *l.rate, 1)
+		if err != nil {
+			return false
+		}
+
+		if taken {
+			return true
+		}
+
+		next := b.NextRefill(*l.rate)
+		if l.action != Delay || next.After(deadline) {
+			return false
+		}
+
+		if !l.sleep(time.Until(next)) {
+			return false
+		}
+	}
+}
+
+// acquire takes a connection slot for ip, waiting until the deadline if the action is Delay.
+func (l *Listener) acquire(ip string, deadline time.Time) bool {
+	for {
+		l.mux.Lock()
+		if (l.maxConns <= 0 || l.total < l.maxConns) && (l.maxPerIP <= 0 || l.conns[ip] < l.maxPerIP) {
+			l.total++
+			l.conns[ip]++
+			l.mux.Unlock()
+			return true
+		}
+		released := l.released
+		l.mux.Unlock()
+
+		if l.action != Delay {
+			return false
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-released:
+			timer.Stop()
+		case <-timer.C:
+			return false
+		case <-l.done:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// release frees the connection slot of ip, waking up delayed connections.
+func (l *Listener) release(ip string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.total--
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// sleep waits for d, returning false if the listener is closed in the meantime.
+func (l *Listener) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// Close closes the connection, freeing its slot.
+func (c *conn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+
+	return host
+}
@@ -0,0 +1,198 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+func newListener(t *testing.T, b func(*ListenerBuilder) *ListenerBuilder) (*Listener, chan net.Conn) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	l, err := b(NewListenerBuilder(inner)).Build()
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			accepted <- c
+		}
+	}()
+
+	return l, accepted
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// closedByServer returns true if the server closes the connection within a short time.
+func closedByServer(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+
+	return err == io.EOF
+}
+
+func receive(t *testing.T, accepted chan net.Conn) net.Conn {
+	select {
+	case c := <-accepted:
+		return c
+	case <-time.After(time.Second):
+		assert.Fail(t, "no connection accepted")
+		return nil
+	}
+}
+
+func TestListenerBuilder_Build(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer inner.Close()
+
+	_, err = NewListenerBuilder(inner).Build()
+	assert.Error(t, err)
+}
+
+func TestListenerBuilder_Build_FailsIfAcceptRateIsNotPositive(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer inner.Close()
+
+	rate := common.Rate{Value: 1, Interval: time.Second}
+	for _, cfg := range []token_bucket.Config{
+		{Limit: rate, Refill: common.Rate{Value: 1}},
+		{Limit: rate, Refill: common.Rate{Interval: time.Second}},
+		{Refill: rate},
+	} {
+		_, err = NewListenerBuilder(inner).SetAcceptRate(cfg).Build()
+		assert.Error(t, err)
+	}
+}
+
+func TestListener_MaxConnsPerIP(t *testing.T) {
+	l, accepted := newListener(t, func(b *ListenerBuilder) *ListenerBuilder {
+		return b.SetMaxConnsPerIP(2)
+	})
+
+	dial(t, l)
+	dial(t, l)
+	first := receive(t, accepted)
+	receive(t, accepted)
+
+	assert.True(t, closedByServer(dial(t, l)))
+
+	// closing a connection frees its slot
+	first.Close()
+	c := dial(t, l)
+	receive(t, accepted)
+	assert.False(t, closedByServer(c))
+}
+
+func TestListener_AcceptRate(t *testing.T) {
+	rate := common.Rate{Value: 2, Interval: time.Minute}
+	l, accepted := newListener(t, func(b *ListenerBuilder) *ListenerBuilder {
+		return b.SetAcceptRate(token_bucket.Config{Limit: rate, Refill: rate})
+	})
+
+	for i := 0; i < 2; i++ {
+		dial(t, l)
+		receive(t, accepted).Close()
+	}
+
+	assert.True(t, closedByServer(dial(t, l)))
+}
+
+func TestListener_EvictsIdleIPs(t *testing.T) {
+	rate := common.Rate{Value: 1, Interval: 100 * time.Millisecond}
+	l, accepted := newListener(t, func(b *ListenerBuilder) *ListenerBuilder {
+		return b.SetAcceptRate(token_bucket.Config{Limit: rate, Refill: rate})
+	})
+
+	dial(t, l)
+	receive(t, accepted).Close()
+	assert.Equal(t, 1, l.store.Len())
+
+	assert.Eventually(t, func() bool { return l.store.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestListener_DelayUntilSlotIsFree(t *testing.T) {
+	l, accepted := newListener(t, func(b *ListenerBuilder) *ListenerBuilder {
+		return b.SetMaxConns(1).SetAction(Delay).SetMaxDelay(time.Second)
+	})
+
+	dial(t, l)
+	first := receive(t, accepted)
+
+	dial(t, l)
+	select {
+	case <-accepted:
+		assert.Fail(t, "connection should have been delayed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	receive(t, accepted)
+}
+
+func TestListener_DelayTooLong(t *testing.T) {
+	l, accepted := newListener(t, func(b *ListenerBuilder) *ListenerBuilder {
+		return b.SetMaxConns(1).SetAction(Delay).SetMaxDelay(50 * time.Millisecond)
+	})
+
+	dial(t, l)
+	receive(t, accepted)
+
+	assert.True(t, closedByServer(dial(t, l)))
+}
+
+func TestListener_HTTPServer(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	l, err := NewListenerBuilder(inner).SetMaxConnsPerIP(1).Build()
+	assert.NoError(t, err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	for i := 0; i < 3; i++ {
+		// the same connection is reused
+		res, err := client.Get("http://" + l.Addr().String())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	l, _ := newListener(t, func(b *ListenerBuilder) *ListenerBuilder {
+		return b.SetMaxConns(1)
+	})
+
+	assert.NoError(t, l.Close())
+	assert.NoError(t, l.Close())
+
+	_, err := l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,316 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+// Action defines what happens to messages exceeding the limits.
+type Action int
+
+const (
+	// Drop discards excess messages, so that the reader only gets the messages within the limits.
+	Drop Action = iota
+	// Delay holds excess messages back until they are within the limits.
+	Delay
+	// Close closes the connection with the configured close code upon the first excess message.
+	Close
+)
+
+const (
+	// ClosePolicyViolation is the WebSocket close code for messages that violate a policy.
+	ClosePolicyViolation = 1008
+	// CloseTryAgainLater is the WebSocket close code for temporary conditions, e.g. when clients send too many messages.
+	CloseTryAgainLater = 1013
+)
+
+const (
+	// reads and writes identify the direction of messages in bucket keys.
+	reads  token_bucket.Path = "read"
+	writes token_bucket.Path = "write"
+)
+
+// ErrLimited is returned by ReadMessage and WriteMessage once the connection has been closed because of an excess
+// message.
+var ErrLimited = errors.New("message rate limit exceeded")
+
+type (
+	// Conn is a message-oriented connection. Its methods have the same signatures as those of a
+	// github.com/gorilla/websocket connection, which therefore satisfies it.
+	Conn interface {
+		ReadMessage() (messageType int, p []byte, err error)
+		WriteMessage(messageType int, data []byte) error
+	}
+
+	// CloseFunc closes a connection with a close code and reason, e.g. by sending a WebSocket close frame.
+	CloseFunc func(code int, reason string) error
+
+	// limit limits the messages flowing in one direction, per connection and per user.
+	limit struct {
+		conn *token_bucket.Config
+		user *token_bucket.Config
+	}
+
+	// LimitsBuilder builds message limits.
+	LimitsBuilder struct {
+		read        limit
+		write       limit
+		action      Action
+		closeCode   int
+		closeReason string
+	}
+
+	// Limits limit the rate of the messages received and sent on long-lived connections (e.g. WebSockets), which HTTP
+	// middlewares only see once, when they are opened. Messages are limited per connection and per user, across all
+	// the connections of a user: a message is within the limits only if both allow it. Received and sent messages
+	// are limited separately.
+	Limits struct {
+		read        limit
+		write       limit
+		users       token_bucket.Store
+		action      Action
+		closeCode   int
+		closeReason string
+	}
+
+	// LimitedConn is a connection whose received and sent messages are rate-limited.
+	LimitedConn struct {
+		Conn
+		ctx     context.Context
+		limits  *Limits
+		userID  token_bucket.UserID
+		own     token_bucket.Store
+		close   CloseFunc
+		dropped atomic.Int64
+		closed  atomic.Bool
+	}
+)
+
+// NewLimitsBuilder instantiates a message limits builder.
+func NewLimitsBuilder() *LimitsBuilder {
+	return &LimitsBuilder{
+		closeCode:   ClosePolicyViolation,
+		closeReason: "too many messages",
+	}
+}
+
+// SetConnectionRate sets the rate of messages received on each connection.
+func (b *LimitsBuilder) SetConnectionRate(cfg token_bucket.Config) *LimitsBuilder {
+	b.read.conn = &cfg
+	return b
+}
+
+// SetUserRate sets the rate of messages received from each user, across all their connections.
+func (b *LimitsBuilder) SetUserRate(cfg token_bucket.Config) *LimitsBuilder {
+	b.read.user = &cfg
+	return b
+}
+
+// SetWriteConnectionRate sets the rate of messages sent on each connection.
+func (b *LimitsBuilder) SetWriteConnectionRate(cfg token_bucket.Config) *LimitsBuilder {
+	b.write.conn = &cfg
+	return b
+}
+
+// SetWriteUserRate sets the rate of messages sent to each user, across all their connections.
+func (b *LimitsBuilder) SetWriteUserRate(cfg token_bucket.Config) *LimitsBuilder {
+	b.write.user = &cfg
+	return b
+}
+
+// SetAction sets what happens to messages exceeding the limits. Defaults to Drop.
+func (b *LimitsBuilder) SetAction(action Action) *LimitsBuilder {
+	b.action = action
+	return b
+}
+
+// SetCloseCode sets the code and reason used to close connections, when the action is Close. Defaults to
+// ClosePolicyViolation.
+func (b *LimitsBuilder) SetCloseCode(code int, reason string) *LimitsBuilder {
+	b.closeCode = code
+	b.closeReason = reason
+	return b
+}
+
+// Build builds message limits.
+// It returns an error if no rate has been configured, or if any rate is not positive.
+func (b *LimitsBuilder) Build() (*Limits, error) {
+	if !b.read.configured() && !b.write.configured() {
+		return nil, errors.New("no rate limit configured")
+	}
+
+	for _, cfg := range []*token_bucket.Config{b.read.conn, b.read.user, b.write.conn, b.write.user} {
+		if cfg == nil {
+			continue
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid rate: %w", err)
+		}
+	}
+
+	return &Limits{
+		read:        b.read,
+		write:       b.write,
+		users:       token_bucket.NewMemoryStore(),
+		action:      b.action,
+		closeCode:   b.closeCode,
+		closeReason: b.closeReason,
+	}, nil
+}
+
+// Wrap returns a connection that reads and writes messages on conn within the limits, on behalf of the user. Delayed
+// reads and writes are interrupted once ctx is done; close is invoked when the action is Close.
+func (l *Limits) Wrap(ctx context.Context, conn Conn, userID token_bucket.UserID, close CloseFunc) *LimitedConn {
+	return &LimitedConn{
+		Conn:   conn,
+		ctx:    ctx,
+		limits: l,
+		userID: userID,
+		own:    token_bucket.NewMemoryStore(),
+		close:  close,
+	}
+}
+
+// Dropped returns the number of messages dropped so far.
+func (c *LimitedConn) Dropped() int64 {
+	return c.dropped.Load()
+}
+
+// configured returns true if any rate is configured.
+func (l limit) configured() bool {
+	return l.conn != nil || l.user != nil
+}
+
+// ReadMessage returns the next message within the limits, applying the configured action to excess messages.
+func (c *LimitedConn) ReadMessage() (int, []byte, error) {
+	for {
+		if c.closed.Load() {
+			return 0, nil, ErrLimited
+		}
+
+		messageType, p, err := c.Conn.ReadMessage()
+		if err != nil {
+			return messageType, p, err
+		}
+
+		ok, err := c.allow(c.limits.read, reads)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if ok {
+			return messageType, p, nil
+		}
+
+		if c.limits.action == Drop {
+			c.dropped.Add(1)
+			continue
+		}
+
+		c.shutdown()
+		return 0, nil, ErrLimited
+	}
+}
+
+// WriteMessage sends a message within the limits, applying the configured action to excess messages. Dropped
+// messages are not sent, without returning an error.
+func (c *LimitedConn) WriteMessage(messageType int, data []byte) error {
+	if c.closed.Load() {
+		return ErrLimited
+	}
+
+	ok, err := c.allow(c.limits.write, writes)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return c.Conn.WriteMessage(messageType, data)
+	}
+
+	if c.limits.action == Drop {
+		c.dropped.Add(1)
+		return nil
+	}
+
+	c.shutdown()
+	return ErrLimited
+}
+
+// shutdown marks the connection as closed, then closes it.
+func (c *LimitedConn) shutdown() {
+	c.closed.Store(true)
+	if c.close != nil {
+		if err := c.close(c.limits.closeCode, c.limits.closeReason); err != nil {
+			logging.Logger().Warn("cannot close connection", zap.String("user", string(c.userID)), zap.Error(err))
+		}
+	}
+}
+
+// allow consumes a unit of quota from the connection and user buckets of a direction. When the action is Delay, it
+// waits until both allow it.
+func (c *LimitedConn) allow(l limit, direction token_bucket.Path) (bool, error) {
+	for {
+		next, ok, err := c.take(l, direction)
+		if err != nil || ok {
+			return ok, err
+		}
+
+		if c.limits.action != Delay {
+			return false, nil
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return false, c.ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take consumes a unit of quota from both buckets of a direction, if available. Otherwise, it returns when the bucket
+// that is exhausted is refilled.
+func (c *LimitedConn) take(l limit, direction token_bucket.Path) (time.Time, bool, error) {
+	key := token_bucket.Key{UserID: c.userID, Path: direction}
+
+	if cfg := l.conn; cfg != nil {
+		b, taken, err := c.own.Take(c.ctx, key, *cfg, 1)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		if !taken {
+			return b.NextRefill(*cfg), false, nil
+		}
+	}
+
+	if cfg := l.user; cfg != nil {
+		b, taken, err := c.limits.users.Take(c.ctx, key, *cfg, 1)
+		if err != nil || !taken {
+			if conn := l.conn; conn != nil {
+				c.own.Refill(c.ctx, key, *conn, 1)
+			}
+		}
+
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		if !taken {
+			return b.NextRefill(*cfg), false, nil
+		}
+	}
+
+	return time.Time{}, true, nil
+}
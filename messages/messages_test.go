@@ -0,0 +1,228 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+const textMessage = 1
+
+type fakeConn struct {
+	mux      sync.Mutex
+	messages []string
+	written  []string
+}
+
+func newFakeConn(n int) *fakeConn {
+	c := &fakeConn{}
+	for i := 0; i < n; i++ {
+		c.messages = append(c.messages, string(rune('a'+i)))
+	}
+
+	return c
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if len(c.messages) == 0 {
+		return 0, nil, io.EOF
+	}
+
+	m := c.messages[0]
+	c.messages = c.messages[1:]
+
+	return textMessage, []byte(m), nil
+}
+
+func (c *fakeConn) WriteMessage(_ int, data []byte) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.written = append(c.written, string(data))
+	return nil
+}
+
+func config(value int, interval time.Duration) token_bucket.Config {
+	rate := common.Rate{Value: value, Interval: interval}
+	return token_bucket.Config{Limit: rate, Refill: rate}
+}
+
+func readAll(c *LimitedConn) ([]string, error) {
+	var read []string
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			return read, err
+		}
+
+		read = append(read, string(p))
+	}
+}
+
+func TestLimitsBuilder_Build(t *testing.T) {
+	_, err := NewLimitsBuilder().Build()
+	assert.Error(t, err)
+}
+
+func TestLimitsBuilder_Build_FailsIfRateIsNotPositive(t *testing.T) {
+	_, err := NewLimitsBuilder().SetConnectionRate(config(1, 0)).Build()
+	assert.Error(t, err)
+
+	_, err = NewLimitsBuilder().SetConnectionRate(config(1, time.Minute)).SetWriteUserRate(config(0, time.Minute)).Build()
+	assert.Error(t, err)
+}
+
+func TestLimitedConn_Drop(t *testing.T) {
+	limits, err := NewLimitsBuilder().SetConnectionRate(config(2, time.Minute)).Build()
+	assert.NoError(t, err)
+
+	c := limits.Wrap(context.Background(), newFakeConn(5), "abc", nil)
+	read, err := readAll(c)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"a", "b"}, read)
+	assert.Equal(t, int64(3), c.Dropped())
+}
+
+func TestLimitedConn_Delay(t *testing.T) {
+	limits, err := NewLimitsBuilder().
+		SetConnectionRate(config(1, 20*time.Millisecond)).
+		SetAction(Delay).
+		Build()
+	assert.NoError(t, err)
+
+	c := limits.Wrap(context.Background(), newFakeConn(4), "abc", nil)
+
+	start := time.Now()
+	read, err := readAll(c)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, read)
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
+
+func TestLimitedConn_DelayHonoursContext(t *testing.T) {
+	limits, err := NewLimitsBuilder().SetConnectionRate(config(1, time.Hour)).SetAction(Delay).Build()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	c := limits.Wrap(ctx, newFakeConn(2), "abc", nil)
+	read, err := readAll(c)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, []string{"a"}, read)
+}
+
+func TestLimitedConn_Close(t *testing.T) {
+	limits, err := NewLimitsBuilder().
+		SetConnectionRate(config(2, time.Minute)).
+		SetAction(Close).
+		SetCloseCode(CloseTryAgainLater, "slow down").
+		Build()
+	assert.NoError(t, err)
+
+	var (
+		code   int
+		reason string
+	)
+	c := limits.Wrap(context.Background(), newFakeConn(5), "abc", func(c int, r string) error {
+		code, reason = c, r
+		return nil
+	})
+
+	read, err := readAll(c)
+	assert.True(t, errors.Is(err, ErrLimited))
+	assert.Equal(t, []string{"a", "b"}, read)
+	assert.Equal(t, CloseTryAgainLater, code)
+	assert.Equal(t, "slow down", reason)
+
+	_, _, err = c.ReadMessage()
+	assert.True(t, errors.Is(err, ErrLimited))
+}
+
+func TestLimitedConn_UserRateAcrossConnections(t *testing.T) {
+	limits, err := NewLimitsBuilder().
+		SetConnectionRate(config(3, time.Minute)).
+		SetUserRate(config(4, time.Minute)).
+		Build()
+	assert.NoError(t, err)
+
+	first, err := readAll(limits.Wrap(context.Background(), newFakeConn(5), "abc", nil))
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, first, 3)
+
+	// the user quota is shared by all the connections of the user
+	second := limits.Wrap(context.Background(), newFakeConn(5), "abc", nil)
+	read, err := readAll(second)
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, read, 1)
+	assert.Equal(t, int64(4), second.Dropped())
+
+	// other users have their own quota
+	read, err = readAll(limits.Wrap(context.Background(), newFakeConn(5), "def", nil))
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, read, 3)
+}
+
+func TestLimitedConn_WritesAreNotLimitedByReadRates(t *testing.T) {
+	limits, err := NewLimitsBuilder().SetConnectionRate(config(1, time.Minute)).Build()
+	assert.NoError(t, err)
+
+	conn := newFakeConn(0)
+	c := limits.Wrap(context.Background(), conn, "abc", nil)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, c.WriteMessage(textMessage, []byte("x")))
+	}
+
+	assert.Len(t, conn.written, 3)
+}
+
+func TestLimitedConn_LimitsWrites(t *testing.T) {
+	limits, err := NewLimitsBuilder().
+		SetWriteConnectionRate(config(2, time.Minute)).
+		SetAction(Close).
+		Build()
+	assert.NoError(t, err)
+
+	conn := newFakeConn(3)
+	var closed bool
+	c := limits.Wrap(context.Background(), conn, "abc", func(int, string) error {
+		closed = true
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, c.WriteMessage(textMessage, []byte("x")))
+	}
+
+	// reads are not limited by write rates
+	read, err := readAll(c)
+	assert.Len(t, read, 3)
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.ErrorIs(t, c.WriteMessage(textMessage, []byte("x")), ErrLimited)
+	assert.True(t, closed)
+	assert.Len(t, conn.written, 2)
+}
+
+func TestLimitedConn_DropsExcessWrites(t *testing.T) {
+	limits, err := NewLimitsBuilder().SetWriteUserRate(config(1, time.Minute)).Build()
+	assert.NoError(t, err)
+
+	conn := newFakeConn(0)
+	for i := 0; i < 2; i++ {
+		c := limits.Wrap(context.Background(), conn, "abc", nil)
+		assert.NoError(t, c.WriteMessage(textMessage, []byte("x")))
+	}
+
+	assert.Len(t, conn.written, 1)
+}
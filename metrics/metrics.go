@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/composite"
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the algorithms, used as values of the algorithm label.
+const (
+	TokenBucket   = "token_bucket"
+	LeakingBucket = "leaking_bucket"
+	Calendar      = "calendar"
+	Gossip        = "gossip"
+	Composite     = "composite"
+)
+
+// Other is the value of the path label of requests that do not match any known route.
+const Other = "other"
+
+type (
+	// PathLabel returns the value of the path label of a request.
+	PathLabel func(r *http.Request) string
+
+	// Queue is implemented by rate limiters backed by a queue, such as leaking_bucket.RateLimiter.
+	Queue interface {
+		// QueueDepth returns the number of requests that can currently be served.
+		QueueDepth() int
+	}
+
+	// Sized is implemented by stores that can report how many keys they are tracking, such as
+	// token_bucket.MemoryStore.
+	Sized interface {
+		// Len returns the number of tracked keys.
+		Len() int
+	}
+
+	// Collector is a prometheus.Collector that exposes the following metrics:
+	//   - ratelimit_decisions_total{path, algorithm, outcome}: the number of decisions taken by instrumented limiters;
+	//   - ratelimit_retry_after_seconds{path, algorithm}: the time rejected requests are told to wait before retrying,
+	//     i.e. until their quota is refilled;
+	//   - ratelimit_queue_depth{path}: the number of requests that leaking bucket queues can currently serve;
+	//   - ratelimit_tracked_keys{store}: the number of keys (e.g. users and paths) tracked by instrumented stores;
+	//   - ratelimit_store_duration_seconds{store, operation}: the latency of the operations of instrumented stores;
+	//   - ratelimit_store_errors_total{store, operation}: the number of failed operations of instrumented stores.
+	//
+	// There is no metric of the duration of refills: token buckets are refilled lazily, as part of the store
+	// operations consuming their tokens, so refills have no duration of their own and their cost is included in
+	// ratelimit_store_duration_seconds. How long users wait for their quota to be refilled is measured by
+	// ratelimit_retry_after_seconds instead.
+	//
+	// It needs to be registered, e.g. using prometheus.MustRegister, to be exposed.
+	Collector struct {
+		label         PathLabel
+		routes        *concurrent.Set[string]
+		decisions     *prometheus.CounterVec
+		retryAfter    *prometheus.HistogramVec
+		storeDuration *prometheus.HistogramVec
+		storeErrors   *prometheus.CounterVec
+		queueDepth    *prometheus.Desc
+		trackedKeys   *prometheus.Desc
+		queues        *concurrent.Map[string, Queue]
+		stores        *concurrent.Map[string, Sized]
+	}
+
+	// Routed is implemented by rate limiters that know which paths they limit, such as token_bucket.RateLimiter.
+	Routed interface {
+		// Paths returns all configured paths, along with their limits.
+		Paths() map[token_bucket.Path]token_bucket.Config
+	}
+
+	limiter struct {
+		c         *Collector
+		algorithm string
+		next      composite.Limiter
+	}
+)
+
+// NewCollector returns a new collector. By default, requests are labeled with their URL path if it is a known route
+// (see AddRoutes), or with Other otherwise, so that the number of time series is bounded.
+func NewCollector() *Collector {
+	c := &Collector{
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_decisions_total",
+			Help: "Number of rate-limiting decisions, by outcome.",
+		}, []string{"path", "algorithm", "outcome"}),
+		retryAfter: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimit_retry_after_seconds",
+			Help:    "Time rejected requests have to wait before their quota is refilled.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}, []string{"path", "algorithm"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimit_store_duration_seconds",
+			Help:    "Latency of store operations.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"store", "operation"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_store_errors_total",
+			Help: "Number of failed store operations.",
+		}, []string{"store", "operation"}),
+		queueDepth: prometheus.NewDesc(
+			"ratelimit_queue_depth",
+			"Number of requests leaking bucket queues can currently serve.",
+			[]string{"path"},
+			nil,
+		),
+		trackedKeys: prometheus.NewDesc(
+			"ratelimit_tracked_keys",
+			"Number of keys tracked by stores.",
+			[]string{"store"},
+			nil,
+		),
+		routes: concurrent.NewSet[string](),
+		queues: concurrent.NewMap[string, Queue](),
+		stores: concurrent.NewMap[string, Sized](),
+	}
+	c.label = c.route
+
+	return c
+}
+
+// SetPathLabel sets the function returning the value of the path label of requests. Since each distinct value creates
+// new time series, it should map requests to a bounded set of values, e.g. their route rather than their URL path, if
+// the latter contains IDs. It must be invoked before the collector is used.
+func (c *Collector) SetPathLabel(label PathLabel) *Collector {
+	c.label = label
+	return c
+}
+
+// AddRoutes adds paths to the known routes, which requests are labeled with by default.
+func (c *Collector) AddRoutes(paths ...string) *Collector {
+	for _, p := range paths {
+		c.routes.Put(p)
+	}
+
+	return c
+}
+
+// route returns the URL path of the request if it is a known route, or Other otherwise.
+func (c *Collector) route(r *http.Request) string {
+	if c.routes.Contains(r.URL.Path) {
+		return r.URL.Path
+	}
+
+	return Other
+}
+
+// Describe sends the descriptors of all metrics to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.decisions.Describe(ch)
+	c.retryAfter.Describe(ch)
+	c.storeDuration.Describe(ch)
+	c.storeErrors.Describe(ch)
+	ch <- c.queueDepth
+	ch <- c.trackedKeys
+}
+
+// Collect sends all metrics to ch, reading the depth of queues and the number of tracked keys at collection time.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.decisions.Collect(ch)
+	c.retryAfter.Collect(ch)
+	c.storeDuration.Collect(ch)
+	c.storeErrors.Collect(ch)
+
+	for t := range c.queues.Iterate() {
+		ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(t.Value.QueueDepth()), t.Key)
+	}
+
+	for t := range c.stores.Iterate() {
+		ch <- prometheus.MustNewConstMetric(c.trackedKeys, prometheus.GaugeValue, float64(t.Value.Len()), t.Key)
+	}
+}
+
+// Instrument returns a limiter that records the decisions taken by l, labeled with the provided algorithm. If l
+// implements Routed, its paths are added to the known routes.
+// Middlewares accepting an observer (e.g. token_bucket.RateLimiterBuilder.SetObserver) can record their decisions
+// directly, without being instrumented: limiters should not be both, or their decisions are recorded twice.
+func (c *Collector) Instrument(algorithm string, l composite.Limiter) composite.Limiter {
+	if routed, ok := l.(Routed); ok {
+		for p := range routed.Paths() {
+			c.routes.Put(string(p))
+		}
+	}
+
+	return &limiter{c: c, algorithm: algorithm, next: l}
+}
+
+// AddQueue exposes the depth of the queue of a rate limiter serving the provided path.
+func (c *Collector) AddQueue(path string, q Queue) *Collector {
+	c.queues.Put(path, q)
+	return c
+}
+
+// Observe records a decision taken on a request, labeled with the provided route or, if empty, with the path label of
+// the request. It implements common.Observer.
+func (c *Collector) Observe(r *http.Request, algorithm, route string, d common.Decision) {
+	path := route
+	if path == "" {
+		path = c.label(r)
+	}
+	c.decisions.WithLabelValues(path, algorithm, d.Outcome.String()).Inc()
+
+	if !d.Allowed() && d.RetryAfter > 0 {
+		c.retryAfter.WithLabelValues(path, algorithm).Observe(d.RetryAfter.Seconds())
+	}
+}
+
+// observeStore records the outcome of a store operation that started at the provided time.
+func (c *Collector) observeStore(store, operation string, start time.Time, err error) {
+	c.storeDuration.WithLabelValues(store, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.storeErrors.WithLabelValues(store, operation).Inc()
+	}
+}
+
+// Take consumes a unit of quota from the instrumented limiter, recording its decision.
+func (l *limiter) Take(r *http.Request) common.Decision {
+	d := l.next.Take(r)
+	l.c.Observe(r, l.algorithm, "", d)
+
+	return d
+}
+
+// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d.
+func (l *limiter) Refund(r *http.Request, d common.Decision) {
+	l.next.Refund(r, d)
+}
+
+// Stop stops the instrumented limiter.
+func (l *limiter) Stop() {
+	l.next.Stop()
+}
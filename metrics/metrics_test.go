@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/config"
+	"github.com/fedragon/rate-limiter/leaking_bucket"
+	"github.com/fedragon/rate-limiter/test"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingStore struct {
+	token_bucket.Store
+}
+
+func (failingStore) Take(context.Context, token_bucket.Key, token_bucket.Config, int) (token_bucket.Bucket, bool, error) {
+	return token_bucket.Bucket{}, false, errors.New("unavailable")
+}
+
+func request(path, user string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("X-User-ID", user)
+
+	return r
+}
+
+func TestCollector_Decisions(t *testing.T) {
+	c := NewCollector()
+	store := token_bucket.NewMemoryStore()
+
+	rl, err := token_bucket.NewRateLimiterBuilder().
+		SetLimit("/a", token_bucket.Config{
+			Limit:  common.Rate{Value: 1, Interval: time.Minute},
+			Refill: common.Rate{Value: 1, Interval: time.Minute},
+		}).
+		RegisterUser("alice").
+		RegisterUser("bob").
+		SetStore(c.InstrumentStore("memory", store)).
+		Build()
+	assert.NoError(t, err)
+
+	l := c.Instrument(TokenBucket, rl)
+	defer l.Stop()
+
+	assert.True(t, l.Take(request("/a", "alice")).Allowed())
+	assert.False(t, l.Take(request("/a", "alice")).Allowed())
+	assert.True(t, l.Take(request("/a", "bob")).Allowed())
+	assert.False(t, l.Take(request("/a", "carol")).Allowed())
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ratelimit_decisions_total Number of rate-limiting decisions, by outcome.
+# TYPE ratelimit_decisions_total counter
+ratelimit_decisions_total{algorithm="token_bucket",outcome="allowed",path="/a"} 2
+ratelimit_decisions_total{algorithm="token_bucket",outcome="denied",path="/a"} 1
+ratelimit_decisions_total{algorithm="token_bucket",outcome="unknown",path="/a"} 1
+# HELP ratelimit_tracked_keys Number of keys tracked by stores.
+# TYPE ratelimit_tracked_keys gauge
+ratelimit_tracked_keys{store="memory"} 2
+`), "ratelimit_decisions_total", "ratelimit_tracked_keys"))
+
+	assert.Equal(t, 1, testutil.CollectAndCount(c, "ratelimit_retry_after_seconds"))
+	// only take operations have been performed, since unknown users are rejected before accessing the store
+	assert.Equal(t, 1, testutil.CollectAndCount(c, "ratelimit_store_duration_seconds"))
+}
+
+func TestCollector_QueueDepth(t *testing.T) {
+	c := NewCollector().SetPathLabel(func(*http.Request) string { return "uploads" })
+
+	rl := leaking_bucket.NewRateLimiter(&common.Rate{Value: 3, Interval: time.Hour})
+	c.AddQueue("uploads", rl)
+
+	l := c.Instrument(LeakingBucket, rl)
+	defer l.Stop()
+
+	assert.True(t, l.Take(request("/upload/1", "")).Allowed())
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ratelimit_decisions_total Number of rate-limiting decisions, by outcome.
+# TYPE ratelimit_decisions_total counter
+ratelimit_decisions_total{algorithm="leaking_bucket",outcome="allowed",path="uploads"} 1
+# HELP ratelimit_queue_depth Number of requests leaking bucket queues can currently serve.
+# TYPE ratelimit_queue_depth gauge
+ratelimit_queue_depth{path="uploads"} 2
+`), "ratelimit_decisions_total", "ratelimit_queue_depth"))
+}
+
+func TestCollector_LabelsUnknownPathsAsOther(t *testing.T) {
+	c := NewCollector().AddRoutes("/uploads")
+
+	rl := leaking_bucket.NewRateLimiter(&common.Rate{Value: 3, Interval: time.Hour})
+	l := c.Instrument(LeakingBucket, rl)
+	defer l.Stop()
+
+	l.Take(request("/uploads", ""))
+	l.Take(request("/uploads/1", ""))
+	l.Take(request("/uploads/2", ""))
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ratelimit_decisions_total Number of rate-limiting decisions, by outcome.
+# TYPE ratelimit_decisions_total counter
+ratelimit_decisions_total{algorithm="leaking_bucket",outcome="allowed",path="/uploads"} 1
+ratelimit_decisions_total{algorithm="leaking_bucket",outcome="allowed",path="other"} 2
+`), "ratelimit_decisions_total"))
+}
+
+func TestCollector_ObservesMiddlewares(t *testing.T) {
+	c := NewCollector()
+
+	rl, err := token_bucket.NewRateLimiterBuilder().
+		SetLimit("/a", token_bucket.Config{
+			Limit:  common.Rate{Value: 1, Interval: time.Minute},
+			Refill: common.Rate{Value: 1, Interval: time.Minute},
+		}).
+		RegisterUser("alice").
+		SetObserver(c).
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	cfg, err := config.Parse("limits.yaml", []byte(`version: 1
+tiers:
+  free:
+    users: [alice]
+routes:
+  - path: /b
+    methods: [POST]
+    limits:
+      free: {limit: 1, interval: 1h}
+`))
+	assert.NoError(t, err)
+	m, err := cfg.Build(nil)
+	assert.NoError(t, err)
+	defer m.Stop()
+	m.SetObserver(c)
+
+	// requests pass through both middlewares: those not limited by the first one are not observed by it
+	h := m.Handle(rl.Handle(test.ItsOK()))
+	for _, r := range []*http.Request{request("/a", "alice"), request("/a", "alice"), request("/a/1", "alice")} {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	r := request("/b", "alice")
+	r.Method = http.MethodPost
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ratelimit_decisions_total Number of rate-limiting decisions, by outcome.
+# TYPE ratelimit_decisions_total counter
+ratelimit_decisions_total{algorithm="token_bucket",outcome="allowed",path="/a"} 1
+ratelimit_decisions_total{algorithm="token_bucket",outcome="allowed",path="POST /b"} 1
+ratelimit_decisions_total{algorithm="token_bucket",outcome="denied",path="/a"} 1
+ratelimit_decisions_total{algorithm="token_bucket",outcome="unknown",path="other"} 2
+`), "ratelimit_decisions_total"))
+}
+
+func TestCollector_StoreErrors(t *testing.T) {
+	c := NewCollector()
+	s := c.InstrumentStore("redis", failingStore{})
+
+	_, _, err := s.Take(context.Background(), token_bucket.Key{}, token_bucket.Config{}, 1)
+	assert.Error(t, err)
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ratelimit_store_errors_total Number of failed store operations.
+# TYPE ratelimit_store_errors_total counter
+ratelimit_store_errors_total{operation="take",store="redis"} 1
+`), "ratelimit_store_errors_total"))
+}
+
+func TestInstrumentStore_KeepsSnapshotter(t *testing.T) {
+	c := NewCollector()
+
+	_, ok := c.InstrumentStore("memory", token_bucket.NewMemoryStore()).(token_bucket.Snapshotter)
+	assert.True(t, ok)
+
+	_, ok = c.InstrumentStore("other", failingStore{}).(token_bucket.Snapshotter)
+	assert.False(t, ok)
+}
+
+func TestCollector_Register(t *testing.T) {
+	assert.NoError(t, prometheus.NewRegistry().Register(NewCollector()))
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+type (
+	store struct {
+		c    *Collector
+		name string
+		next token_bucket.Store
+	}
+
+	snapshotStore struct {
+		*store
+		token_bucket.Snapshotter
+	}
+)
+
+// InstrumentStore returns a store that records the latency and the errors of the operations of s, labeled with the
+// provided name. If s implements Sized, the number of keys it tracks is exposed as well.
+// The returned store implements token_bucket.Snapshotter if s does.
+func (c *Collector) InstrumentStore(name string, s token_bucket.Store) token_bucket.Store {
+	if sized, ok := s.(Sized); ok {
+		c.stores.Put(name, sized)
+	}
+
+	instrumented := &store{c: c, name: name, next: s}
+	if snapshotter, ok := s.(token_bucket.Snapshotter); ok {
+		return &snapshotStore{store: instrumented, Snapshotter: snapshotter}
+	}
+
+	return instrumented
+}
+
+// Take refills the bucket identified by key according to cfg, then consumes n tokens from it if available.
+func (s *store) Take(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, bool, error) {
+	start := time.Now()
+	b, taken, err := s.next.Take(ctx, key, cfg, n)
+	s.c.observeStore(s.name, "take", start, err)
+
+	return b, taken, err
+}
+
+// Refill adds n tokens to the bucket identified by key, without exceeding its limit.
+func (s *store) Refill(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	start := time.Now()
+	b, err := s.next.Refill(ctx, key, cfg, n)
+	s.c.observeStore(s.name, "refill", start, err)
+
+	return b, err
+}
+
+// Set refills the bucket identified by key according to cfg, then sets its number of tokens to n.
+func (s *store) Set(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	start := time.Now()
+	b, err := s.next.Set(ctx, key, cfg, n)
+	s.c.observeStore(s.name, "set", start, err)
+
+	return b, err
+}
+
+// Get returns the current state of the bucket identified by key, refilled according to cfg.
+func (s *store) Get(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) (token_bucket.Bucket, error) {
+	start := time.Now()
+	b, err := s.next.Get(ctx, key, cfg)
+	s.c.observeStore(s.name, "get", start, err)
+
+	return b, err
+}
+
+// Reset fills up the bucket identified by key.
+func (s *store) Reset(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) error {
+	start := time.Now()
+	err := s.next.Reset(ctx, key, cfg)
+	s.c.observeStore(s.name, "reset", start, err)
+
+	return err
+}
@@ -0,0 +1,191 @@
+package penalty
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/fedragon/rate-limiter/concurrent"
+)
+
+type (
+	// Policy defines when keys are banned and for how long.
+	Policy struct {
+		// Violations is the number of denied requests, within Window, after which a key is banned.
+		Violations int
+		Window     time.Duration
+		// BanDuration is the duration of the first ban of a key: each subsequent ban lasts twice as long as the previous
+		// one, up to MaxBanDuration (if set).
+		BanDuration    time.Duration
+		MaxBanDuration time.Duration
+	}
+
+	// Ban represents a key that is currently banned.
+	Ban struct {
+		Key   string    `json:"key"`
+		Until time.Time `json:"until"`
+		// Count is the number of times the key has been banned, including the current one.
+		Count int `json:"count"`
+	}
+
+	record struct {
+		violations []time.Time
+		bans       int
+		since      time.Time
+		until      time.Time
+	}
+
+	// Box keeps track of rate limit violations and temporarily bans keys that repeatedly exceed their limits.
+	// Keys are forgotten, along with their past bans, once they have no violations within the window and have not been
+	// banned for as long as their last ban lasted: the duration of their next ban therefore decreases again.
+	Box struct {
+		policy    Policy
+		records   *concurrent.Map[string, record]
+		lastPrune atomic.Int64
+		now       func() time.Time
+	}
+)
+
+// NewBox returns a new penalty box enforcing the provided policy.
+// It returns an error if the policy is invalid.
+func NewBox(policy Policy) (*Box, error) {
+	if policy.Violations <= 0 {
+		return nil, errors.New("violations must be positive")
+	}
+
+	if policy.Window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+
+	if policy.BanDuration <= 0 {
+		return nil, errors.New("ban duration must be positive")
+	}
+
+	if policy.MaxBanDuration != 0 && policy.MaxBanDuration < policy.BanDuration {
+		return nil, errors.New("max ban duration must not be shorter than the ban duration")
+	}
+
+	return &Box{
+		policy:  policy,
+		records: concurrent.NewMap[string, record](),
+		now:     time.Now,
+	}, nil
+}
+
+// expired returns true if the record can be forgotten.
+func (b *Box) expired(r record, now time.Time) bool {
+	for _, v := range r.violations {
+		if now.Sub(v) < b.policy.Window {
+			return false
+		}
+	}
+
+	return !now.Before(r.until.Add(r.until.Sub(r.since)))
+}
+
+// prune forgets expired records, at most once per window.
+func (b *Box) prune(now time.Time) {
+	last := b.lastPrune.Load()
+	if now.Sub(time.Unix(0, last)) < b.policy.Window || !b.lastPrune.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	b.records.DeleteIf(func(_ string, r record) bool {
+		return b.expired(r, now)
+	})
+}
+
+// Banned returns true if the key is currently banned, along with the time when the ban expires.
+func (b *Box) Banned(key string) (time.Time, bool) {
+	r, ok := b.records.Get(key)
+	if !ok || !b.now().Before(r.until) {
+		return time.Time{}, false
+	}
+
+	return r.until, true
+}
+
+// Violation records a violation by the key, banning it if it has exceeded the allowed number of violations.
+// It returns true if the key has been banned as a consequence, along with the time when the ban expires.
+func (b *Box) Violation(key string) (time.Time, bool) {
+	now := b.now()
+	b.prune(now)
+
+	var banned bool
+	r := b.records.Update(key, func(r record, _ bool) record {
+		if b.expired(r, now) {
+			r = record{}
+		}
+
+		violations := []time.Time{now}
+		for _, v := range r.violations {
+			if now.Sub(v) < b.policy.Window {
+				violations = append(violations, v)
+			}
+		}
+		r.violations = violations
+
+		if len(r.violations) >= b.policy.Violations && !now.Before(r.until) {
+			r.violations = nil
+			r.bans++
+			r.since = now
+			r.until = now.Add(b.banDuration(r.bans))
+			banned = true
+		}
+
+		return r
+	})
+
+	return r.until, banned
+}
+
+func (b *Box) banDuration(count int) time.Duration {
+	duration := b.policy.BanDuration
+	for i := 1; i < count; i++ {
+		duration *= 2
+
+		if b.policy.MaxBanDuration > 0 && duration >= b.policy.MaxBanDuration {
+			return b.policy.MaxBanDuration
+		}
+	}
+
+	return duration
+}
+
+// Bans returns all the currently banned keys, sorted by key.
+func (b *Box) Bans() []Ban {
+	now := b.now()
+	var bans []Ban
+
+	for t := range b.records.Iterate() {
+		if now.Before(t.Value.until) {
+			bans = append(bans, Ban{Key: t.Key, Until: t.Value.until, Count: t.Value.bans})
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+
+	return bans
+}
+
+// Lift lifts the ban on a key, if any, and forgets all its past violations and bans.
+func (b *Box) Lift(key string) {
+	b.records.Delete(key)
+}
+
+// Restore restores a ban, e.g. from a snapshot, unless it has already expired.
+func (b *Box) Restore(ban Ban) {
+	if !b.now().Before(ban.Until) {
+		return
+	}
+
+	b.records.Update(ban.Key, func(r record, _ bool) record {
+		r.bans = ban.Count
+		r.since = ban.Until.Add(-b.banDuration(ban.Count))
+		r.until = ban.Until
+		return r
+	})
+}
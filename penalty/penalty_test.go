@@ -0,0 +1,165 @@
+package penalty
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	key = "0-0-0-0-0"
+)
+
+var (
+	policy = Policy{
+		Violations:     2,
+		Window:         time.Minute,
+		BanDuration:    time.Minute,
+		MaxBanDuration: 3 * time.Minute,
+	}
+)
+
+func newBox(t *testing.T, now *time.Time) *Box {
+	box, err := NewBox(policy)
+	assert.NoError(t, err)
+	box.now = func() time.Time { return *now }
+
+	return box
+}
+
+func TestNewBox_FailsIfPolicyIsInvalid(t *testing.T) {
+	invalid := []Policy{
+		{Window: time.Minute, BanDuration: time.Minute},
+		{Violations: 1, BanDuration: time.Minute},
+		{Violations: 1, Window: time.Minute},
+		{Violations: 1, Window: time.Minute, BanDuration: time.Minute, MaxBanDuration: time.Second},
+	}
+
+	for _, p := range invalid {
+		_, err := NewBox(p)
+		assert.Error(t, err)
+	}
+}
+
+func TestBox_Violation_BansAfterTooManyViolations(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+
+	_, banned := box.Violation(key)
+	assert.False(t, banned)
+	_, banned = box.Banned(key)
+	assert.False(t, banned)
+
+	until, banned := box.Violation(key)
+	assert.True(t, banned)
+	assert.Equal(t, now.Add(time.Minute), until)
+
+	until, banned = box.Banned(key)
+	assert.True(t, banned)
+	assert.Equal(t, now.Add(time.Minute), until)
+
+	now = now.Add(time.Minute)
+	_, banned = box.Banned(key)
+	assert.False(t, banned)
+}
+
+func TestBox_Violation_IgnoresViolationsOutsideWindow(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+
+	box.Violation(key)
+	now = now.Add(time.Minute)
+	_, banned := box.Violation(key)
+
+	assert.False(t, banned)
+}
+
+func TestBox_Violation_EscalatesBanDuration(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+
+	for _, duration := range expected {
+		box.Violation(key)
+		until, banned := box.Violation(key)
+
+		assert.True(t, banned)
+		assert.Equal(t, now.Add(duration), until)
+		now = until
+	}
+}
+
+func TestBox_Violation_ForgetsPastBans(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+
+	box.Violation(key)
+	until, _ := box.Violation(key)
+
+	// the key has not been banned for as long as its last ban lasted
+	now = until.Add(time.Minute)
+	box.Violation(key)
+	until, banned := box.Violation(key)
+
+	assert.True(t, banned)
+	assert.Equal(t, now.Add(time.Minute), until)
+}
+
+func TestBox_Violation_PrunesExpiredKeys(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+
+	box.Violation("a")
+	box.Violation("b")
+	box.Violation("b")
+
+	now = now.Add(3 * time.Minute)
+	box.Violation(key)
+
+	assert.Equal(t, 1, box.records.Size())
+}
+
+func TestBox_Bans(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+
+	box.Violation("b")
+	box.Violation("b")
+	box.Violation("a")
+	box.Violation("a")
+	box.Violation("c")
+
+	assert.Equal(
+		t,
+		[]Ban{
+			{Key: "a", Until: now.Add(time.Minute), Count: 1},
+			{Key: "b", Until: now.Add(time.Minute), Count: 1},
+		},
+		box.Bans(),
+	)
+}
+
+func TestBox_Lift(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+	box.Violation(key)
+	box.Violation(key)
+
+	box.Lift(key)
+
+	_, banned := box.Banned(key)
+	assert.False(t, banned)
+	assert.Empty(t, box.Bans())
+}
+
+func TestBox_Restore(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	box := newBox(t, &now)
+	ban := Ban{Key: key, Until: now.Add(time.Minute), Count: 2}
+
+	box.Restore(ban)
+	box.Restore(Ban{Key: "expired", Until: now, Count: 1})
+
+	assert.Equal(t, []Ban{ban}, box.Bans())
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/fedragon/rate-limiter/logging"
 	"go.uber.org/zap"
+	"sync"
 	"time"
 
 	"github.com/fedragon/rate-limiter/common"
@@ -18,6 +19,9 @@ type Queue struct {
 	cancel  context.CancelFunc
 	content chan struct{}
 	rate    *common.Rate
+	// mux guards closing content, so that Push never sends on a closed channel.
+	mux    sync.Mutex
+	closed bool
 }
 
 // Rate returns the queue refill rate.
@@ -53,7 +57,10 @@ func (q *Queue) Start() {
 		select {
 		case <-q.ctx.Done():
 			log.Debug("stopping queue")
+			q.mux.Lock()
+			q.closed = true
 			close(q.content)
+			q.mux.Unlock()
 			return
 		case <-t.C:
 			for i := 0; i < q.rate.Value; i++ {
@@ -73,6 +80,11 @@ func (q *Queue) Stop() {
 	q.cancel()
 }
 
+// Len returns the number of values currently available in the queue.
+func (q *Queue) Len() int {
+	return len(q.content)
+}
+
 // Pop returns true if there is an available value in the queue, false otherwise.
 func (q *Queue) Pop() bool {
 	select {
@@ -82,3 +94,20 @@ func (q *Queue) Pop() bool {
 		return false
 	}
 }
+
+// Push puts back a value in the queue, returning true if it succeeded or false if the queue is already full.
+func (q *Queue) Push() bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.closed || q.ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case q.content <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
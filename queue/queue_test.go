@@ -13,7 +13,8 @@ import (
 func TestQueue_Start_RefillsAtExpectedRate(t *testing.T) {
 	var total atomic.Int64
 	var expected int64 = 6 // 3 prebuffered at creation time + 3 from the refiller execution
-	ctx, cancel := context.WithTimeout(context.Background(), 260*time.Millisecond)
+	// the deadline leaves half an interval for the refill, since tickers may fire late on busy machines
+	ctx, cancel := context.WithTimeout(context.Background(), 375*time.Millisecond)
 	defer cancel()
 	q := NewQueue(ctx, &common.Rate{Value: 3, Interval: 250 * time.Millisecond})
 
@@ -22,7 +23,11 @@ func TestQueue_Start_RefillsAtExpectedRate(t *testing.T) {
 			select {
 			case <-ctx.Done():
 				return
-			case <-q.content:
+			case _, more := <-q.content:
+				// the channel is closed once the queue stops, and reading from it would then always succeed
+				if !more {
+					return
+				}
 				total.Add(1)
 			default:
 			}
@@ -47,3 +52,32 @@ func TestQueue_Stop_ClosesUnderlyingChannel(t *testing.T) {
 	default:
 	}
 }
+
+func TestQueue_Push_PutsBackPoppedValue(t *testing.T) {
+	q := NewQueue(context.Background(), &common.Rate{Value: 1, Interval: time.Second})
+
+	assert.False(t, q.Push())
+	assert.True(t, q.Pop())
+	assert.False(t, q.Pop())
+	assert.True(t, q.Push())
+	assert.True(t, q.Pop())
+}
+
+func TestQueue_Push_AfterStop(t *testing.T) {
+	q := NewQueue(context.Background(), &common.Rate{Value: 1, Interval: time.Second})
+	done := make(chan struct{})
+	go func() {
+		q.Start()
+		close(done)
+	}()
+
+	assert.True(t, q.Pop())
+	go q.Stop()
+	for i := 0; i < 1000; i++ {
+		q.Push()
+		q.Pop()
+	}
+
+	<-done
+	assert.False(t, q.Push())
+}
@@ -0,0 +1,141 @@
+package redis_store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// script refills and then updates a bucket, according to the requested operation, using the Redis server time so that
+// all clients agree on it. Timestamps are expressed in microseconds.
+// Buckets expire once they would be full again, since a missing bucket is considered full.
+//
+// KEYS[1]: the bucket key
+// ARGV: limit, refill value, refill interval, number of tokens, operation (take, refill, set, get or reset)
+// Returns: the number of tokens, the last refill timestamp and 1 if the tokens have been taken (0 otherwise)
+var script = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local limit = tonumber(ARGV[1])
+local refill = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local op = ARGV[5]
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil or op == 'reset' then
+	tokens = limit
+	last = now
+end
+
+if interval > 0 and now > last then
+	local intervals = math.floor((now - last) / interval)
+	if intervals > 0 then
+		last = last + intervals * interval
+		tokens = math.min(limit, tokens + intervals * refill)
+	end
+end
+
+local taken = 0
+if op == 'take' then
+	if tokens >= n then
+		tokens = tokens - n
+		taken = 1
+	end
+elseif op == 'refill' then
+	tokens = math.min(limit, tokens + n)
+elseif op == 'set' then
+	tokens = n
+end
+
+if op ~= 'get' then
+	-- numbers are formatted explicitly, since Lua would otherwise convert timestamps to strings in scientific notation
+	redis.call('HSET', KEYS[1], 'tokens', string.format('%d', tokens), 'last', string.format('%d', last))
+	if refill > 0 and interval > 0 then
+		local ttl = (math.ceil((limit - tokens) / refill) + 1) * interval
+		redis.call('PEXPIRE', KEYS[1], math.ceil(ttl / 1000))
+	end
+end
+
+return {tokens, last, taken}
+`)
+
+// Store is a token_bucket.Store that keeps all buckets in Redis, so that they can be shared by several rate limiter
+// instances. Each operation is performed atomically by a Lua script, which requires Redis 5 or later.
+type Store struct {
+	client redis.Scripter
+	prefix string
+}
+
+// NewStore returns a new store that keeps buckets in Redis, using the provided prefix for all its keys.
+func NewStore(client redis.Scripter, prefix string) *Store {
+	return &Store{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (s *Store) key(key token_bucket.Key) string {
+	// the path length makes the key unambiguous, even if the path contains the separator
+	return fmt.Sprintf("%s:%d:%s:%s", s.prefix, len(key.Path), key.Path, key.UserID)
+}
+
+func (s *Store) run(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int, op string) (token_bucket.Bucket, bool, error) {
+	res, err := script.Run(
+		ctx,
+		s.client,
+		[]string{s.key(key)},
+		cfg.Limit.Value,
+		cfg.Refill.Value,
+		cfg.Refill.Interval.Microseconds(),
+		n,
+		op,
+	).Int64Slice()
+	if err != nil {
+		return token_bucket.Bucket{}, false, err
+	}
+
+	if len(res) != 3 {
+		return token_bucket.Bucket{}, false, fmt.Errorf("unexpected script result: %v", res)
+	}
+
+	return token_bucket.Bucket{
+		Tokens:     int(res[0]),
+		LastRefill: time.UnixMicro(res[1]),
+	}, res[2] == 1, nil
+}
+
+// Take refills the bucket identified by key according to cfg, then consumes n tokens from it if available.
+func (s *Store) Take(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, bool, error) {
+	return s.run(ctx, key, cfg, n, "take")
+}
+
+// Refill adds n tokens to the bucket identified by key, without exceeding its limit.
+func (s *Store) Refill(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	b, _, err := s.run(ctx, key, cfg, n, "refill")
+	return b, err
+}
+
+// Set refills the bucket identified by key according to cfg, then sets its number of tokens to n.
+func (s *Store) Set(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config, n int) (token_bucket.Bucket, error) {
+	b, _, err := s.run(ctx, key, cfg, n, "set")
+	return b, err
+}
+
+// Get returns the current state of the bucket identified by key, refilled according to cfg.
+func (s *Store) Get(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) (token_bucket.Bucket, error) {
+	b, _, err := s.run(ctx, key, cfg, 0, "get")
+	return b, err
+}
+
+// Reset fills up the bucket identified by key.
+func (s *Store) Reset(ctx context.Context, key token_bucket.Key, cfg token_bucket.Config) error {
+	_, _, err := s.run(ctx, key, cfg, 0, "reset")
+	return err
+}
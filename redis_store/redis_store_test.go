@@ -0,0 +1,157 @@
+package redis_store
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	route  = "/bar"
+	userID = "0-0-0-0-0"
+)
+
+var (
+	key = token_bucket.Key{UserID: userID, Path: route}
+	cfg = token_bucket.Config{
+		Limit:  common.Rate{Value: 3, Interval: time.Minute},
+		Refill: common.Rate{Value: 1, Interval: time.Minute},
+	}
+)
+
+func newStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewStore(client, "test"), server
+}
+
+func TestStore_Take(t *testing.T) {
+	store, server := newStore(t)
+	now := time.Date(2022, 10, 5, 13, 0, 0, 123000, time.UTC)
+	server.SetTime(now)
+	ctx := context.Background()
+
+	b, taken, err := store.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, 1, b.Tokens)
+	assert.True(t, now.Equal(b.LastRefill))
+
+	b, taken, err = store.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.False(t, taken)
+	assert.Equal(t, 1, b.Tokens)
+
+	server.SetTime(now.Add(time.Minute + time.Second))
+	b, taken, err = store.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, 0, b.Tokens)
+	assert.True(t, now.Add(time.Minute).Equal(b.LastRefill))
+}
+
+func TestStore_Refill(t *testing.T) {
+	store, server := newStore(t)
+	server.SetTime(time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	_, _, _ = store.Take(ctx, key, cfg, 3)
+	b, err := store.Refill(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+
+	b, err = store.Refill(ctx, key, cfg, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Limit.Value, b.Tokens)
+}
+
+func TestStore_GetAndReset(t *testing.T) {
+	store, server := newStore(t)
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	server.SetTime(now)
+	ctx := context.Background()
+
+	b, err := store.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Limit.Value, b.Tokens)
+	assert.False(t, server.Exists(store.key(key)))
+
+	_, _, _ = store.Take(ctx, key, cfg, 3)
+	b, err = store.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Tokens)
+
+	assert.NoError(t, store.Reset(ctx, key, cfg))
+	b, err = store.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Limit.Value, b.Tokens)
+}
+
+func TestStore_Set(t *testing.T) {
+	store, server := newStore(t)
+	server.SetTime(time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	b, err := store.Set(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+
+	b, err = store.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+	assert.Equal(t, 3*time.Minute, server.TTL(store.key(key)))
+}
+
+func TestStore_ExpiresBucketsOnceFull(t *testing.T) {
+	store, server := newStore(t)
+	server.SetTime(time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC))
+
+	_, _, _ = store.Take(context.Background(), key, cfg, 2)
+	assert.Equal(t, 3*time.Minute, server.TTL(store.key(key)))
+
+	server.FastForward(3 * time.Minute)
+	assert.False(t, server.Exists(store.key(key)))
+}
+
+func TestStore_FailsIfServerIsUnreachable(t *testing.T) {
+	store, server := newStore(t)
+	server.Close()
+
+	_, _, err := store.Take(context.Background(), key, cfg, 1)
+	assert.Error(t, err)
+}
+
+func TestStore_SharesQuotasAcrossRateLimiters(t *testing.T) {
+	store, _ := newStore(t)
+	build := func() *token_bucket.RateLimiter {
+		rl, err := token_bucket.NewRateLimiterBuilder().
+			SetLimit(route, cfg).
+			RegisterUser(userID).
+			SetStore(store).
+			Build()
+		assert.NoError(t, err)
+
+		return rl
+	}
+	replica1, replica2 := build(), build()
+	defer replica1.Stop()
+	defer replica2.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	assert.True(t, replica1.Take(req).Allowed())
+	assert.True(t, replica2.Take(req).Allowed())
+	assert.True(t, replica1.Take(req).Allowed())
+	assert.Equal(t, common.Denied, replica2.Take(req).Outcome)
+}
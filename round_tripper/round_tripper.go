@@ -0,0 +1,313 @@
+package round_tripper
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fedragon/rate-limiter/concurrent"
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/token_bucket"
+
+	"go.uber.org/zap"
+)
+
+// Mode defines what happens to requests exceeding the limits.
+type Mode int
+
+const (
+	// Wait delays requests until they are allowed, or their context is done.
+	Wait Mode = iota
+	// FailFast rejects requests immediately, with a *LimitedError.
+	FailFast
+)
+
+// ErrLimited is wrapped by the errors returned for requests rejected in FailFast mode.
+var ErrLimited = errors.New("client-side rate limit exceeded")
+
+type (
+	// LimitedError is returned for requests rejected in FailFast mode.
+	LimitedError struct {
+		Destination string
+		// RetryAfter is the time to wait before the request would be allowed.
+		RetryAfter time.Duration
+	}
+
+	// RateLimiterBuilder builds a client-side rate limiter.
+	RateLimiterBuilder struct {
+		next         http.RoundTripper
+		destinations *concurrent.Map[string, token_bucket.Config]
+		mode         Mode
+		store        token_bucket.Store
+	}
+
+	// RateLimiter is an http.RoundTripper that throttles the requests sent to each destination (a host, optionally
+	// followed by a path prefix, e.g. api.example.com/v1/search), so that clients stay within the quotas of the
+	// services they call instead of being rejected by them.
+	// It also honours the limits advertised by servers: after a response with a `Retry-After` header, or with an
+	// `X-Ratelimit-Remaining` header of 0 along with `X-Ratelimit-Reset`, no request is sent to the destination until
+	// the given time, and remaining quotas lower than the local ones are adopted. Rejected requests are not retried.
+	RateLimiter struct {
+		next         http.RoundTripper
+		destinations *concurrent.Map[string, token_bucket.Config]
+		mode         Mode
+		store        token_bucket.Store
+		blocked      *concurrent.Map[string, time.Time]
+		now          func() time.Time
+	}
+)
+
+// Error returns the error message.
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("%v: %v, retry after %v", ErrLimited, e.Destination, e.RetryAfter)
+}
+
+// Unwrap returns ErrLimited.
+func (e *LimitedError) Unwrap() error {
+	return ErrLimited
+}
+
+// NewRateLimiterBuilder instantiates a client-side rate limiter builder, which sends requests using next. If next is
+// nil, http.DefaultTransport is used.
+func NewRateLimiterBuilder(next http.RoundTripper) *RateLimiterBuilder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &RateLimiterBuilder{
+		next:         next,
+		destinations: concurrent.NewMap[string, token_bucket.Config](),
+		store:        token_bucket.NewMemoryStore(),
+	}
+}
+
+// SetLimit sets a limit on a destination, which is either a host (e.g. api.example.com, or api.example.com:8080 if
+// the port is not the default one) or a host followed by a path prefix (e.g. api.example.com/v1/search). Requests are
+// limited by the most specific matching destination, whose path prefix must match whole segments of the request path
+// (e.g. /v1/search matches /v1/search/users but not /v1/searches); requests not matching any destination are not
+// limited.
+func (b *RateLimiterBuilder) SetLimit(destination string, cfg token_bucket.Config) *RateLimiterBuilder {
+	b.destinations.Put(destination, cfg)
+	return b
+}
+
+// SetMode sets what happens to requests exceeding the limits. Defaults to Wait.
+func (b *RateLimiterBuilder) SetMode(mode Mode) *RateLimiterBuilder {
+	b.mode = mode
+	return b
+}
+
+// SetStore sets the store that keeps the state of all buckets, e.g. to share quotas among several processes. By
+// default, buckets are kept in memory.
+func (b *RateLimiterBuilder) SetStore(store token_bucket.Store) *RateLimiterBuilder {
+	b.store = store
+	return b
+}
+
+// Build builds a client-side rate limiter.
+// It returns an error if no limits have been configured, or if any limit is not positive.
+func (b *RateLimiterBuilder) Build() (*RateLimiter, error) {
+	if b.destinations.Size() == 0 {
+		return nil, errors.New("no rate limit configured")
+	}
+
+	for t := range b.destinations.Iterate() {
+		if err := t.Value.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid limit of %v: %w", t.Key, err)
+		}
+	}
+
+	return &RateLimiter{
+		next:         b.next,
+		destinations: b.destinations,
+		mode:         b.mode,
+		store:        b.store,
+		blocked:      concurrent.NewMap[string, time.Time](),
+		now:          time.Now,
+	}, nil
+}
+
+// destination returns the most specific destination matching the request, along with its configuration.
+func (rl *RateLimiter) destination(r *http.Request) (string, token_bucket.Config, bool) {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var (
+		best  string
+		found token_bucket.Config
+		ok    bool
+	)
+	for t := range rl.destinations.Iterate() {
+		destHost, prefix, _ := strings.Cut(t.Key, "/")
+		if destHost != host || !matches(path, prefix) {
+			continue
+		}
+
+		if !ok || len(t.Key) > len(best) {
+			best, found, ok = t.Key, t.Value, true
+		}
+	}
+
+	return best, found, ok
+}
+
+// matches returns true if path is equal to prefix, or starts with prefix followed by a '/'. An empty prefix matches all
+// paths.
+func matches(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+
+	rest, ok := strings.CutPrefix(path, "/"+prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// RoundTrip sends the request once it is allowed by the limits of its destination. As required by http.RoundTripper,
+// the request body is closed even if the request is not sent.
+func (rl *RateLimiter) RoundTrip(r *http.Request) (*http.Response, error) {
+	dest, cfg, ok := rl.destination(r)
+	if !ok {
+		return rl.next.RoundTrip(r)
+	}
+
+	if err := rl.acquire(r, dest, cfg); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	res, err := rl.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rl.adapt(r, dest, cfg, res)
+	return res, nil
+}
+
+// acquire consumes a unit of quota for the destination, waiting for it if needed and allowed by the mode.
+func (rl *RateLimiter) acquire(r *http.Request, dest string, cfg token_bucket.Config) error {
+	key := token_bucket.GlobalKey(token_bucket.Path(dest))
+
+	for {
+		var wait time.Duration
+		if until, blocked := rl.blocked.Get(dest); blocked && rl.now().Before(until) {
+			wait = until.Sub(rl.now())
+		} else {
+			b, taken, err := rl.store.Take(r.Context(), key, cfg, 1)
+			if err != nil {
+				return err
+			}
+
+			if taken {
+				return nil
+			}
+
+			wait = b.NextRefill(cfg).Sub(rl.now())
+		}
+
+		if rl.mode == FailFast {
+			return &LimitedError{Destination: dest, RetryAfter: wait}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return r.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// adapt adjusts the limits of the destination to those advertised by the server in the response.
+func (rl *RateLimiter) adapt(r *http.Request, dest string, cfg token_bucket.Config, res *http.Response) {
+	now := rl.now()
+
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := retryAfter(res.Header, now); ok {
+			rl.block(dest, now.Add(d))
+		}
+	}
+
+	remaining, err := strconv.Atoi(res.Header.Get("X-Ratelimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	if remaining <= 0 {
+		if reset, ok := resetTime(res.Header.Get("X-Ratelimit-Reset"), now); ok {
+			rl.block(dest, reset)
+		}
+	}
+
+	// the server has less quota left than expected (e.g. because it is shared with other clients): catch up
+	key := token_bucket.GlobalKey(token_bucket.Path(dest))
+	b, err := rl.store.Get(r.Context(), key, cfg)
+	if err != nil || b.Tokens <= remaining {
+		return
+	}
+
+	if _, _, err := rl.store.Take(r.Context(), key, cfg, b.Tokens-remaining); err != nil {
+		logging.Logger().Warn("cannot adapt quota", zap.String("destination", dest), zap.Error(err))
+	}
+}
+
+func (rl *RateLimiter) block(dest string, until time.Time) {
+	rl.blocked.Update(dest, func(current time.Time, exists bool) time.Time {
+		if exists && current.After(until) {
+			return current
+		}
+
+		return until
+	})
+}
+
+// retryAfter parses the `Retry-After` header, either in seconds or as an HTTP date, falling back to the
+// `X-Ratelimit-Retry-After` header (in seconds) set by this project's middlewares.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+
+		if t, err := http.ParseTime(v); err == nil {
+			return t.Sub(now), true
+		}
+	}
+
+	if seconds, err := strconv.Atoi(h.Get("X-Ratelimit-Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// resetTime parses the `X-Ratelimit-Reset` header, which is either a Unix timestamp or a number of seconds, depending
+// on the server.
+func resetTime(v string, now time.Time) (time.Time, bool) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+
+	// values this large cannot be a delay, so they are timestamps
+	if n > 1_000_000_000 {
+		return time.Unix(n, 0), true
+	}
+
+	return now.Add(time.Duration(n) * time.Second), true
+}
@@ -0,0 +1,279 @@
+package round_tripper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(t *testing.T, h http.HandlerFunc) (*httptest.Server, string, *int32) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		h(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	return server, u.Host, &count
+}
+
+func ok(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func config(value int, interval time.Duration) token_bucket.Config {
+	rate := common.Rate{Value: value, Interval: interval}
+	return token_bucket.Config{Limit: rate, Refill: rate}
+}
+
+func get(client *http.Client, url string) (*http.Response, error) {
+	res, err := client.Get(url)
+	if err == nil {
+		res.Body.Close()
+	}
+
+	return res, err
+}
+
+type body struct {
+	closed bool
+}
+
+func (b *body) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRateLimiterBuilder_Build_FailsIfLimitIsNotPositive(t *testing.T) {
+	_, err := NewRateLimiterBuilder(nil).SetLimit("example.com", config(1, 0)).Build()
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_RoundTrip_ClosesBodyOfLimitedRequests(t *testing.T) {
+	_, host, _ := newServer(t, ok)
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(1, time.Minute)).
+		SetMode(FailFast).
+		Build()
+	assert.NoError(t, err)
+
+	res, err := rl.RoundTrip(httptest.NewRequest(http.MethodPost, "http://"+host+"/", &body{}))
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	b := &body{}
+	_, err = rl.RoundTrip(httptest.NewRequest(http.MethodPost, "http://"+host+"/", b))
+	assert.True(t, errors.Is(err, ErrLimited))
+	assert.True(t, b.closed)
+}
+
+func TestRateLimiter_FailFast(t *testing.T) {
+	server, host, count := newServer(t, ok)
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(2, time.Minute)).
+		SetMode(FailFast).
+		Build()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rl}
+
+	for i := 0; i < 2; i++ {
+		_, err := get(client, server.URL+"/foo")
+		assert.NoError(t, err)
+	}
+
+	_, err = get(client, server.URL+"/foo")
+	assert.True(t, errors.Is(err, ErrLimited))
+
+	var limited *LimitedError
+	assert.True(t, errors.As(err, &limited))
+	assert.Equal(t, host, limited.Destination)
+	assert.InDelta(t, time.Minute, limited.RetryAfter, float64(time.Second))
+	assert.Equal(t, int32(2), atomic.LoadInt32(count))
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	server, host, count := newServer(t, ok)
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(1, 50*time.Millisecond)).
+		Build()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rl}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := get(client, server.URL)
+		assert.NoError(t, err)
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+}
+
+func TestRateLimiter_WaitHonoursContext(t *testing.T) {
+	server, host, _ := newServer(t, ok)
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(1, time.Minute)).
+		Build()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rl}
+
+	_, err = get(client, server.URL)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+
+	_, err = client.Do(req)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRateLimiter_MostSpecificDestination(t *testing.T) {
+	server, host, _ := newServer(t, ok)
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(10, time.Minute)).
+		SetLimit(host+"/search", config(1, time.Minute)).
+		SetMode(FailFast).
+		Build()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rl}
+
+	_, err = get(client, server.URL+"/search")
+	assert.NoError(t, err)
+
+	_, err = get(client, server.URL+"/search")
+	assert.True(t, errors.Is(err, ErrLimited))
+
+	_, err = get(client, server.URL+"/search/1")
+	assert.True(t, errors.Is(err, ErrLimited))
+
+	// prefixes only match whole segments
+	_, err = get(client, server.URL+"/searches")
+	assert.NoError(t, err)
+
+	_, err = get(client, server.URL+"/other")
+	assert.NoError(t, err)
+
+	// other hosts are not limited
+	other := httptest.NewServer(http.HandlerFunc(ok))
+	defer other.Close()
+	for i := 0; i < 3; i++ {
+		_, err = get(client, other.URL+"/search")
+		assert.NoError(t, err)
+	}
+}
+
+func TestRateLimiter_HonoursRetryAfter(t *testing.T) {
+	var throttle int32 = 1
+	server, host, count := newServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&throttle) == 1 {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(10, time.Minute)).
+		SetMode(FailFast).
+		Build()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rl}
+
+	res, err := get(client, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	atomic.StoreInt32(&throttle, 0)
+	_, err = get(client, server.URL)
+
+	var limited *LimitedError
+	assert.True(t, errors.As(err, &limited))
+	assert.InDelta(t, 2*time.Minute, limited.RetryAfter, float64(time.Second))
+	assert.Equal(t, int32(1), atomic.LoadInt32(count))
+
+	// the server is contacted again once the delay is over
+	rl.now = func() time.Time { return time.Now().Add(3 * time.Minute) }
+	res, err = get(client, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRateLimiter_AdoptsRemainingQuota(t *testing.T) {
+	var remaining int32 = 3
+	server, host, _ := newServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		r := atomic.AddInt32(&remaining, -1)
+		w.Header().Set("X-Ratelimit-Remaining", strconv.Itoa(int(r)))
+		w.Header().Set("X-Ratelimit-Reset", "60")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rl, err := NewRateLimiterBuilder(nil).
+		SetLimit(host, config(10, time.Minute)).
+		SetMode(FailFast).
+		Build()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rl}
+
+	sent := 0
+	for i := 0; i < 10; i++ {
+		if _, err := get(client, server.URL); err != nil {
+			assert.True(t, errors.Is(err, ErrLimited))
+			break
+		}
+		sent++
+	}
+
+	// the server only had 3 requests left, despite the local limit of 10
+	assert.Equal(t, 3, sent)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+
+	d, ok := retryAfter(http.Header{"Retry-After": []string{now.Add(time.Minute).Format(http.TimeFormat)}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	d, ok = retryAfter(http.Header{"X-Ratelimit-Retry-After": []string{"5"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, d)
+
+	_, ok = retryAfter(http.Header{}, now)
+	assert.False(t, ok)
+}
+
+func TestResetTime(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+
+	reset, ok := resetTime("30", now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(30*time.Second), reset)
+
+	reset, ok = resetTime(strconv.FormatInt(now.Add(time.Hour).Unix(), 10), now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour).Unix(), reset.Unix())
+
+	_, ok = resetTime("soon", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/config"
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+type (
+	// Entry is a key/value pair of a descriptor.
+	Entry struct {
+		Key   string `json:"key"`
+		Value string `json:"value,omitempty"`
+	}
+
+	// Descriptor describes what a request should be limited by, as an ordered list of entries, e.g.
+	// [{"key": "user", "value": "abc"}, {"key": "path", "value": "/foo"}].
+	Descriptor []Entry
+
+	// Rule limits the requests whose descriptor matches its own: entries need to have the same keys, in the same
+	// order, and the same values, unless the rule leaves them empty, in which case each value has its own bucket.
+	// Requests are limited by a token bucket: when Refill equals Limit (the default), it behaves as a fixed window of
+	// Interval, starting with the first request.
+	Rule struct {
+		Descriptor Descriptor `json:"descriptor"`
+		// Limit is the maximum number of hits allowed at once.
+		Limit int `json:"limit"`
+		// Refill is the number of hits given back every Interval. Defaults to Limit.
+		Refill   int             `json:"refill,omitempty"`
+		Interval config.Duration `json:"interval"`
+	}
+
+	// Domain is a set of rules, isolated from the rules of other domains.
+	Domain struct {
+		Name  string `json:"name"`
+		Rules []Rule `json:"rules"`
+	}
+
+	// Config configures the service.
+	Config struct {
+		Domains []Domain `json:"domains"`
+	}
+)
+
+// LoadConfig decodes a JSON configuration, rejecting unknown fields.
+func LoadConfig(r io.Reader) (Config, error) {
+	var cfg Config
+
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// Validate returns all the errors found in the configuration, if any.
+func (cfg Config) Validate() error {
+	var errs []error
+	if len(cfg.Domains) == 0 {
+		errs = append(errs, errors.New("no domain configured"))
+	}
+
+	names := make(map[string]bool)
+	for i, d := range cfg.Domains {
+		if d.Name == "" {
+			errs = append(errs, fmt.Errorf("domains[%d]: missing name", i))
+		} else if names[d.Name] {
+			errs = append(errs, fmt.Errorf("domains[%d]: duplicate name %q", i, d.Name))
+		}
+		names[d.Name] = true
+
+		for j, r := range d.Rules {
+			if err := r.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("domains[%d].rules[%d]: %w", i, j, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r Rule) validate() error {
+	if len(r.Descriptor) == 0 {
+		return errors.New("empty descriptor")
+	}
+
+	for _, e := range r.Descriptor {
+		if e.Key == "" {
+			return errors.New("descriptor entry without key")
+		}
+	}
+
+	if r.Limit <= 0 {
+		return errors.New("limit must be positive")
+	}
+
+	if r.Refill < 0 {
+		return errors.New("refill must not be negative")
+	}
+
+	if r.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	return nil
+}
+
+// config returns the configuration of the buckets of the rule.
+func (r Rule) config() token_bucket.Config {
+	refill := r.Refill
+	if refill == 0 {
+		refill = r.Limit
+	}
+
+	return token_bucket.Config{
+		Limit:  common.Rate{Value: r.Limit, Interval: time.Duration(r.Interval)},
+		Refill: common.Rate{Value: refill, Interval: time.Duration(r.Interval)},
+	}
+}
+
+// matches returns true if the descriptor matches the rule.
+func (r Rule) matches(d Descriptor) bool {
+	if len(r.Descriptor) != len(d) {
+		return false
+	}
+
+	for i, e := range r.Descriptor {
+		if e.Key != d[i].Key || (e.Value != "" && e.Value != d[i].Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// specificity returns the number of entries of the rule that have a value.
+func (r Rule) specificity() int {
+	n := 0
+	for _, e := range r.Descriptor {
+		if e.Value != "" {
+			n++
+		}
+	}
+
+	return n
+}
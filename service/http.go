@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/logging"
+
+	"go.uber.org/zap"
+)
+
+// maxRequestSize is the maximum size, in bytes, of the body of requests.
+const maxRequestSize = 64 << 10
+
+type (
+	request struct {
+		Domain     string     `json:"domain"`
+		Descriptor Descriptor `json:"descriptor"`
+		// Hits is the number of units of quota to check or take. Defaults to 1.
+		Hits int `json:"hits,omitempty"`
+	}
+
+	decisionResponse struct {
+		Outcome      string `json:"outcome"`
+		Allowed      bool   `json:"allowed"`
+		Limit        int    `json:"limit"`
+		Remaining    int    `json:"remaining"`
+		RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	}
+
+	statusResponse struct {
+		Limit      int       `json:"limit"`
+		Remaining  int       `json:"remaining"`
+		NextRefill time.Time `json:"next_refill"`
+	}
+
+	errorResponse struct {
+		Error string `json:"error"`
+	}
+)
+
+// Handler returns an HTTP handler exposing the service as a JSON API. All endpoints accept POST requests whose body
+// contains the domain and descriptor to evaluate, e.g.
+//
+//	{"domain": "api", "descriptor": [{"key": "user", "value": "abc"}], "hits": 1}
+//
+// and are served at:
+//   - /v1/check: returns whether hits units of quota are available, without consuming them;
+//   - /v1/take: consumes hits units of quota, if available;
+//   - /v1/remaining: returns the remaining quota and the time of the next refill;
+//   - /v1/reset: fills up the quota.
+//
+// Decisions are always returned with status 200, even when requests are denied: other statuses denote errors.
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/check", s.decide(s.Check))
+	mux.Handle("/v1/take", s.decide(s.Take))
+	mux.Handle("/v1/remaining", s.handle(func(ctx context.Context, req request) (any, int, error) {
+		st, err := s.Remaining(ctx, req.Domain, req.Descriptor)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return statusResponse{Limit: st.Limit, Remaining: st.Remaining, NextRefill: st.NextRefill}, http.StatusOK, nil
+	}))
+	mux.Handle("/v1/reset", s.handle(func(ctx context.Context, req request) (any, int, error) {
+		return nil, http.StatusNoContent, s.Reset(ctx, req.Domain, req.Descriptor)
+	}))
+
+	return mux
+}
+
+func (s *Service) decide(f func(context.Context, string, Descriptor, int) (common.Decision, error)) http.Handler {
+	return s.handle(func(ctx context.Context, req request) (any, int, error) {
+		d, err := f(ctx, req.Domain, req.Descriptor, req.Hits)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return decisionResponse{
+			Outcome:      d.Outcome.String(),
+			Allowed:      d.Allowed(),
+			Limit:        d.Limit,
+			Remaining:    d.Remaining,
+			RetryAfterMs: d.RetryAfter.Milliseconds(),
+		}, http.StatusOK, nil
+	})
+}
+
+func (s *Service) handle(f func(context.Context, request) (any, int, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse{Error: err.Error()})
+				return
+			}
+
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		if req.Domain == "" || len(req.Descriptor) == 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "domain and descriptor are required"})
+			return
+		}
+
+		if req.Hits < 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "hits must not be negative"})
+			return
+		}
+
+		if req.Hits == 0 {
+			req.Hits = 1
+		}
+
+		body, status, err := f(r.Context(), req)
+		if errors.Is(err, ErrNoRule) {
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+			return
+		}
+
+		if err != nil {
+			logging.Logger().Error("cannot serve request", zap.String("path", r.URL.Path), zap.Error(err))
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+
+		if body == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		writeJSON(w, status, body)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
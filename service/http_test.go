@@ -0,0 +1,69 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func post(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	h := newService(t).Handler()
+	body := `{"domain": "api", "descriptor": [{"key": "user", "value": "abc"}], "hits": 2}`
+
+	w := post(h, "/v1/take", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var d decisionResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&d))
+	assert.Equal(t, decisionResponse{Outcome: "allowed", Allowed: true, Limit: 3, Remaining: 1}, d)
+
+	w = post(h, "/v1/check", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&d))
+	assert.Equal(t, "denied", d.Outcome)
+	assert.False(t, d.Allowed)
+	assert.Greater(t, d.RetryAfterMs, int64(0))
+
+	w = post(h, "/v1/remaining", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var st statusResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&st))
+	assert.Equal(t, 1, st.Remaining)
+
+	w = post(h, "/v1/reset", body)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = post(h, "/v1/remaining", body)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&st))
+	assert.Equal(t, 3, st.Remaining)
+}
+
+func TestHandler_Errors(t *testing.T) {
+	h := newService(t).Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/take", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	assert.Equal(t, http.StatusBadRequest, post(h, "/v1/take", `{`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(h, "/v1/take", `{"domain": "api"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(h, "/v1/take", `{"domain": "api", "descriptor": [{"key": "user"}], "hits": -1}`).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(h, "/v1/take", `{"domain": "`+strings.Repeat("a", maxRequestSize)+`"}`).Code)
+	assert.Equal(t, http.StatusNotFound, post(h, "/v1/reset", `{"domain": "api", "descriptor": [{"key": "ip"}]}`).Code)
+
+	w = post(h, "/v1/take", `{"domain": "api", "descriptor": [{"key": "ip"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"outcome":"unknown"`)
+}
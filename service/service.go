@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/token_bucket"
+)
+
+// ErrNoRule is returned when no rule matches a descriptor.
+var ErrNoRule = errors.New("no matching rule")
+
+type (
+	// Status represents the current state of the bucket of a descriptor.
+	Status struct {
+		Limit      int
+		Remaining  int
+		NextRefill time.Time
+	}
+
+	// Service makes rate-limiting decisions on behalf of other processes, which describe what each request should be
+	// limited by using descriptors, grouped in domains. Buckets are kept in a token_bucket.Store, so that several
+	// instances of the service can share them.
+	Service struct {
+		domains map[string][]Rule
+		store   token_bucket.Store
+	}
+)
+
+// New returns a new service, applying the provided configuration and keeping buckets in store.
+// It returns an error if the configuration is not valid.
+func New(cfg Config, store token_bucket.Store) (*Service, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	domains := make(map[string][]Rule, len(cfg.Domains))
+	for _, d := range cfg.Domains {
+		rules := make([]Rule, len(d.Rules))
+		copy(rules, d.Rules)
+
+		// the most specific rules are evaluated first
+		sort.SliceStable(rules, func(i, j int) bool {
+			return rules[i].specificity() > rules[j].specificity()
+		})
+
+		domains[d.Name] = rules
+	}
+
+	return &Service{domains: domains, store: store}, nil
+}
+
+// rule returns the rule matching the descriptor, along with the key of its bucket.
+func (s *Service) rule(domain string, d Descriptor) (Rule, token_bucket.Key, bool) {
+	for _, r := range s.domains[domain] {
+		if r.matches(d) {
+			return r, key(domain, d), true
+		}
+	}
+
+	return Rule{}, token_bucket.Key{}, false
+}
+
+// Rule returns the rule matching the descriptor in domain, if any.
+func (s *Service) Rule(domain string, d Descriptor) (Rule, bool) {
+	r, _, ok := s.rule(domain, d)
+	return r, ok
+}
+
+// key returns the key of the bucket of the descriptor: the domain is used as path and the escaped entries as user ID.
+func key(domain string, d Descriptor) token_bucket.Key {
+	entries := make([]string, len(d))
+	for i, e := range d {
+		entries[i] = url.QueryEscape(e.Key) + "=" + url.QueryEscape(e.Value)
+	}
+
+	return token_bucket.Key{
+		UserID: token_bucket.UserID(strings.Join(entries, "&")),
+		Path:   token_bucket.Path(domain),
+	}
+}
+
+// Take consumes hits units of quota from the bucket of the descriptor, if available.
+// The decision is Unknown if no rule matches the descriptor.
+func (s *Service) Take(ctx context.Context, domain string, d Descriptor, hits int) (common.Decision, error) {
+	r, k, ok := s.rule(domain, d)
+	if !ok {
+		return common.Decision{Outcome: common.Unknown}, nil
+	}
+
+	cfg := r.config()
+	b, taken, err := s.store.Take(ctx, k, cfg, hits)
+	if err != nil {
+		return common.Decision{Outcome: common.Failed}, err
+	}
+
+	return decision(b, cfg, hits, taken), nil
+}
+
+// Check returns whether hits units of quota are available in the bucket of the descriptor, without consuming them.
+// The decision is Unknown if no rule matches the descriptor.
+func (s *Service) Check(ctx context.Context, domain string, d Descriptor, hits int) (common.Decision, error) {
+	r, k, ok := s.rule(domain, d)
+	if !ok {
+		return common.Decision{Outcome: common.Unknown}, nil
+	}
+
+	cfg := r.config()
+	b, err := s.store.Get(ctx, k, cfg)
+	if err != nil {
+		return common.Decision{Outcome: common.Failed}, err
+	}
+
+	return decision(b, cfg, hits, b.Tokens >= hits), nil
+}
+
+func decision(b token_bucket.Bucket, cfg token_bucket.Config, hits int, allowed bool) common.Decision {
+	if allowed {
+		return common.Decision{
+			Outcome:   common.Allowed,
+			Limit:     cfg.Limit.Value,
+			Remaining: b.Tokens,
+		}
+	}
+
+	d := common.Decision{Outcome: common.Denied, Limit: cfg.Limit.Value, Remaining: b.Tokens}
+	if hits <= cfg.Limit.Value && cfg.Refill.Value > 0 {
+		// wait for as many refills as needed to collect the missing tokens
+		refills := (hits - b.Tokens + cfg.Refill.Value - 1) / cfg.Refill.Value
+		d.RetryAfter = time.Until(b.NextRefill(cfg).Add(time.Duration(refills-1) * cfg.Refill.Interval))
+	}
+
+	return d
+}
+
+// Remaining returns the current state of the bucket of the descriptor.
+// It returns ErrNoRule if no rule matches the descriptor.
+func (s *Service) Remaining(ctx context.Context, domain string, d Descriptor) (Status, error) {
+	r, k, ok := s.rule(domain, d)
+	if !ok {
+		return Status{}, fmt.Errorf("%w: %v", ErrNoRule, domain)
+	}
+
+	cfg := r.config()
+	b, err := s.store.Get(ctx, k, cfg)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return Status{Limit: cfg.Limit.Value, Remaining: b.Tokens, NextRefill: b.NextRefill(cfg)}, nil
+}
+
+// Reset fills up the bucket of the descriptor.
+// It returns ErrNoRule if no rule matches the descriptor.
+func (s *Service) Reset(ctx context.Context, domain string, d Descriptor) error {
+	r, k, ok := s.rule(domain, d)
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNoRule, domain)
+	}
+
+	return s.store.Reset(ctx, k, r.config())
+}
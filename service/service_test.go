@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/config"
+	"github.com/fedragon/rate-limiter/token_bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+const configJSON = `{
+  "domains": [
+    {
+      "name": "api",
+      "rules": [
+        {"descriptor": [{"key": "user"}], "limit": 3, "interval": "1m"},
+        {"descriptor": [{"key": "user", "value": "vip"}], "limit": 10, "refill": 2, "interval": "1m"},
+        {"descriptor": [{"key": "user"}, {"key": "path", "value": "/login"}], "limit": 1, "interval": "1h"}
+      ]
+    }
+  ]
+}`
+
+func newService(t *testing.T) *Service {
+	cfg, err := LoadConfig(strings.NewReader(configJSON))
+	assert.NoError(t, err)
+
+	s, err := New(cfg, token_bucket.NewMemoryStore())
+	assert.NoError(t, err)
+
+	return s
+}
+
+func user(id string) Descriptor {
+	return Descriptor{{Key: "user", Value: id}}
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(configJSON))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Domains, 1)
+	assert.Equal(t, config.Duration(time.Hour), cfg.Domains[0].Rules[2].Interval)
+
+	_, err = LoadConfig(strings.NewReader(`{"domains": [], "unknown": true}`))
+	assert.Error(t, err)
+
+	_, err = LoadConfig(strings.NewReader(`{"domains": [{"name": "api", "rules": [{"interval": "soon"}]}]}`))
+	assert.Error(t, err)
+}
+
+func TestLoadConfig_Example(t *testing.T) {
+	f, err := os.Open("../cmd/ratelimitd/config.example.json")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	cfg, err := LoadConfig(f)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := Config{
+		Domains: []Domain{
+			{Name: "api", Rules: []Rule{{Limit: 1, Interval: config.Duration(time.Second)}}},
+			{Name: "api", Rules: []Rule{{Descriptor: Descriptor{{Key: "user"}}, Interval: config.Duration(time.Second)}}},
+		},
+	}
+
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "domains[0].rules[0]: empty descriptor")
+	assert.Contains(t, err.Error(), `domains[1]: duplicate name "api"`)
+	assert.Contains(t, err.Error(), "domains[1].rules[0]: limit must be positive")
+
+	assert.Error(t, Config{}.Validate())
+}
+
+func TestService_Take(t *testing.T) {
+	s := newService(t)
+	ctx := context.Background()
+
+	d, err := s.Take(ctx, "api", user("abc"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Decision{Outcome: common.Allowed, Limit: 3, Remaining: 1}, d)
+
+	d, err = s.Take(ctx, "api", user("abc"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Denied, d.Outcome)
+	assert.Equal(t, 1, d.Remaining)
+	assert.InDelta(t, time.Minute, d.RetryAfter, float64(time.Second))
+
+	// each user has its own bucket
+	d, err = s.Take(ctx, "api", user("def"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Allowed, d.Outcome)
+}
+
+func TestService_TakeMostSpecificRule(t *testing.T) {
+	s := newService(t)
+	ctx := context.Background()
+
+	d, err := s.Take(ctx, "api", user("vip"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Decision{Outcome: common.Allowed, Limit: 10, Remaining: 5}, d)
+
+	// 3 refills are needed to collect the missing 5 tokens
+	d, err = s.Take(ctx, "api", user("vip"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Denied, d.Outcome)
+	assert.InDelta(t, 3*time.Minute, d.RetryAfter, float64(time.Second))
+
+	d, err = s.Take(ctx, "api", Descriptor{{Key: "user", Value: "abc"}, {Key: "path", Value: "/login"}}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, d.Limit)
+}
+
+func TestService_Unknown(t *testing.T) {
+	s := newService(t)
+	ctx := context.Background()
+
+	d, err := s.Take(ctx, "other", user("abc"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Unknown, d.Outcome)
+
+	d, err = s.Check(ctx, "api", Descriptor{{Key: "ip", Value: "1.2.3.4"}}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Unknown, d.Outcome)
+
+	_, err = s.Remaining(ctx, "api", Descriptor{{Key: "user", Value: "abc"}, {Key: "path", Value: "/"}})
+	assert.True(t, errors.Is(err, ErrNoRule))
+}
+
+func TestService_CheckDoesNotConsume(t *testing.T) {
+	s := newService(t)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		d, err := s.Check(ctx, "api", user("abc"), 3)
+		assert.NoError(t, err)
+		assert.Equal(t, common.Allowed, d.Outcome)
+	}
+
+	d, err := s.Check(ctx, "api", user("abc"), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, common.Denied, d.Outcome)
+}
+
+func TestService_RemainingAndReset(t *testing.T) {
+	s := newService(t)
+	ctx := context.Background()
+
+	_, err := s.Take(ctx, "api", user("abc"), 3)
+	assert.NoError(t, err)
+
+	st, err := s.Remaining(ctx, "api", user("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, st.Limit)
+	assert.Equal(t, 0, st.Remaining)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), st.NextRefill, time.Second)
+
+	assert.NoError(t, s.Reset(ctx, "api", user("abc")))
+
+	st, err = s.Remaining(ctx, "api", user("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, st.Remaining)
+}
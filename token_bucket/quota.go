@@ -0,0 +1,110 @@
+package token_bucket
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrUnknownQuota is returned when the requested path or user is not configured.
+	ErrUnknownQuota = errors.New("unknown path or user")
+	// ErrInvalidQuota is returned when the requested number of tokens exceeds the limit of the bucket, or is negative.
+	ErrInvalidQuota = errors.New("invalid number of tokens")
+)
+
+// Paths returns all configured paths, along with their limits.
+func (rl *RateLimiter) Paths() map[Path]Config {
+	paths := make(map[Path]Config)
+	for t := range rl.paths.Iterate() {
+		paths[t.Key] = t.Value
+	}
+
+	return paths
+}
+
+// Users returns all registered users, sorted by ID.
+func (rl *RateLimiter) Users() []UserID {
+	var users []UserID
+	for u := range rl.users.Iterate() {
+		users = append(users, u)
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users
+}
+
+// bucket returns the key and the configuration of the bucket of a user on a path. An empty userID identifies the
+// global bucket of the path, if it has one.
+func (rl *RateLimiter) bucket(userID UserID, path Path) (Key, Config, error) {
+	limit, exists := rl.paths.Get(path)
+	if !exists {
+		return Key{}, Config{}, ErrUnknownQuota
+	}
+
+	if userID == "" {
+		if limit.Global == nil {
+			return Key{}, Config{}, ErrUnknownQuota
+		}
+
+		return GlobalKey(path), *limit.Global, nil
+	}
+
+	if !rl.users.Contains(userID) {
+		return Key{}, Config{}, ErrUnknownQuota
+	}
+
+	return Key{UserID: userID, Path: path}, limit, nil
+}
+
+// Quota returns the current state of the bucket of a user on a path, along with its configuration, without consuming
+// any token. An empty userID identifies the global bucket of the path.
+func (rl *RateLimiter) Quota(ctx context.Context, userID UserID, path Path) (Bucket, Config, error) {
+	key, cfg, err := rl.bucket(userID, path)
+	if err != nil {
+		return Bucket{}, cfg, err
+	}
+
+	b, err := rl.store.Get(ctx, key, cfg)
+	return b, cfg, err
+}
+
+// ResetQuota fills up the bucket of a user on a path. An empty userID identifies the global bucket of the path.
+func (rl *RateLimiter) ResetQuota(ctx context.Context, userID UserID, path Path) error {
+	key, cfg, err := rl.bucket(userID, path)
+	if err != nil {
+		return err
+	}
+
+	return rl.store.Reset(ctx, key, cfg)
+}
+
+// TopUpQuota adds n tokens to the bucket of a user on a path, without exceeding its limit. An empty userID identifies
+// the global bucket of the path.
+func (rl *RateLimiter) TopUpQuota(ctx context.Context, userID UserID, path Path, n int) (Bucket, error) {
+	key, cfg, err := rl.bucket(userID, path)
+	if err != nil {
+		return Bucket{}, err
+	}
+
+	if n < 0 {
+		return Bucket{}, ErrInvalidQuota
+	}
+
+	return rl.store.Refill(ctx, key, cfg, n)
+}
+
+// SetQuota sets the number of tokens in the bucket of a user on a path, which must not exceed its limit. An empty
+// userID identifies the global bucket of the path.
+func (rl *RateLimiter) SetQuota(ctx context.Context, userID UserID, path Path, n int) (Bucket, error) {
+	key, cfg, err := rl.bucket(userID, path)
+	if err != nil {
+		return Bucket{}, err
+	}
+
+	if n < 0 || n > cfg.Limit.Value {
+		return Bucket{}, ErrInvalidQuota
+	}
+
+	return rl.store.Set(ctx, key, cfg, n)
+}
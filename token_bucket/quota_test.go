@@ -0,0 +1,88 @@
+package token_bucket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newQuotaLimiter(t *testing.T) *RateLimiter {
+	cfg := Config{
+		Limit:  common.Rate{Value: 5, Interval: time.Hour},
+		Refill: common.Rate{Value: 5, Interval: time.Hour},
+	}
+	global := cfg
+	global.Limit.Value = 10
+	cfg.Global = &global
+
+	rl, err := NewRateLimiterBuilder().
+		SetLimit(route, cfg).
+		RegisterUser("b").
+		RegisterUser("a").
+		Build()
+	assert.NoError(t, err)
+
+	return rl
+}
+
+func TestRateLimiter_PathsAndUsers(t *testing.T) {
+	rl := newQuotaLimiter(t)
+	defer rl.Stop()
+
+	assert.Equal(t, []UserID{"a", "b"}, rl.Users())
+	assert.Contains(t, rl.Paths(), Path(route))
+	assert.Equal(t, 10, rl.Paths()[route].Global.Limit.Value)
+}
+
+func TestRateLimiter_Quota(t *testing.T) {
+	rl := newQuotaLimiter(t)
+	defer rl.Stop()
+	ctx := context.Background()
+
+	b, cfg, err := rl.Quota(ctx, "a", route)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, b.Tokens)
+	assert.Equal(t, 5, cfg.Limit.Value)
+
+	b, _, err = rl.Quota(ctx, "", route)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, b.Tokens)
+
+	_, _, err = rl.Quota(ctx, "c", route)
+	assert.ErrorIs(t, err, ErrUnknownQuota)
+
+	_, _, err = rl.Quota(ctx, "a", "/unknown")
+	assert.ErrorIs(t, err, ErrUnknownQuota)
+}
+
+func TestRateLimiter_ManipulateQuota(t *testing.T) {
+	rl := newQuotaLimiter(t)
+	defer rl.Stop()
+	ctx := context.Background()
+
+	b, err := rl.SetQuota(ctx, "a", route, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+
+	_, err = rl.SetQuota(ctx, "a", route, 6)
+	assert.ErrorIs(t, err, ErrInvalidQuota)
+
+	b, err = rl.TopUpQuota(ctx, "a", route, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Tokens)
+
+	b, err = rl.TopUpQuota(ctx, "a", route, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, b.Tokens)
+
+	_, err = rl.SetQuota(ctx, "a", route, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, rl.ResetQuota(ctx, "a", route))
+
+	b, _, err = rl.Quota(ctx, "a", route)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, b.Tokens)
+}
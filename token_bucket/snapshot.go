@@ -0,0 +1,153 @@
+package token_bucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/penalty"
+
+	"go.uber.org/zap"
+)
+
+// SnapshotVersion is the version of the snapshot format written by this package.
+const SnapshotVersion = 1
+
+type (
+	// SnapshotConfig configures how the state of a rate limiter is saved across restarts.
+	SnapshotConfig struct {
+		// File is the path of the snapshot file.
+		File string
+		// Interval is the interval between periodic snapshots. If zero, a snapshot is only saved when the rate limiter
+		// is stopped.
+		Interval time.Duration
+		// MaxAge is the maximum age of the buckets restored from a snapshot, measured from their last refill: older
+		// buckets are ignored and start full. If zero, all buckets are restored.
+		MaxAge time.Duration
+	}
+
+	snapshot struct {
+		Version int           `json:"version"`
+		TakenAt time.Time     `json:"taken_at"`
+		Buckets []bucketEntry `json:"buckets"`
+		Bans    []penalty.Ban `json:"bans,omitempty"`
+	}
+
+	bucketEntry struct {
+		UserID     UserID    `json:"user_id,omitempty"`
+		Path       Path      `json:"path"`
+		Tokens     int       `json:"tokens"`
+		LastRefill time.Time `json:"last_refill"`
+	}
+)
+
+// SaveSnapshot saves the state of all buckets, along with current bans, to the configured snapshot file.
+// It returns an error if snapshots have not been configured.
+func (rl *RateLimiter) SaveSnapshot() error {
+	if rl.snapshots == nil {
+		return errors.New("snapshots not configured")
+	}
+
+	s := snapshot{
+		Version: SnapshotVersion,
+		TakenAt: time.Now(),
+	}
+
+	for k, b := range rl.snapshotter.Buckets() {
+		s.Buckets = append(s.Buckets, bucketEntry{
+			UserID:     k.UserID,
+			Path:       k.Path,
+			Tokens:     b.Tokens,
+			LastRefill: b.LastRefill,
+		})
+	}
+
+	if rl.box != nil {
+		s.Bans = rl.box.Bans()
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// writing to a temporary file first guarantees that the snapshot is never left half-written
+	tmp, err := os.CreateTemp(filepath.Dir(rl.snapshots.File), filepath.Base(rl.snapshots.File)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), rl.snapshots.File)
+}
+
+// restoreSnapshot restores the state of all buckets, and bans, from the configured snapshot file, if it exists.
+func (rl *RateLimiter) restoreSnapshot() error {
+	data, err := os.ReadFile(rl.snapshots.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid snapshot %v: %w", rl.snapshots.File, err)
+	}
+
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %v", s.Version)
+	}
+
+	now := time.Now()
+	for _, e := range s.Buckets {
+		if rl.snapshots.MaxAge > 0 && now.Sub(e.LastRefill) > rl.snapshots.MaxAge {
+			continue
+		}
+
+		rl.snapshotter.Restore(Key{UserID: e.UserID, Path: e.Path}, Bucket{Tokens: e.Tokens, LastRefill: e.LastRefill})
+	}
+
+	if rl.box != nil {
+		for _, ban := range s.Bans {
+			rl.box.Restore(ban)
+		}
+	}
+
+	return nil
+}
+
+// saveSnapshots periodically saves a snapshot, until the rate limiter is stopped.
+func (rl *RateLimiter) saveSnapshots() {
+	log := logging.Logger()
+
+	ticker := time.NewTicker(rl.snapshots.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rl.SaveSnapshot(); err != nil {
+				log.Error("cannot save snapshot", zap.String("file", rl.snapshots.File), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package token_bucket
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/penalty"
+	"github.com/stretchr/testify/assert"
+)
+
+type opaqueStore struct {
+	Store
+}
+
+func TestRateLimiter_Stop_SavesSnapshotThatIsRestoredOnBuild(t *testing.T) {
+	snapshots := SnapshotConfig{File: filepath.Join(t.TempDir(), "snapshot.json")}
+	box, err := penalty.NewBox(penalty.Policy{Violations: 1, Window: time.Minute, BanDuration: time.Minute})
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	rl, err := NewRateLimiterBuilder().SetLimit(route, limit).RegisterUser(userID).SetSnapshots(snapshots).Build()
+	assert.NoError(t, err)
+	assert.True(t, rl.Take(req).Allowed())
+	rl.Stop()
+
+	rl, err = NewRateLimiterBuilder().
+		SetLimit(route, limit).
+		RegisterUser(userID).
+		SetPenaltyBox(box).
+		SetSnapshots(snapshots).
+		Build()
+	assert.NoError(t, err)
+	assert.Equal(t, common.Denied, rl.Take(req).Outcome)
+	rl.Stop()
+
+	box, err = penalty.NewBox(penalty.Policy{Violations: 1, Window: time.Minute, BanDuration: time.Minute})
+	assert.NoError(t, err)
+	rl, err = NewRateLimiterBuilder().
+		SetLimit(route, limit).
+		RegisterUser(userID).
+		SetPenaltyBox(box).
+		SetSnapshots(snapshots).
+		Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+	assert.Equal(t, common.Banned, rl.Take(req).Outcome)
+}
+
+func TestRateLimiter_SaveSnapshot_Periodically(t *testing.T) {
+	snapshots := SnapshotConfig{File: filepath.Join(t.TempDir(), "snapshot.json"), Interval: 50 * time.Millisecond}
+
+	rl, err := NewRateLimiterBuilder().SetLimit(route, limit).RegisterUser(userID).SetSnapshots(snapshots).Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(snapshots.File)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRateLimiterBuilder_Build_IgnoresStaleBuckets(t *testing.T) {
+	snapshots := SnapshotConfig{File: filepath.Join(t.TempDir(), "snapshot.json"), MaxAge: time.Minute}
+	store := NewMemoryStore()
+	store.Restore(Key{UserID: userID, Path: route}, Bucket{Tokens: 0, LastRefill: time.Now().Add(-time.Hour)})
+	store.Restore(Key{UserID: "fresh", Path: route}, Bucket{Tokens: 0, LastRefill: time.Now()})
+	rl, err := NewRateLimiterBuilder().SetLimit(route, limit).SetStore(store).SetSnapshots(snapshots).Build()
+	assert.NoError(t, err)
+	rl.Stop()
+
+	store = NewMemoryStore()
+	rl, err = NewRateLimiterBuilder().SetLimit(route, limit).SetStore(store).SetSnapshots(snapshots).Build()
+	assert.NoError(t, err)
+	defer rl.Stop()
+
+	buckets := store.Buckets()
+	assert.Len(t, buckets, 1)
+	assert.Contains(t, buckets, Key{UserID: "fresh", Path: route})
+}
+
+func TestRateLimiterBuilder_Build_FailsIfSnapshotVersionIsUnsupported(t *testing.T) {
+	snapshots := SnapshotConfig{File: filepath.Join(t.TempDir(), "snapshot.json")}
+	assert.NoError(t, os.WriteFile(snapshots.File, []byte(`{"version": 42}`), 0o600))
+
+	rl, err := NewRateLimiterBuilder().SetLimit(route, limit).SetSnapshots(snapshots).Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiterBuilder_Build_FailsIfStoreDoesNotSupportSnapshots(t *testing.T) {
+	snapshots := SnapshotConfig{File: filepath.Join(t.TempDir(), "snapshot.json")}
+
+	rl, err := NewRateLimiterBuilder().
+		SetLimit(route, limit).
+		SetStore(opaqueStore{NewMemoryStore()}).
+		SetSnapshots(snapshots).
+		Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_SaveSnapshot_FailsIfNotConfigured(t *testing.T) {
+	rl, _ := NewRateLimiterBuilder().SetLimit(route, limit).Build()
+	defer rl.Stop()
+
+	assert.Error(t, rl.SaveSnapshot())
+}
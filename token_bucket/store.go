@@ -0,0 +1,193 @@
+package token_bucket
+
+import (
+	"context"
+	"time"
+
+	"github.com/fedragon/rate-limiter/concurrent"
+)
+
+type (
+	// Key identifies a bucket. Global buckets, shared by all users of a path, have an empty UserID.
+	Key struct {
+		UserID UserID
+		Path   Path
+	}
+
+	// Bucket represents the state of a bucket.
+	Bucket struct {
+		Tokens int
+		// LastRefill is the last time the bucket has been refilled.
+		LastRefill time.Time
+	}
+
+	// Store stores the state of buckets. All its operations must be atomic, since buckets are concurrently accessed.
+	// Buckets are refilled lazily, based on the time elapsed since their last refill, whenever they are accessed: a
+	// bucket that does not exist yet is considered full.
+	Store interface {
+		// Take refills the bucket identified by key according to cfg, then consumes n tokens from it if available.
+		// It returns the state of the bucket after the operation and whether the tokens have been consumed.
+		Take(ctx context.Context, key Key, cfg Config, n int) (Bucket, bool, error)
+		// Refill adds n tokens to the bucket identified by key, without exceeding its limit.
+		Refill(ctx context.Context, key Key, cfg Config, n int) (Bucket, error)
+		// Set refills the bucket identified by key according to cfg, then sets its number of tokens to n.
+		Set(ctx context.Context, key Key, cfg Config, n int) (Bucket, error)
+		// Get returns the current state of the bucket identified by key, refilled according to cfg.
+		Get(ctx context.Context, key Key, cfg Config) (Bucket, error)
+		// Reset fills up the bucket identified by key.
+		Reset(ctx context.Context, key Key, cfg Config) error
+	}
+
+	// Snapshotter is implemented by stores whose state can be saved to, and restored from, a snapshot.
+	Snapshotter interface {
+		// Buckets returns the state of all buckets.
+		Buckets() map[Key]Bucket
+		// Restore sets the state of the bucket identified by key.
+		Restore(key Key, b Bucket)
+	}
+
+	// MemoryStore is a Store that keeps all buckets in memory.
+	MemoryStore struct {
+		buckets *concurrent.Map[Key, Bucket]
+		now     func() time.Time
+	}
+)
+
+// GlobalKey returns the key of the global bucket of a path.
+func GlobalKey(path Path) Key {
+	return Key{Path: path}
+}
+
+// NewBucket returns a full bucket.
+func NewBucket(cfg Config, now time.Time) Bucket {
+	return Bucket{Tokens: cfg.Limit.Value, LastRefill: now}
+}
+
+// Refilled returns the bucket after adding all the tokens it should have received, according to cfg, since its last
+// refill.
+func (b Bucket) Refilled(cfg Config, now time.Time) Bucket {
+	if cfg.Refill.Interval <= 0 || now.Before(b.LastRefill) {
+		return b
+	}
+
+	intervals := int(now.Sub(b.LastRefill) / cfg.Refill.Interval)
+	if intervals == 0 {
+		return b
+	}
+
+	b.LastRefill = b.LastRefill.Add(time.Duration(intervals) * cfg.Refill.Interval)
+	b.Tokens = b.Tokens + intervals*cfg.Refill.Value
+	if b.Tokens > cfg.Limit.Value {
+		b.Tokens = cfg.Limit.Value
+	}
+
+	return b
+}
+
+// NextRefill returns the time of the next refill of the bucket.
+func (b Bucket) NextRefill(cfg Config) time.Time {
+	return b.LastRefill.Add(cfg.Refill.Interval)
+}
+
+// NewMemoryStore returns a new, empty, in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: concurrent.NewMap[Key, Bucket](),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) update(key Key, cfg Config, f func(b Bucket) Bucket) Bucket {
+	now := s.now()
+
+	return s.buckets.Update(key, func(b Bucket, exists bool) Bucket {
+		if !exists {
+			b = NewBucket(cfg, now)
+		}
+
+		return f(b.Refilled(cfg, now))
+	})
+}
+
+// Take refills the bucket identified by key according to cfg, then consumes n tokens from it if available.
+func (s *MemoryStore) Take(_ context.Context, key Key, cfg Config, n int) (Bucket, bool, error) {
+	var taken bool
+	b := s.update(key, cfg, func(b Bucket) Bucket {
+		if b.Tokens >= n {
+			b.Tokens -= n
+			taken = true
+		}
+
+		return b
+	})
+
+	return b, taken, nil
+}
+
+// Refill adds n tokens to the bucket identified by key, without exceeding its limit.
+func (s *MemoryStore) Refill(_ context.Context, key Key, cfg Config, n int) (Bucket, error) {
+	return s.update(key, cfg, func(b Bucket) Bucket {
+		b.Tokens += n
+		if b.Tokens > cfg.Limit.Value {
+			b.Tokens = cfg.Limit.Value
+		}
+
+		return b
+	}), nil
+}
+
+// Set refills the bucket identified by key according to cfg, then sets its number of tokens to n.
+func (s *MemoryStore) Set(_ context.Context, key Key, cfg Config, n int) (Bucket, error) {
+	return s.update(key, cfg, func(b Bucket) Bucket {
+		b.Tokens = n
+		return b
+	}), nil
+}
+
+// Get returns the current state of the bucket identified by key, refilled according to cfg.
+func (s *MemoryStore) Get(_ context.Context, key Key, cfg Config) (Bucket, error) {
+	now := s.now()
+	b, exists := s.buckets.Get(key)
+	if !exists {
+		return NewBucket(cfg, now), nil
+	}
+
+	return b.Refilled(cfg, now), nil
+}
+
+// Reset fills up the bucket identified by key.
+func (s *MemoryStore) Reset(_ context.Context, key Key, cfg Config) error {
+	s.buckets.Put(key, NewBucket(cfg, s.now()))
+	return nil
+}
+
+// Evict removes the buckets that have not been refilled for longer than idle. Since removed buckets are considered
+// full, idle should be at least the time it takes to refill an empty bucket, so that evicting a bucket does not grant
+// additional tokens. It returns the number of removed buckets.
+func (s *MemoryStore) Evict(idle time.Duration) int {
+	now := s.now()
+
+	return s.buckets.DeleteIf(func(_ Key, b Bucket) bool {
+		return now.Sub(b.LastRefill) > idle
+	})
+}
+
+// Len returns the number of buckets kept in memory.
+func (s *MemoryStore) Len() int {
+	return s.buckets.Size()
+}
+
+// Buckets returns the state of all buckets, as last updated.
+func (s *MemoryStore) Buckets() map[Key]Bucket {
+	buckets := make(map[Key]Bucket)
+	for t := range s.buckets.Iterate() {
+		buckets[t.Key] = t.Value
+	}
+
+	return buckets
+}
+
+// Restore sets the state of the bucket identified by key.
+func (s *MemoryStore) Restore(key Key, b Bucket) {
+	s.buckets.Put(key, b)
+}
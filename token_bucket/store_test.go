@@ -0,0 +1,160 @@
+package token_bucket
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	key = Key{UserID: userID, Path: route}
+	cfg = Config{
+		Limit:  common.Rate{Value: 3, Interval: time.Minute},
+		Refill: common.Rate{Value: 1, Interval: time.Minute},
+	}
+)
+
+func newMemoryStore(now *time.Time) *MemoryStore {
+	s := NewMemoryStore()
+	s.now = func() time.Time { return *now }
+
+	return s
+}
+
+func TestBucket_Refilled(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	b := Bucket{Tokens: 0, LastRefill: now}
+
+	assert.Equal(t, b, b.Refilled(cfg, now.Add(59*time.Second)))
+	assert.Equal(
+		t,
+		Bucket{Tokens: 2, LastRefill: now.Add(2 * time.Minute)},
+		b.Refilled(cfg, now.Add(2*time.Minute+30*time.Second)),
+	)
+	assert.Equal(
+		t,
+		Bucket{Tokens: 3, LastRefill: now.Add(10 * time.Minute)},
+		b.Refilled(cfg, now.Add(10*time.Minute)),
+	)
+}
+
+func TestMemoryStore_Take(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := newMemoryStore(&now)
+	ctx := context.Background()
+
+	b, taken, err := s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, Bucket{Tokens: 1, LastRefill: now}, b)
+
+	b, taken, err = s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.False(t, taken)
+	assert.Equal(t, 1, b.Tokens)
+
+	now = now.Add(time.Minute)
+	b, taken, err = s.Take(ctx, key, cfg, 2)
+	assert.NoError(t, err)
+	assert.True(t, taken)
+	assert.Equal(t, Bucket{Tokens: 0, LastRefill: now}, b)
+}
+
+func TestMemoryStore_ConcurrentTake(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := newMemoryStore(&now)
+	var taken sync.Map
+	consumer := func(wg *sync.WaitGroup, id int) {
+		defer wg.Done()
+		if _, ok, _ := s.Take(context.Background(), key, cfg, 1); ok {
+			taken.Store(id, true)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go consumer(&wg, i)
+	}
+	wg.Wait()
+
+	count := 0
+	taken.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, cfg.Limit.Value, count)
+}
+
+func TestMemoryStore_Refill(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := newMemoryStore(&now)
+	ctx := context.Background()
+
+	_, _, _ = s.Take(ctx, key, cfg, 3)
+	b, err := s.Refill(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+
+	b, err = s.Refill(ctx, key, cfg, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Limit.Value, b.Tokens)
+}
+
+func TestMemoryStore_GetAndReset(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := newMemoryStore(&now)
+	ctx := context.Background()
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, NewBucket(cfg, now), b)
+
+	_, _, _ = s.Take(ctx, key, cfg, 3)
+	now = now.Add(time.Minute)
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, Bucket{Tokens: 1, LastRefill: now}, b)
+
+	assert.NoError(t, s.Reset(ctx, key, cfg))
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, NewBucket(cfg, now), b)
+}
+
+func TestMemoryStore_Set(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := newMemoryStore(&now)
+	ctx := context.Background()
+
+	b, err := s.Set(ctx, key, cfg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, Bucket{Tokens: 1, LastRefill: now}, b)
+
+	b, err = s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Tokens)
+}
+
+func TestMemoryStore_Evict(t *testing.T) {
+	now := time.Date(2022, 10, 5, 13, 0, 0, 0, time.UTC)
+	s := newMemoryStore(&now)
+	ctx := context.Background()
+	other := Key{UserID: "other", Path: route}
+
+	_, _, _ = s.Take(ctx, key, cfg, 3)
+	now = now.Add(2 * time.Minute)
+	_, _, _ = s.Take(ctx, other, cfg, 1)
+	now = now.Add(2 * time.Minute)
+
+	assert.Equal(t, 1, s.Evict(3*time.Minute))
+	assert.Equal(t, 1, s.Len())
+
+	b, err := s.Get(ctx, key, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, NewBucket(cfg, now), b)
+}
@@ -3,15 +3,16 @@ package token_bucket
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
+	"github.com/fedragon/rate-limiter/access"
 	"github.com/fedragon/rate-limiter/common"
 	"github.com/fedragon/rate-limiter/concurrent"
 	"github.com/fedragon/rate-limiter/logging"
+	"github.com/fedragon/rate-limiter/penalty"
+	"github.com/fedragon/rate-limiter/tracing"
 
 	"go.uber.org/zap"
 )
@@ -23,176 +24,373 @@ type (
 	Config struct {
 		Limit  common.Rate
 		Refill common.Rate
+		// Global, if set, limits the requests issued on the path by all users together, in addition to each user's
+		// own limit. Its own Global field is ignored.
+		Global *Config
 	}
 
+	// UserExtractor extracts the ID of the user issuing a request.
+	UserExtractor func(r *http.Request) UserID
+
 	// RateLimiterBuilder builds a rate limiter.
 	RateLimiterBuilder struct {
-		paths *concurrent.Map[Path, Config]
-		users *concurrent.Set[UserID]
+		paths     *concurrent.Map[Path, Config]
+		users     *concurrent.Set[UserID]
+		extractor UserExtractor
+		box       *penalty.Box
+		lists     *access.Lists
+		store     Store
+		snapshots *SnapshotConfig
+		observer  common.Observer
 	}
 
 	// RateLimiter acts as an HTTP middleware that rate-limits traffic according to the `token bucket` algorithm, which
 	// means that users can only issue requests at a given rate (configurable by endpoint) and further requests are
 	// dropped until their quota is refilled.
-	// Since it uses goroutines to manage the quota refilling logic, it needs to be explicitly stopped by invoking the
-	// Stop() method during the HTTP server shutdown process.
+	// Quotas are kept in a Store and refilled lazily, whenever they are accessed. The rate limiter should nevertheless
+	// be stopped, by invoking the Stop() method during the HTTP server shutdown process, to clean up all used
+	// resources.
 	RateLimiter struct {
-		paths      *concurrent.Map[Path, Config]
-		userQuotas *concurrent.Map[UserID, *concurrent.Map[Path, int]]
-		cancel     context.CancelFunc
-		once       sync.Once
+		paths       *concurrent.Map[Path, Config]
+		users       *concurrent.Set[UserID]
+		store       Store
+		extractor   UserExtractor
+		box         *penalty.Box
+		lists       *access.Lists
+		snapshots   *SnapshotConfig
+		snapshotter Snapshotter
+		observer    common.Observer
+		ctx         context.Context
+		cancel      context.CancelFunc
 	}
 )
 
+// Validate returns an error if the limit, the refill value or the refill interval of the configuration, or of its
+// global configuration, is not positive: buckets would otherwise never be refilled.
+func (c Config) Validate() error {
+	if c.Limit.Value <= 0 {
+		return errors.New("limit must be positive")
+	}
+
+	if c.Refill.Value <= 0 || c.Refill.Interval <= 0 {
+		return errors.New("refill must be positive")
+	}
+
+	if c.Global != nil {
+		return c.Global.Validate()
+	}
+
+	return nil
+}
+
 // NewRateLimiterBuilder instantiates a rate limiter builder.
 func NewRateLimiterBuilder() *RateLimiterBuilder {
 	return &RateLimiterBuilder{
-		paths: concurrent.NewMap[Path, Config](),
-		users: concurrent.NewSet[UserID](),
+		paths:     concurrent.NewMap[Path, Config](),
+		users:     concurrent.NewSet[UserID](),
+		extractor: FromHeader("X-User-ID"),
+		store:     NewMemoryStore(),
+	}
+}
+
+// FromHeader returns a UserExtractor that reads the user ID from the provided request header.
+func FromHeader(name string) UserExtractor {
+	return func(r *http.Request) UserID {
+		return UserID(r.Header.Get(name))
 	}
 }
 
 // SetLimit sets a limit on a path. The path needs to be absolute and start with a leading '/'.
+// If cfg.Global is set, the path is also protected by a bucket shared by all users: requests are only served if both
+// the user's and the global bucket allow them.
 func (b *RateLimiterBuilder) SetLimit(path string, cfg Config) *RateLimiterBuilder {
 	b.paths.Put(Path(path), cfg)
 	return b
 }
 
-// RegisterUser registers a user.
+// RegisterUser registers a user. User IDs must not be empty, since the empty ID identifies global buckets.
 func (b *RateLimiterBuilder) RegisterUser(ID string) *RateLimiterBuilder {
 	b.users.Put(UserID(ID))
 	return b
 }
 
-// Build builds a rate limiter, setting quotas for each configured user and path.
-// It returns an error if no limits have been configured.
+// SetUserExtractor sets the function used to identify the user issuing a request. By default, users are identified by
+// the value of the `X-User-ID` header.
+func (b *RateLimiterBuilder) SetUserExtractor(extractor UserExtractor) *RateLimiterBuilder {
+	b.extractor = extractor
+	return b
+}
+
+// SetPenaltyBox sets a penalty box that temporarily bans users who repeatedly exceed their limits. Requests issued by
+// banned users are rejected before their quotas are even evaluated.
+func (b *RateLimiterBuilder) SetPenaltyBox(box *penalty.Box) *RateLimiterBuilder {
+	b.box = box
+	return b
+}
+
+// SetStore sets the store that keeps the state of all buckets. By default, buckets are kept in memory.
+func (b *RateLimiterBuilder) SetStore(store Store) *RateLimiterBuilder {
+	b.store = store
+	return b
+}
+
+// SetSnapshots configures the rate limiter to save the state of all buckets, along with current bans, to a file when
+// it is stopped (and, optionally, periodically), and to restore it when it is built, so that quotas survive restarts.
+// The configured store must implement Snapshotter.
+func (b *RateLimiterBuilder) SetSnapshots(cfg SnapshotConfig) *RateLimiterBuilder {
+	b.snapshots = &cfg
+	return b
+}
+
+// SetAccessLists sets the allow and deny lists that are checked before evaluating any quota: allowlisted requests are
+// always served, while denylisted ones are always rejected. Users are matched against the lists as identified by the
+// user extractor.
+func (b *RateLimiterBuilder) SetAccessLists(lists *access.Lists) *RateLimiterBuilder {
+	b.lists = lists
+	return b
+}
+
+// SetObserver sets an observer, such as metrics.Collector, notified of the decisions taken by the HTTP middleware.
+func (b *RateLimiterBuilder) SetObserver(observer common.Observer) *RateLimiterBuilder {
+	b.observer = observer
+	return b
+}
+
+// Build builds a rate limiter, restoring the state of its buckets from a snapshot, if configured.
+// It returns an error if no limits have been configured, if an empty user ID has been registered, or if the snapshot
+// cannot be restored.
 func (b *RateLimiterBuilder) Build() (*RateLimiter, error) {
 	if b.paths.Size() == 0 {
 		return nil, errors.New("no rate limit configured")
 	}
 
-	rl := RateLimiter{
-		paths:      b.paths,
-		userQuotas: concurrent.NewMap[UserID, *concurrent.Map[Path, int]](),
+	if b.users.Contains("") {
+		// the empty user ID identifies global buckets
+		return nil, errors.New("user ID must not be empty")
 	}
 
-	for u := range b.users.Iterate() {
-		for t := range b.paths.Iterate() {
-			path := t.Key
-			limit := t.Value
-			uqs, ok := rl.userQuotas.Get(u)
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &RateLimiter{
+		ctx:       ctx,
+		cancel:    cancel,
+		paths:     b.paths,
+		users:     b.users,
+		store:     b.store,
+		extractor: b.extractor,
+		box:       b.box,
+		lists:     b.lists,
+		snapshots: b.snapshots,
+		observer:  b.observer,
+	}
 
-			if !ok {
-				uqs = concurrent.NewMap[Path, int]()
-				rl.userQuotas.Put(u, uqs)
-			}
+	if rl.snapshots != nil {
+		snapshotter, ok := rl.store.(Snapshotter)
+		if !ok {
+			cancel()
+			return nil, errors.New("store does not support snapshots")
+		}
+		rl.snapshotter = snapshotter
 
-			uqs.Put(path, limit.Limit.Value)
+		if err := rl.restoreSnapshot(); err != nil {
+			cancel()
+			return nil, err
+		}
+
+		if rl.snapshots.Interval > 0 {
+			go rl.saveSnapshots()
 		}
 	}
 
-	return &rl, nil
+	return rl, nil
 }
 
-// Stop stops the rate limiter, cleaning up all used resources.
+// Stop stops the rate limiter, cleaning up all used resources and saving a snapshot of its state, if configured.
 func (rl *RateLimiter) Stop() {
 	rl.cancel()
+
+	if rl.snapshots != nil {
+		if err := rl.SaveSnapshot(); err != nil {
+			logging.Logger().Error("cannot save snapshot", zap.String("file", rl.snapshots.File), zap.Error(err))
+		}
+	}
+}
+
+// Take consumes a unit of quota for the user and path of the provided request, if available. If the path has a global
+// limit, a unit of global quota is consumed as well: if either is unavailable, nothing is consumed.
+func (rl *RateLimiter) Take(r *http.Request) common.Decision {
+	d, _, _ := rl.take(r)
+	return d
+}
+
+// take consumes a unit of quota for the request, returning the decision along with the user and path it was taken on.
+func (rl *RateLimiter) take(r *http.Request) (common.Decision, UserID, Path) {
+	userID, path := rl.identify(r)
+	d := rl.decide(r, userID, path)
+
+	return d, userID, path
 }
 
-func (rl *RateLimiter) getQuota(userID UserID, path Path) (int, bool) {
-	if user, exists := rl.userQuotas.Get(userID); exists {
-		return user.Get(path)
+func (rl *RateLimiter) decide(r *http.Request, userID UserID, path Path) common.Decision {
+	if rl.lists != nil {
+		if outcome, ok := rl.lists.Check(r, string(userID)); ok {
+			return common.Decision{Outcome: outcome}
+		}
 	}
 
-	return 0, false
+	limit, exists := rl.paths.Get(path)
+	if rl.box != nil {
+		if until, banned := rl.box.Banned(string(userID)); banned {
+			d := common.Decision{Outcome: common.Banned, RetryAfter: time.Until(until)}
+			if exists {
+				d.Limit = limit.Refill.Value
+			}
+
+			return d
+		}
+	}
+
+	if !exists || !rl.users.Contains(userID) {
+		return common.Decision{Outcome: common.Unknown}
+	}
+
+	ctx := r.Context()
+	b, taken, err := rl.store.Take(ctx, Key{UserID: userID, Path: path}, limit, 1)
+	if err != nil {
+		return rl.failed(err, userID, path)
+	}
+
+	if !taken {
+		rl.violation(userID)
+		return denied(b, limit)
+	}
+
+	if global := limit.Global; global != nil {
+		gb, taken, err := rl.store.Take(ctx, GlobalKey(path), *global, 1)
+		if err != nil || !taken {
+			if _, err := rl.store.Refill(ctx, Key{UserID: userID, Path: path}, limit, 1); err != nil {
+				logging.Logger().Error("cannot refund quota", zap.String("user", string(userID)), zap.Error(err))
+			}
+		}
+
+		if err != nil {
+			return rl.failed(err, userID, path)
+		}
+
+		if !taken {
+			return denied(gb, *global)
+		}
+
+		if gb.Tokens < b.Tokens {
+			return allowed(gb, *global)
+		}
+	}
+
+	return allowed(b, limit)
 }
 
-func (rl *RateLimiter) decrQuota(userID UserID, path Path) {
-	user, ok := rl.userQuotas.Get(userID)
-	if !ok {
-		return
+func allowed(b Bucket, cfg Config) common.Decision {
+	return common.Decision{
+		Outcome:   common.Allowed,
+		Limit:     cfg.Refill.Value,
+		Remaining: b.Tokens,
 	}
+}
 
-	if quota, ok := user.Get(path); ok && quota > 0 {
-		user.Put(path, quota-1)
+func denied(b Bucket, cfg Config) common.Decision {
+	return common.Decision{
+		Outcome:    common.Denied,
+		Limit:      cfg.Refill.Value,
+		RetryAfter: time.Until(b.NextRefill(cfg)),
 	}
 }
 
-func (rl *RateLimiter) getRefillRate(path Path) (*common.Rate, error) {
-	limit, ok := rl.paths.Get(path)
+func (rl *RateLimiter) failed(err error, userID UserID, path Path) common.Decision {
+	logging.Logger().Error(
+		"cannot access quota",
+		zap.String("user", string(userID)),
+		zap.String("path", string(path)),
+		zap.Error(err),
+	)
+
+	return common.Decision{Outcome: common.Failed}
+}
 
-	if !ok {
-		return nil, fmt.Errorf("unknown path: %v", path)
+// violation records a denial of the user's own bucket with the penalty box, if any. Denials of the global bucket are
+// not the user's fault and are never recorded.
+func (rl *RateLimiter) violation(userID UserID) {
+	if rl.box == nil {
+		return
 	}
 
-	return &limit.Refill, nil
+	if until, banned := rl.box.Violation(string(userID)); banned {
+		logging.Logger().Info("banning user", zap.String("user", string(userID)), zap.Time("until", until))
+	}
 }
 
-func (rl *RateLimiter) refill(ctx context.Context, path Path, limit Config) {
-	log := logging.Logger()
+// Refund gives back the unit of quota consumed by a previous invocation of Take, which returned d, if the request was
+// allowed.
+func (rl *RateLimiter) Refund(r *http.Request, d common.Decision) {
+	if d.Outcome != common.Allowed {
+		return
+	}
 
-	ticker := time.NewTicker(limit.Refill.Interval)
-	defer ticker.Stop()
+	userID, path := rl.identify(r)
+	limit, exists := rl.paths.Get(path)
+	if !exists || !rl.users.Contains(userID) {
+		return
+	}
 
-	log.Debug("starting refiller", zap.String("path", string(path)), zap.Duration("interval", limit.Refill.Interval))
+	ctx := r.Context()
+	if _, err := rl.store.Refill(ctx, Key{UserID: userID, Path: path}, limit, 1); err != nil {
+		logging.Logger().Error("cannot refund quota", zap.String("user", string(userID)), zap.Error(err))
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Debug("stopping refiller", zap.String("path", string(path)))
-			return
-		case <-ticker.C:
-			for t := range rl.userQuotas.Iterate() {
-				quotas := t.Value
-				current, _ := quotas.Get(path)
-				next := current + limit.Refill.Value
-				if next > limit.Limit.Value {
-					next = limit.Limit.Value
-				}
-
-				quotas.Put(path, next)
-			}
-		default:
+	if global := limit.Global; global != nil {
+		if _, err := rl.store.Refill(ctx, GlobalKey(path), *global, 1); err != nil {
+			logging.Logger().Error("cannot refund global quota", zap.String("path", string(path)), zap.Error(err))
 		}
 	}
 }
 
 // Handle returns an HTTP middleware that applies preconfigured rate-limiting rules to all received requests.
 func (rl *RateLimiter) Handle(next http.Handler) http.Handler {
-	rl.once.Do(func() {
-		ctx, cancel := context.WithCancel(context.Background())
-		rl.cancel = cancel
-
-		for t := range rl.paths.Iterate() {
-			go rl.refill(ctx, t.Key, t.Value)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, userID, path := rl.take(r)
+		r = tracing.Record(r, "token_bucket", string(userID), string(path), d)
+		if rl.observer != nil {
+			rl.observer.Observe(r, "token_bucket", rl.route(path), d)
 		}
-	})
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID := UserID(r.Header.Get("X-User-ID"))
-		path := Path(r.URL.Path)
-		quota, exists := rl.getQuota(userID, path)
-		if !exists {
+		switch d.Outcome {
+		case common.Unknown:
 			w.WriteHeader(http.StatusUnauthorized)
 			return
-		}
-
-		if quota == 0 {
-			rate, err := rl.getRefillRate(path)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-				return
-			}
-
+		case common.Denylisted:
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case common.Failed:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case common.Denied, common.Banned:
+			w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(d.Limit))
+			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(d.RetryAfter.Seconds())))
 			w.WriteHeader(http.StatusTooManyRequests)
-			w.Header().Add("X-Ratelimit-Limit", strconv.Itoa(rate.Value))
-			w.Header().Add("X-Ratelimit-Retry-After", strconv.Itoa(int(rate.Interval.Seconds())))
 			return
 		}
 
-		rl.decrQuota(userID, path)
-
 		next.ServeHTTP(w, r)
 	})
 }
+
+// route returns the path if it is configured, or an empty string otherwise.
+func (rl *RateLimiter) route(path Path) string {
+	if _, ok := rl.paths.Get(path); ok {
+		return string(path)
+	}
+
+	return ""
+}
+
+func (rl *RateLimiter) identify(r *http.Request) (UserID, Path) {
+	return rl.extractor(r), Path(r.URL.Path)
+}
@@ -6,7 +6,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fedragon/rate-limiter/access"
 	"github.com/fedragon/rate-limiter/common"
+	"github.com/fedragon/rate-limiter/penalty"
 	"github.com/fedragon/rate-limiter/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -37,6 +39,13 @@ func TestRateLimiterBuilder_Build_FailsIfLimitsAreNotConfigured(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestRateLimiterBuilder_Build_FailsIfUserIDIsEmpty(t *testing.T) {
+	rl, err := NewRateLimiterBuilder().SetLimit(route, limit).RegisterUser("").Build()
+
+	assert.Nil(t, rl)
+	assert.Error(t, err)
+}
+
 func Test_ServerReturns401_IfUserIsUnknown(t *testing.T) {
 	rlb := NewRateLimiterBuilder()
 	rl, _ := rlb.SetLimit(route, limit).Build()
@@ -104,11 +113,210 @@ func Test_ServerReturns429_OnTooManyRequests(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, statusCode)
 }
 
+func TestRateLimiter_Refund_GivesBackQuota(t *testing.T) {
+	rlb := NewRateLimiterBuilder()
+	rl, _ := rlb.SetLimit(route, limit).RegisterUser(userID).Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	d := rl.Take(req)
+	assert.True(t, d.Allowed())
+	denied := rl.Take(req)
+	assert.Equal(t, common.Denied, denied.Outcome)
+
+	// denied requests have nothing to give back
+	rl.Refund(req, denied)
+	assert.Equal(t, common.Denied, rl.Take(req).Outcome)
+
+	rl.Refund(req, d)
+	assert.True(t, rl.Take(req).Allowed())
+}
+
+func Test_ServerIdentifiesUsers_WithCustomExtractor(t *testing.T) {
+	rlb := NewRateLimiterBuilder()
+	rl, _ := rlb.SetLimit(route, limit).
+		RegisterUser("abc").
+		SetUserExtractor(FromHeader("X-API-Key")).
+		Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-API-Key", "abc")
+	assert.True(t, rl.Take(req).Allowed())
+
+	req.Header.Set("X-API-Key", userID)
+	assert.Equal(t, common.Unknown, rl.Take(req).Outcome)
+}
+
+func Test_ServerReturns429_WhenGlobalLimitIsExceeded(t *testing.T) {
+	otherUserID := "1-1-1-1-1"
+	rlb := NewRateLimiterBuilder()
+	rl, _ := rlb.SetLimit(route, Config{
+		Limit:  limit.Limit,
+		Refill: limit.Refill,
+		Global: &limit,
+	}).
+		RegisterUser(userID).
+		RegisterUser(otherUserID).
+		Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+	otherReq := httptest.NewRequest("GET", route, nil)
+	otherReq.Header.Set("X-User-ID", otherUserID)
+
+	d := rl.Take(req)
+	assert.True(t, d.Allowed())
+	assert.Equal(t, common.Denied, rl.Take(otherReq).Outcome)
+
+	// the denied request has not consumed the other user's quota
+	rl.Refund(req, d)
+	assert.True(t, rl.Take(otherReq).Allowed())
+}
+
+func Test_ServerReturns429_WhenUserIsBanned(t *testing.T) {
+	box, err := penalty.NewBox(penalty.Policy{Violations: 1, Window: time.Minute, BanDuration: time.Minute})
+	assert.NoError(t, err)
+	rlb := NewRateLimiterBuilder()
+	rl, _ := rlb.SetLimit(route, limit).RegisterUser(userID).SetPenaltyBox(box).Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	d := rl.Take(req)
+	assert.True(t, d.Allowed())
+	assert.Equal(t, common.Denied, rl.Take(req).Outcome)
+
+	rl.Refund(req, d)
+	banned := rl.Take(req)
+	assert.Equal(t, common.Banned, banned.Outcome)
+	assert.Equal(t, limit.Refill.Value, banned.Limit)
+
+	box.Lift(userID)
+	assert.True(t, rl.Take(req).Allowed())
+}
+
+func TestRateLimiter_Take_DoesNotPenalizeGlobalLimitDenials(t *testing.T) {
+	otherUserID := "1-1-1-1-1"
+	box, err := penalty.NewBox(penalty.Policy{Violations: 1, Window: time.Minute, BanDuration: time.Minute})
+	assert.NoError(t, err)
+	rlb := NewRateLimiterBuilder()
+	rl, _ := rlb.SetLimit(route, Config{
+		Limit:  limit.Limit,
+		Refill: limit.Refill,
+		Global: &limit,
+	}).
+		RegisterUser(userID).
+		RegisterUser(otherUserID).
+		SetPenaltyBox(box).
+		Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+	otherReq := httptest.NewRequest("GET", route, nil)
+	otherReq.Header.Set("X-User-ID", otherUserID)
+
+	d := rl.Take(req)
+	assert.True(t, d.Allowed())
+	assert.Equal(t, common.Denied, rl.Take(otherReq).Outcome)
+
+	_, banned := box.Banned(otherUserID)
+	assert.False(t, banned)
+}
+
+func TestRateLimiter_Take_ChecksAccessListsFirst(t *testing.T) {
+	lists := access.NewLists()
+	lists.Allow.AddUser(userID)
+	lists.Deny.AddUser("1-1-1-1-1")
+	rlb := NewRateLimiterBuilder()
+	rl, _ := rlb.SetLimit(route, limit).RegisterUser(userID).SetAccessLists(lists).Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+	assert.Equal(t, common.Allowlisted, rl.Take(req).Outcome)
+	assert.Equal(t, common.Allowlisted, rl.Take(req).Outcome)
+
+	req.Header.Set("X-User-ID", "1-1-1-1-1")
+	assert.Equal(t, common.Denylisted, rl.Take(req).Outcome)
+}
+
+func TestRateLimiter_Take_MatchesAccessListsWithUserExtractor(t *testing.T) {
+	lists := access.NewLists()
+	lists.Deny.AddUser("abc")
+	rl, _ := NewRateLimiterBuilder().
+		SetLimit(route, limit).
+		RegisterUser("abc").
+		SetUserExtractor(FromHeader("X-Client")).
+		SetAccessLists(lists).
+		Build()
+	defer rl.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-Client", "abc")
+	assert.Equal(t, common.Denylisted, rl.Take(req).Outcome)
+}
+
+func TestRateLimiter_Take_SharesQuotasThroughStore(t *testing.T) {
+	store := NewMemoryStore()
+	rl1, _ := NewRateLimiterBuilder().SetLimit(route, limit).RegisterUser(userID).SetStore(store).Build()
+	defer rl1.Stop()
+	rl2, _ := NewRateLimiterBuilder().SetLimit(route, limit).RegisterUser(userID).SetStore(store).Build()
+	defer rl2.Stop()
+
+	req := httptest.NewRequest("GET", route, nil)
+	req.Header.Set("X-User-ID", userID)
+
+	assert.True(t, rl1.Take(req).Allowed())
+	assert.Equal(t, common.Denied, rl2.Take(req).Outcome)
+}
+
+func TestRateLimiter_Handle_PropagatesDecision(t *testing.T) {
+	rl, _ := NewRateLimiterBuilder().SetLimit(route, limit).RegisterUser(userID).Build()
+	defer rl.Stop()
+
+	var got common.Decision
+	h := rl.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = common.DecisionFromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, route, nil)
+	r.Header.Set("X-User-ID", userID)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, common.Allowed, got.Outcome)
+	assert.Equal(t, 1, got.Limit)
+	assert.Equal(t, 0, got.Remaining)
+}
+
 func sendRequest(route string, client *http.Client) (int, error) {
 	req, _ := http.NewRequest("GET", route, nil)
 	req.Header.Set("X-User-ID", userID)
 
 	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
 	defer res.Body.Close()
-	return res.StatusCode, err
+
+	return res.StatusCode, nil
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, limit.Validate())
+
+	invalid := []Config{
+		{Limit: common.Rate{Value: 0}, Refill: limit.Refill},
+		{Limit: limit.Limit, Refill: common.Rate{Value: 1}},
+		{Limit: limit.Limit, Refill: common.Rate{Interval: time.Second}},
+		{Limit: limit.Limit, Refill: limit.Refill, Global: &Config{Limit: limit.Limit}},
+	}
+	for _, cfg := range invalid {
+		assert.Error(t, cfg.Validate())
+	}
 }
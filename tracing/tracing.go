@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/fedragon/rate-limiter/common"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EventName is the name of the span events recording rate-limiting decisions.
+const EventName = "ratelimit.decision"
+
+// Attributes of rate-limiting decisions.
+const (
+	Algorithm    = attribute.Key("ratelimit.algorithm")
+	Key          = attribute.Key("ratelimit.key")
+	Route        = attribute.Key("ratelimit.route")
+	Outcome      = attribute.Key("ratelimit.outcome")
+	Allowed      = attribute.Key("ratelimit.allowed")
+	Limit        = attribute.Key("ratelimit.limit")
+	Remaining    = attribute.Key("ratelimit.remaining")
+	RetryAfterMs = attribute.Key("ratelimit.retry_after_ms")
+)
+
+// Record records the decision taken by a rate limiter on a request as an event of the request span, if any, and
+// returns the request carrying the decision in its context (see common.DecisionFromContext). The key identifies the
+// bucket the decision was taken on (e.g. the user ID), if any, while the route identifies the limited path. Since keys
+// may be credentials (e.g. API keys), only their hash is recorded (see HashKey).
+// The outcome is also set as an attribute of the span, so that rejected requests can be searched for.
+func Record(r *http.Request, algorithm, key, route string, d common.Decision) *http.Request {
+	span := trace.SpanFromContext(r.Context())
+	if span.IsRecording() {
+		attrs := []attribute.KeyValue{
+			Algorithm.String(algorithm),
+			Route.String(route),
+			Outcome.String(d.Outcome.String()),
+			Allowed.Bool(d.Allowed()),
+			Limit.Int(d.Limit),
+			Remaining.Int(d.Remaining),
+			RetryAfterMs.Int64(d.RetryAfter.Milliseconds()),
+		}
+
+		if key != "" {
+			attrs = append(attrs, Key.String(HashKey(key)))
+		}
+
+		span.AddEvent(EventName, trace.WithAttributes(attrs...))
+		span.SetAttributes(Outcome.String(d.Outcome.String()))
+	}
+
+	return r.WithContext(common.WithDecision(r.Context(), d))
+}
+
+// HashKey returns the value of the key attribute recorded for the provided key: a truncated SHA-256 hash, which allows
+// correlating the decisions taken on the same key without revealing it.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
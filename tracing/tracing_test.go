@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fedragon/rate-limiter/common"
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRecord(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "request")
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil).WithContext(ctx)
+
+	d := common.Decision{Outcome: common.Denied, Limit: 10, RetryAfter: 1500 * time.Millisecond}
+	r = Record(r, "token_bucket", "alice", "/foo", d)
+	span.End()
+
+	got, ok := common.DecisionFromContext(r.Context())
+	assert.True(t, ok)
+	assert.Equal(t, d, got)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes(), Outcome.String("denied"))
+
+	events := spans[0].Events()
+	assert.Len(t, events, 1)
+	assert.Equal(t, EventName, events[0].Name)
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		Algorithm.String("token_bucket"),
+		Key.String(HashKey("alice")),
+		Route.String("/foo"),
+		Outcome.String("denied"),
+		Allowed.Bool(false),
+		Limit.Int(10),
+		Remaining.Int(0),
+		RetryAfterMs.Int64(1500),
+	}, events[0].Attributes)
+}
+
+func TestRecord_WithoutSpan(t *testing.T) {
+	r := Record(httptest.NewRequest(http.MethodGet, "/foo", nil), "leaking_bucket", "", "/foo", common.Decision{})
+
+	d, ok := common.DecisionFromContext(r.Context())
+	assert.True(t, ok)
+	assert.Equal(t, common.Allowed, d.Outcome)
+}
+
+func TestHashKey(t *testing.T) {
+	assert.Len(t, HashKey("secret"), 16)
+	assert.NotContains(t, HashKey("secret"), "secret")
+	assert.Equal(t, HashKey("secret"), HashKey("secret"))
+	assert.NotEqual(t, HashKey("secret"), HashKey("other"))
+}